@@ -3,6 +3,7 @@ package boji
 import (
 	"os"
 	"io"
+	"time"
 	"archive/zip"
 )
 
@@ -13,6 +14,7 @@ type archivableDir struct {
 	path string
 	zreader *zip.ReadCloser
 	filesRead int
+	modTime time.Time
 
 	stats *telemetryStats
 }
@@ -82,6 +84,14 @@ func (this *archivableDir) Readdir(count int) ([]os.FileInfo, error) {
 }
 
 func (this *archivableDir) Close() error {
+	if this.modTime.IsZero() {
+		return nil
+	}
+	return os.Chtimes(this.path, this.modTime, this.modTime)
+}
+
+func (this *archivableDir) SetModTime(modTime time.Time) error {
+	this.modTime = modTime
 	return nil
 }
 func (this *archivableDir) Read(p []byte) (n int, err error) {
@@ -11,6 +11,7 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"time"
 	"golang.org/x/net/webdav"
 )
 
@@ -24,14 +25,102 @@ import (
 type archivableFS struct {
 	path string
 	stats *telemetryStats
+	props *propertyStore
+	digests *digestCache
+	quotas *quotaManager
+	trash *trashBin
+	versions *versionStore
+	changes *changeFeed
+	fulltext *fullTextIndex
+	photos *photoOrganizer
+	groupware *groupwareCollections
+	mimeTypes *mimeResolver
 }
 
 func (this archivableFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
 	this.stats.directoriesCreated++
-	return webdav.Dir(this.path).Mkdir(ctx, name, perm)
+
+	err := webdav.Dir(this.path).Mkdir(ctx, name, perm)
+	if err == nil {
+		this.changes.publish("create", name, "", true)
+	}
+	return err
 }
 
 func (this archivableFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+
+	// anything about to be overwritten is kept as a version first.
+	var replaced string
+	if flag & os.O_TRUNC != 0 {
+		var err error
+		replaced, err = this.versions.capture(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	existed := true
+	var tracked func()
+	allowance := int64(-1)
+	if isFlagWriteable(flag) {
+		path := this.resolve(name)
+		existed = existsOnDisk(path)
+
+		// measured before it's opened, since opening might truncate it. Directories don't change size by being opened.
+		stat, err := os.Stat(path)
+		if err != nil || !stat.IsDir() {
+			tracked = this.quotas.track(name)
+
+			limit, limited := this.quotas.allowance(name, flag & os.O_TRUNC != 0)
+			if limited {
+				allowance = limit
+				if allowance < 0 {
+					allowance = 0
+				}
+			}
+		}
+	}
+
+	file, err := this.open(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if isFlagWriteable(flag) {
+		this.changes.startWriting(name)
+	}
+
+	// clients may tell us what the modification time of a file they're uploading ought to be.
+	modTime, ok := ctx.Value(contextModTime).(time.Time)
+	if ok && isFlagWriteable(flag) {
+		setter, ok := file.(modTimeSetter)
+		if ok {
+			setter.SetModTime(modTime)
+		}
+	}
+
+	ret := &servedFile {
+		File: file,
+		fs: this,
+		name: name,
+		path: this.resolve(name),
+		flag: flag,
+		created: !existed,
+		props: this.props,
+		tracked: tracked,
+		allowance: allowance,
+		replaced: replaced,
+	}
+	ret.exceeded, _ = ctx.Value(contextQuotaExceeded).(*bool)
+
+	// encrypted files can only be indexed while their key is known.
+	_, encrypted := file.(*encryptedFileW)
+	if encrypted {
+		ret.key, _ = ctx.Value(contextEncryptionKey).([]byte)
+	}
+	return ret, nil
+}
+
+func (this archivableFS) open(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
 	
 	var key []byte
 
@@ -103,6 +192,11 @@ func (this archivableFS) OpenFile(ctx context.Context, name string, flag int, pe
 		}
 	}
 
+	// a bare O_RDWR is only ever used to patch properties, and directories can't be opened that way.
+	if !isFlagWriteable(flag) {
+		flag = os.O_RDONLY
+	}
+
 	// not found, not encrypted, try it straight
 	return newRegularFile(this.path, ctx, name, flag, perm)
 }
@@ -117,15 +211,55 @@ func (this archivableFS) Stat(ctx context.Context, name string) (os.FileInfo, er
 	}
 	defer f.Close()
 
-	fi, err := f.Stat()
-	if err != nil {
-		return fi, err
+	return f.Stat()
+}
+
+/*
+	Stats anything that would be listed in its directory - which, unlike [Stat], includes encrypted files when there's no key.
+*/
+func (this archivableFS) statListed(ctx context.Context, name string) (os.FileInfo, error) {
+
+	info, err := this.Stat(ctx, name)
+	if err == nil {
+		return info, nil
 	}
-	return hideEncryptionInfo(fi), nil
+
+	stat, statErr := os.Stat(this.resolve(name) + encryptedExtension)
+	if statErr != nil {
+		return nil, err
+	}
+	return this.wrapInfo(name, this.resolve(name), hideEncryptionInfo(stat)), nil
 }
 
 func (this archivableFS) Rename(ctx context.Context, oldName, newName string) error {
 
+	// properties have to be read before the move, since wherever they live might not survive it.
+	props, err := this.props.load(this.resolve(oldName))
+	if err != nil {
+		return err
+	}
+
+	oldTracked := this.quotas.track(oldName)
+	newTracked := this.quotas.track(newName)
+
+	err = this.rename(ctx, oldName, newName)
+	if err != nil {
+		return err
+	}
+	this.digests.remove(this.resolve(oldName))
+	oldTracked()
+	newTracked()
+	this.versions.move(oldName, newName)
+	this.groupware.move(oldName, newName)
+
+	stat, err := os.Stat(this.resolve(newName))
+	this.changes.publish("move", oldName, newName, err == nil && stat.IsDir())
+
+	return this.props.move(this.resolve(oldName), this.resolve(newName), props)
+}
+
+func (this archivableFS) rename(ctx context.Context, oldName, newName string) error {
+
 	var fromPath string
 
 	oldPath := this.resolve(oldName)
@@ -143,7 +277,7 @@ func (this archivableFS) Rename(ctx context.Context, oldName, newName string) er
 
 		oldFilename := filepath.Base(oldPath)
 		newFilename := filepath.Base(newPath)
-		_, err = rewriteArchive(zreaderFrom, archiveFrom, oldFilename, newFilename, "")
+		_, err = rewriteArchive(zreaderFrom, archiveFrom, oldFilename, newFilename, "", time.Time{})
 		return err
 	}
 
@@ -186,7 +320,7 @@ func (this archivableFS) Rename(ctx context.Context, oldName, newName string) er
 		// at the end of this, delete from the old archive.
 		defer func(){
 			if err == nil {
-				rewriteArchive(zreaderFrom, archiveFrom, "", "", fromFilename)
+				rewriteArchive(zreaderFrom, archiveFrom, "", "", fromFilename, time.Time{})
 			}
 		}()
 	} else {
@@ -210,14 +344,14 @@ func (this archivableFS) Rename(ctx context.Context, oldName, newName string) er
 		defer os.Remove(toPath)
 
 		// rewrite target archive with the new file
-		_, err = rewriteArchive(zreaderTo, archiveTo, toFilename, "", "")
+		_, err = rewriteArchive(zreaderTo, archiveTo, toFilename, "", "", time.Time{})
 		return err
 	}
 
 	return nil
 }
 
-func (this archivableFS) RemoveAll(ctx context.Context, name string) error {
+func (this archivableFS) RemoveAll(ctx context.Context, name string) (err error) {
 
 	this.stats.filesRemoved++
 
@@ -226,32 +360,84 @@ func (this archivableFS) RemoveAll(ctx context.Context, name string) error {
 		return errors.New("Unable to resolve local file")
 	}
 
+	// as webdav.Dir refuses, since it would take everything with it.
+	if slashClean(name) == "/" {
+		return os.ErrPermission
+	}
+
 	filename := filepath.Base(path)
 	dir := filepath.Dir(path)
 	archive := filepath.Join(dir, "archive.zip")
 	encrypted := path + encryptedExtension
-	
+
+	defer this.quotas.track(name)()
+
+	// being replaced by a MOVE or COPY (as apps that save safely do) is an overwrite, so it's kept as a version,
+	// and the file's history carries on. Only a real delete lets it go.
+	replacing, _ := ctx.Value(contextReplacing).(bool)
+	if replacing {
+		_, err = this.versions.capture(ctx, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	stat, err := os.Stat(path)
+	directory := err == nil && stat.IsDir()
+	defer func() {
+		if err == nil {
+			this.changes.publish("delete", name, "", directory)
+		}
+	}()
+
+	// deletes are only moved to the trash, if there is one.
+	if this.trash != nil {
+		this.digests.remove(path)
+		owner, _ := ctx.Value(contextUsername).(string)
+		err = this.trash.put(name, owner)
+		if err == nil && !replacing {
+			this.versions.forget(name)
+		}
+		return err
+	}
+
+	err = removeFromDisk(ctx, this.path, name, archive, filename, encrypted)
+	if err != nil {
+		return err
+	}
+
+	// only once it's really gone, so that a delete which fails leaves everything as it was.
+	this.digests.remove(path)
+	if !replacing {
+		this.versions.forget(name)
+	}
+	return this.props.remove(path)
+}
+
+func removeFromDisk(ctx context.Context, root string, name string, archive string, filename string, encrypted string) error {
+
 	zreader, err := zip.OpenReader(archive)
 	if err == nil {
-		_, err = rewriteArchive(zreader, archive, "", "", filename)	
+		_, err = rewriteArchive(zreader, archive, "", "", filename, time.Time{})	
 		return err	
 	}
 
 	efd, err := os.Open(encrypted)
 	if err == nil {
 		efd.Close()
-		return webdav.Dir(this.path).RemoveAll(ctx, name + encryptedExtension)
+		return webdav.Dir(root).RemoveAll(ctx, name + encryptedExtension)
 	}
 
 	// not encrypted or compressed, play it straight.
-	return webdav.Dir(this.path).RemoveAll(ctx, name)
+	return webdav.Dir(root).RemoveAll(ctx, name)
 }
 
 /*
 	Zips all files in the directory (ignoring subdirs) into an archive zip.
 	Removes all files afterwards.
+	Any properties held by those files are kept in the given store (which may be nil).
 */
-func archiveDir(dir string) error {
+func archiveDir(dir string, props *propertyStore) error {
 
 	children, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -299,7 +485,13 @@ func archiveDir(dir string) error {
 		if stat.IsDir() {
 			continue
 		}
-		os.Remove(filepath.Join(dir, stat.Name()))
+
+		childPath := filepath.Join(dir, stat.Name())
+		err = props.detach(childPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to keep properties of '%s': %v\n", childPath, err)
+		}
+		os.Remove(childPath)
 	}
 
 	return nil
@@ -393,8 +585,30 @@ func resolve(root, name string) string {
 	return filepath.Join(root, filepath.FromSlash(slashClean(name)))
 }
 
+/*
+	Whether the given name is an ordinary file on disk - neither an archive member nor encrypted -
+	such that it can be modified in place.
+*/
+func (this archivableFS) isPlainFile(name string) bool {
+
+	path := this.resolve(name)
+
+	_, err := os.Stat(filepath.Join(filepath.Dir(path), "archive.zip"))
+	if err == nil {
+		return false
+	}
+
+	stat, err := os.Stat(path)
+	return err == nil && stat.Mode().IsRegular()
+}
+
+/*
+	Whether or not the given flag means the caller intends to (re)write the file.
+	A bare O_RDWR doesn't count - the webdav handler opens files that way just to patch their properties,
+	and treating that as a write would truncate archived or encrypted files.
+*/
 func isFlagWriteable(flag int) bool {
-	return flag & os.O_CREATE != 0 || flag & os.O_RDWR != 0 || flag & os.O_WRONLY != 0
+	return flag & os.O_CREATE != 0 || flag & os.O_TRUNC != 0 || flag & os.O_WRONLY != 0
 }
 
 func slashClean(name string) string {
@@ -3,8 +3,8 @@ package boji
 import (
 	"archive/zip"
 	"os"
-	"io"
-	"io/ioutil"
+	"time"
+	"path/filepath"
 )
 
 /*
@@ -14,10 +14,10 @@ import (
 type archiveFile struct {
 	path string
 	zfile *zip.File
-	zreader io.ReadCloser
+	stream *seekableStream
 	stats *telemetryStats
 
-	seekPos int64
+	modTime time.Time
 }
 
 func newArchiveFile(path string, zfile *zip.File, stats *telemetryStats) *archiveFile {
@@ -25,6 +25,9 @@ func newArchiveFile(path string, zfile *zip.File, stats *telemetryStats) *archiv
 		zfile: zfile,
 		path: path,
 		stats: stats,
+		stream: newSeekableStream(zfile.Open, func() (int64, error) {
+			return int64(zfile.UncompressedSize64), nil
+		}),
 	}
 }
 
@@ -38,52 +41,13 @@ func (this *archiveFile) Stat() (os.FileInfo, error) {
 }
 
 func (this *archiveFile) Read(p []byte) (int, error) {
-
-	var err error
-
-	if this.zreader == nil {
-		this.zreader, err = this.zfile.Open()
-		if err != nil {
-			return 0, err
-		}
-	}
-	
-	n, err := this.zreader.Read(p)
+	n, err := this.stream.Read(p)
 	this.stats.bytesRead += int64(n)
 	return n, err
 }
 
-func (this *archiveFile) Seek(offset int64, whence int) (n int64, err error) {
-	
-	switch whence {
-	case os.SEEK_SET: this.seekPos = offset
-		
-		// reset the zip reader
-		if this.zreader != nil {
-			this.zreader.Close()
-		}
-
-		this.zreader, err = this.zfile.Open()
-		if err != nil {
-			return 0, err
-		}
-		
-		io.CopyN(ioutil.Discard, this.zreader, offset)
-
-	case os.SEEK_CUR: this.seekPos += offset
-		if this.zreader != nil {
-			io.CopyN(ioutil.Discard, this.zreader, offset)
-		}
-
-	case os.SEEK_END: 
-		stat, err := this.Stat()
-		if err != nil {
-			return -1, err
-		}
-		this.seekPos = stat.Size() + offset
-	}
-
-	return this.seekPos, nil	
+func (this *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	return this.stream.Seek(offset, whence)
 }
 
 func (this *archiveFile) Write(p []byte) (n int, err error) {
@@ -92,8 +56,28 @@ func (this *archiveFile) Write(p []byte) (n int, err error) {
 
 func (this *archiveFile) Close() error {
 	
-	if this.zreader == nil {
+	err := this.stream.Close()
+	if err != nil {
+		return err
+	}
+
+	if this.modTime.IsZero() {
 		return nil
 	}
-	return this.zreader.Close()
+
+	// changing the time of an archived file means rewriting the archive with a new header for it.
+	archivePath := filepath.Join(this.path, "archive.zip")
+	zreader, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zreader.Close()
+
+	_, err = rewriteArchive(zreader, archivePath, this.zfile.Name, this.zfile.Name, "", this.modTime)
+	return err
+}
+
+func (this *archiveFile) SetModTime(modTime time.Time) error {
+	this.modTime = modTime
+	return nil
 }
\ No newline at end of file
@@ -4,6 +4,7 @@ import (
 	"archive/zip"
 	"os"
 	"io"
+	"time"
 	"path/filepath"
 )
 
@@ -22,7 +23,7 @@ type archiveFileW struct {
 	tempfilePath string
 
 	stat os.FileInfo
-	seekPos int64
+	modTime time.Time
 
 	stats *telemetryStats
 }
@@ -47,16 +48,9 @@ func newArchiveFileW(archivePath string, filename string, zreader *zip.ReadClose
 	}, nil
 }
 
+// writes go to a plain temp file until close, so seeking is just seeking that file.
 func (this *archiveFileW) Seek(offset int64, whence int) (n int64, err error) {
-	
-	switch whence {
-	case os.SEEK_END:
-		fallthrough // a bug i know, but this should never really be a thing
-	case os.SEEK_SET: this.seekPos = offset
-	case os.SEEK_CUR: this.seekPos += offset
-	}
-
-	return this.seekPos, nil	
+	return this.tempfile.Seek(offset, whence)
 }
 
 func (this *archiveFileW) Write(p []byte) (int, error) {
@@ -70,11 +64,24 @@ func (this *archiveFileW) Close() error {
 	defer os.Remove(this.tempfilePath)
 	this.tempfile.Close()
 	
-	stat, err := rewriteArchive(this.zreader, this.archivePath, this.filename, "", "")
+	stat, err := rewriteArchive(this.zreader, this.archivePath, this.filename, "", "", this.modTime)
 	this.stat = stat
 	return err
 }
 
+// throws away what was written without touching the archive.
+func (this *archiveFileW) Discard() error {
+	this.tempfile.Close()
+	this.zreader.Close()
+	return os.Remove(this.tempfilePath)
+}
+
+// the given time will be written to the archive as this file's modification time, rather than the time it was uploaded.
+func (this *archiveFileW) SetModTime(modTime time.Time) error {
+	this.modTime = modTime
+	return nil
+}
+
 func (this *archiveFileW) Readdir(count int) ([]os.FileInfo, error) {
 	return []os.FileInfo{}, nil
 }
@@ -100,8 +107,10 @@ func (this *archiveFileW) Read(p []byte) (n int, err error) {
 	If `renameWith` is also specified, the `replaceFile` will be kept the same as it currently exists in the archive, just with a new name.
 	If neither are specified, nothing happens.
 	If `deleteFrom` is specified, the given file will be ommitted during rewrites.
+	If `modTime` is non-zero, it becomes the modification time of `replaceFile` (whether it was added, updated, or renamed).
+	Renaming a file to its own name with a `modTime` just changes its modification time.
 */
-func rewriteArchive(zreader *zip.ReadCloser, archivePath string, replaceFile, renameWith, deleteFrom string) (os.FileInfo, error) {
+func rewriteArchive(zreader *zip.ReadCloser, archivePath string, replaceFile, renameWith, deleteFrom string, modTime time.Time) (os.FileInfo, error) {
 
 	var stat os.FileInfo
 
@@ -136,7 +145,12 @@ func rewriteArchive(zreader *zip.ReadCloser, archivePath string, replaceFile, re
 			return nil, err
 		}
 
-		err = compressFile(zipped.FileInfo(), name, zwriter, zippedReader)
+		info := zipped.FileInfo()
+		if zipped.Name == replaceFile {
+			info = withModTime(info, modTime)
+		}
+
+		err = compressFile(info, name, zwriter, zippedReader)
 		zippedReader.Close()
 		if err != nil {
 			return nil, err
@@ -156,6 +170,7 @@ func rewriteArchive(zreader *zip.ReadCloser, archivePath string, replaceFile, re
 		if err != nil {
 			return nil, err
 		}
+		stat = withModTime(stat, modTime)
 
 		err = compressFile(stat, stat.Name(), zwriter, newFile)
 		if err != nil {
@@ -8,6 +8,8 @@ import (
 	"context"
 	"net/http"
 	"time"
+	"crypto/tls"
+	"path/filepath"
 	"golang.org/x/net/webdav"
 )
 
@@ -17,37 +19,194 @@ type ServerSettings struct {
 	Address string
 	Port int
 	Root string
+	StateDir string
+	StagingDir string
+	StaticDir string
+	Quota string
+	TrashRetention int
+	Versions string
+	WatchInterval time.Duration
+	ReplicationPeer string
+	ReplicationInterval time.Duration
+	AcceptReplicas bool
+	SearchIndex bool
+	FullTextIndex bool
 	AdminUsername string
 	AdminPassword string
 
 	InfluxURL string
 	InfluxBucket string	
+
+	// when given, these replace the admin user.
+	Users map[string]string
+	Rules map[string]DirectoryRule
+
+	// where these settings were loaded from, if anywhere, what they were loaded over, and what overrides them - so they can be reloaded.
+	ConfigPath string
+	commandLine *ServerSettings
+	overrides func(*ServerSettings)
 }
 
 type Server struct {
 	Settings ServerSettings
 	wdav *webdav.Handler
+	fs archivableFS
+	locks *persistentLS
+	props *propertyStore
+	uploads *uploadManager
+	quotas *quotaManager
+	trash *trashBin
+	versions *versionStore
+	snapshots *snapshotStore
+	replicator *replicator
+	webhooks *webhookDispatcher
+	watcher *diskWatcher
+	searches *searchIndex
+	thumbnails *thumbnailCache
 	telemetry *telemetry
+	users *userAccounts
+	certificates *certificateStore
+
+	// what was last loaded from the config file, which can change without a restart.
+	applied *ServerSettings
 
 	stopTelemetry chan bool
+	stopMaintenance chan bool
+	stopReloads chan bool
 }
 
-func NewServer(settings ServerSettings) *Server {
+func NewServer(settings ServerSettings) (*Server, error) {
 
 	telemetry := newTelemetry(settings.InfluxURL, settings.InfluxBucket)
 
-	return &Server{
+	err := validateSettings(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// locks are kept outside the served root, so that clients never see the journal.
+	locks, err := newPersistentLS(filepath.Join(settings.StateDir, "locks.journal"), &(telemetry.stats))
+	if err != nil {
+		return nil, err
+	}
+
+	quotas, err := newQuotaManager(settings.Root, settings.StateDir, settings.Quota)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := newVersionStore(settings.Root, settings.StateDir, settings.Versions)
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := newChangeJournal(settings.StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := newChangeFeed(journal)
+	if err != nil {
+		return nil, err
+	}
+
+	fulltext, err := newFullTextIndex(settings.StateDir, settings.FullTextIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	photos, err := newPhotoOrganizer(settings.StateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	groupware, err := newGroupwareCollections(settings.StateDir, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	props := newPropertyStore(settings.Root, settings.StateDir)
+	fs := archivableFS {
+		path: settings.Root,
+		stats: &(telemetry.stats),
+		props: props,
+		digests: newDigestCache(settings.Root, settings.StateDir),
+		quotas: quotas,
+		versions: versions,
+		changes: changes,
+		fulltext: fulltext,
+		photos: photos,
+		groupware: groupware,
+		mimeTypes: newMimeResolver(settings.Root),
+	}
+
+	// the trash deletes through the filesystem it's part of.
+	trash := newTrashBin(settings.StateDir, settings.TrashRetention)
+	fs.trash = trash
+	if trash != nil {
+		trash.fs = fs
+	}
+	versions.fs = fs
+	photos.fs = fs
+	if fulltext != nil {
+		fulltext.fs = fs
+	}
+
+	snapshots := newSnapshotStore(settings.Root, settings.StateDir)
+	snapshots.live = fs
+
+	webhooks, err := newWebhookDispatcher(settings.StateDir, changes, &(telemetry.stats))
+	if err != nil {
+		return nil, err
+	}
+
+	replicator, err := newReplicator(settings.Root, settings.StateDir, settings.ReplicationPeer, settings.ReplicationInterval, &(telemetry.stats))
+	if err != nil {
+		return nil, err
+	}
+
+	// only served over TLS if both files are there.
+	var certificates *certificateStore
+	_, certErr := os.Stat(settings.TLSCertPath)
+	_, keyErr := os.Stat(settings.TLSKeyPath)
+
+	if certErr == nil && keyErr == nil {
+		certificates = &certificateStore{}
+		err = certificates.load(settings.TLSCertPath, settings.TLSKeyPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applied := settings
+	server := &Server{
 		Settings: settings,
+		fs: fs,
+		props: props,
+		uploads: newUploadManager(settings.StagingDir, fs, locks, &(telemetry.stats)),
+		quotas: quotas,
+		trash: trash,
+		versions: versions,
+		snapshots: snapshots,
+		replicator: replicator,
+		webhooks: webhooks,
+		watcher: newDiskWatcher(fs, settings.WatchInterval, replicator.notify),
+		searches: newSearchIndex(fs, settings.SearchIndex),
+		thumbnails: newThumbnailCache(settings.StateDir),
 		wdav: &webdav.Handler {
-			FileSystem: archivableFS{
-				path: settings.Root,
-				stats: &(telemetry.stats),
-			},
-			LockSystem: webdav.NewMemLS(),
+			FileSystem: snapshotFS{archivableFS: fs, snapshots: snapshots},
+			LockSystem: locks,
 			Logger: logStderr,
 		},
+		locks: locks,
 		telemetry: telemetry,
+		users: newUserAccounts(settings),
+		certificates: certificates,
+		applied: &applied,
 	}
+
+	server.applyRules(settings.Rules, nil)
+	return server, nil
 }
 
 func (this *Server) Listen() error {
@@ -60,20 +219,56 @@ func (this *Server) Listen() error {
 	this.stopTelemetry = make(chan bool)
 	go this.runTelemetry()
 
+	this.stopMaintenance = make(chan bool)
+	go this.runMaintenance()
+
+	go this.webhooks.run()
+	go this.watcher.run()
+	go this.searches.run()
+	go this.fs.fulltext.run()
+
+	if this.replicator != nil {
+		fmt.Printf("Replicating to '%s'\n", this.replicator.peer.Host)
+		go this.replicator.run()
+	}
+
+	if this.Settings.ConfigPath != "" {
+		this.stopReloads = make(chan bool)
+		go this.runConfigReloads(this.stopReloads)
+	}
+
 	defer func(){
 		this.stopTelemetry <- true
 		close(this.stopTelemetry)
+		this.stopMaintenance <- true
+		close(this.stopMaintenance)
+		this.replicator.Close()
+		this.webhooks.Close()
+		this.watcher.Close()
+		this.searches.Close()
+		this.fs.fulltext.Close()
+		this.locks.Close()
+		if this.stopReloads != nil {
+			close(this.stopReloads)
+		}
 	}()
 
 	path := fmt.Sprintf("%s:%d", this.Settings.Address, this.Settings.Port)
 
 	// if we're set up for TLS, serve https
-	_, certErr := os.Stat(this.Settings.TLSCertPath)
-	_, keyErr := os.Stat(this.Settings.TLSKeyPath)
+	if this.certificates != nil {
+
+		// the certificate is handed out per connection, so that it can be replaced by reloading.
+		server := &http.Server {
+			Addr: path,
+			Handler: this.authenticatedHandler(),
+			TLSConfig: &tls.Config {
+				GetCertificate: this.certificates.get,
+			},
+		}
 
-	if certErr == nil && keyErr == nil {
 		fmt.Printf("Listening on TLS %s\n", path)
-		return http.ListenAndServeTLS(path, this.Settings.TLSCertPath, this.Settings.TLSKeyPath, this.authenticatedHandler())
+		return server.ListenAndServeTLS("", "")
 	}
 
 	// otherwise just plain http
@@ -84,21 +279,27 @@ func (this *Server) Listen() error {
 func (this *Server) authenticatedHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+		// the UI is just files, and logs in for itself.
+		if this.attemptUIRequest(w, r) {
+			return
+		}
+
 		// auth
 		username, password, key, err := parseAuth(r)
 		if err != nil {
 			this.telemetry.stats.failedAuths++
-			w.Header().Set("WWW-Authenticate", `Basic realm="boji"`)
+			challenge(w, r)
 			http.Error(w, err.Error(), 401)
 			return
 		} 
 
-		if username != this.Settings.AdminUsername || password != this.Settings.AdminPassword {
+		if !this.users.check(username, password) {
 			this.telemetry.stats.failedAuths++
-			w.Header().Set("WWW-Authenticate", `Basic realm="boji"`)
+			challenge(w, r)
 			http.Error(w, "Not authorized", 401)
 			return
 		}
+		r = r.WithContext(context.WithValue(r.Context(), contextUsername, username))
 
 		// informational header so that clients can be assured encryption is actually working.
 		if key != "" {
@@ -109,6 +310,98 @@ func (this *Server) authenticatedHandler() http.Handler {
 			r = r.WithContext(context.WithValue(r.Context(), contextEncryptionKey, []byte(key)))
 		}
 
+		// sync clients tell us the original modification time of whatever they're uploading
+		if r.Method == "PUT" {
+			modTime, err := parseOCMtime(r)
+			if err != nil {
+				http.Error(w, "Invalid X-OC-Mtime", 400)
+				return
+			}
+			if !modTime.IsZero() {
+				w.Header().Set("X-OC-MTime", "accepted")
+				r = r.WithContext(context.WithValue(r.Context(), contextModTime, modTime))
+			}
+		}
+
+		// a MOVE or COPY onto something that exists removes it first, but that's an overwrite rather than a delete.
+		if r.Method == "MOVE" || r.Method == "COPY" {
+			r = r.WithContext(context.WithValue(r.Context(), contextReplacing, true))
+		}
+
+		// snapshots are read-only, and only webdav knows how to read them.
+		_, _, isSnapshot := splitSnapshotName(this.Settings.Root, r.URL.Path)
+		if isSnapshot && (r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH") {
+			http.Error(w, "Snapshots are read-only", http.StatusForbidden)
+			return
+		}
+
+		if this.attemptUIPage(w, r) {
+			return
+		}
+
+		if this.attemptEventRequest(w, r) {
+			return
+		}
+
+		if this.attemptWebhookRequest(w, r) {
+			return
+		}
+
+		// replicas are raw files, which don't pass through the filesystem at all.
+		if this.attemptReplicaRequest(w, r) {
+			return
+		}
+
+		// anything which might change the tree is worth replicating soon.
+		if r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" && r.Method != "PROPFIND" && r.Method != "REPORT" && r.Method != "SEARCH" {
+			defer this.replicator.notify()
+		}
+
+		// resumable uploads have their own protocol entirely.
+		if this.uploads.attempt(w, r) {
+			return
+		}
+
+		if this.attemptTrashRequest(w, r) {
+			return
+		}
+
+		if this.attemptSnapshotRequest(w, r) {
+			return
+		}
+
+		if this.attemptVersionRequest(w, r) {
+			return
+		}
+
+		if this.attemptPartialUpdate(w, r) {
+			return
+		}
+
+		if this.attemptSyncReport(w, r) {
+			return
+		}
+
+		if this.attemptSearchRequest(w, r) {
+			return
+		}
+
+		if this.attemptThumbnailRequest(w, r) {
+			return
+		}
+
+		if this.attemptFullTextRequest(w, r, key) {
+			return
+		}
+
+		if this.attemptOrganizeRequest(w, r) {
+			return
+		}
+
+		if this.attemptGroupwareRequest(w, r) {
+			return
+		}
+
 		// check to see if this is a request to compress a directory
 		areq, err := this.attemptArchiveRequest(r)
 		if err != nil {
@@ -122,9 +415,61 @@ func (this *Server) authenticatedHandler() http.Handler {
 			return
 		}
 
-		if !areq && !ereq {
-			this.wdav.ServeHTTP(w, r)
+		qreq, err := this.attemptQuotaRequest(r)
+		if err == errAdminOnly {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		if areq || ereq || qreq {
+			// compressing or encrypting changes how much is on disk.
+			this.quotas.invalidate(r.URL.Path)
+			return
+		}
+
+		// checksums are verified before anything is written, and given back on every read.
+		switch r.Method {
+		case "PUT":
+			err = this.quotas.check(r.URL.Path, r.ContentLength, true)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInsufficientStorage)
+				return
+			}
+
+			cleanup, err := this.verifyUpload(r)
+			defer cleanup()
+
+			if err == errChecksumMismatch {
+				this.telemetry.stats.checksumFailures++
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+
+			// a body without a length is only stopped once it's written too much, and webdav can't tell that from any other failure.
+			exceeded := false
+			r = r.WithContext(context.WithValue(r.Context(), contextQuotaExceeded, &exceeded))
+			w = &quotaResponse {
+				ResponseWriter: w,
+				exceeded: &exceeded,
+			}
+
+		case "GET", "HEAD":
+			this.addChecksumHeaders(w, r)
+			this.addContentTypeHeader(w, r)
 		}
+
+		// the handler's lock system has to know which of its locks are only for this request.
+		wdav := *this.wdav
+		wdav.LockSystem = this.locks.forRequest(r)
+		wdav.ServeHTTP(w, r)
 	})
 }
 
@@ -144,12 +489,18 @@ func (this Server) attemptArchiveRequest(r *http.Request) (bool, error) {
 			return true, err
 		}
 
+		this.fs.changes.startWriting(r.URL.Path)
+		defer this.fs.changes.finishWriting(r.URL.Path)
+
 		compressed := compressQuery[0] == "true"
 		if compressed {
-			return true, archiveDir(path)
+			err = archiveDir(path, this.props)
+			this.publishJob(r.URL.Path, "compress", err)
 		} else {
-			return true, unarchiveDir(path)
+			err = unarchiveDir(path)
+			this.publishJob(r.URL.Path, "uncompress", err)
 		}
+		return true, err
 	}
 
 	return false, nil
@@ -170,20 +521,91 @@ func (this Server) attemptEncryptionRequest(r *http.Request, key string) (bool,
 			return true, err
 		}
 
+		this.fs.changes.startWriting(r.URL.Path)
+		defer this.fs.changes.finishWriting(r.URL.Path)
+
 		encrypted := encryptQuery[0] == "true"
 		recursiveStr, ok := query["recursive"]
 		recursive := !ok || recursiveStr[0] == "true"
 
 		if encrypted {
-			return true, encryptDir(path, []byte(key), recursive)
+			err = encryptDir(path, []byte(key), recursive)
+			this.publishJob(r.URL.Path, "encrypt", err)
 		} else {
-			return true, decryptDir(path, []byte(key), recursive)
+			err = decryptDir(path, []byte(key), recursive)
+			this.publishJob(r.URL.Path, "decrypt", err)
+		}
+		return true, err
+	}
+
+	return false, nil
+}
+
+// tells anyone listening that a whole directory was compressed, encrypted, or the reverse - if it was.
+func (this Server) publishJob(urlPath string, kind string, err error) {
+	if err == nil {
+		this.fs.changes.publish(kind, urlPath, "", true)
+	}
+}
+
+/*
+	Checks to see if this is a request to set the quota of a top-level directory, such as `POST /photos?quota=10G`.
+	A quota of "none" removes the limit, and "default" reverts to the `-q` flag.
+*/
+func (this Server) attemptQuotaRequest(r *http.Request) (bool, error) {
+
+	query := r.URL.Query()
+	quotaQuery, ok := query["quota"]
+	if r.Method == "POST" && ok && len(quotaQuery) > 0 {
+
+		// with more than one user, a quota is only a limit if nobody but the admin can change it.
+		if requestUsername(r) != this.Settings.AdminUsername {
+			return true, errAdminOnly
+		}
+
+		_, err := this.checkDir(r.URL.Path)
+		if err != nil {
+			return true, err
 		}
+		return true, this.quotas.setLimit(r.URL.Path, quotaQuery[0])
 	}
 
 	return false, nil
 }
 
+/*
+	If the client gave any checksums for an upload, stages and verifies the body before it's allowed anywhere near the real file.
+	The returned func cleans up anything that was staged, and must always be called.
+*/
+func (this Server) verifyUpload(r *http.Request) (func(), error) {
+
+	checksums, err := parseExpectedChecksums(r)
+	if err != nil || len(checksums) == 0 {
+		return func(){}, err
+	}
+	return stageVerifiedBody(r, this.Settings.StagingDir, checksums)
+}
+
+/*
+	Adds content checksums of the requested file (if it is one) to the response,
+	if they're already known, or the client asked for them.
+*/
+func (this Server) addChecksumHeaders(w http.ResponseWriter, r *http.Request) {
+
+	ctx := r.Context()
+
+	info, err := this.fs.Stat(ctx, r.URL.Path)
+	if err != nil || info.IsDir() {
+		return
+	}
+
+	digest, err := this.fs.digests.digestIf(wantsDigest(r), this.fs.resolve(r.URL.Path), info, fsOpener(ctx, this.fs, r.URL.Path))
+	if err != nil || digest == nil {
+		return
+	}
+	setChecksumHeaders(w, digest)
+}
+
 /*
 	Resolves the on-disk path to the given [urlPath], and returns whether or not it's an accessible directory.
 */
@@ -219,6 +641,80 @@ func (this *Server) runTelemetry() {
 	}
 }
 
+/*
+	Whether [urlPath] is one of boji's own paths (such as `/_trash/`, given as [prefix]), or anywhere beneath it.
+	Something of the same name in the served root always wins, so that nothing on disk is ever hidden by one.
+*/
+func isReservedPath(root string, urlPath string, prefix string) bool {
+
+	top := strings.TrimSuffix(prefix, "/")
+	if urlPath != top && !strings.HasPrefix(urlPath, top + "/") {
+		return false
+	}
+	return !existsOnDisk(filepath.Join(root, filepath.FromSlash(top)))
+}
+
+// returns true if [path] is [root], or anywhere beneath it.
+func isWithin(root string, path string) bool {
+
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	relative, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return relative != ".." && !strings.HasPrefix(relative, ".." + string(filepath.Separator))
+}
+
+/*
+	Periodically cleans up after anything which leaves data lying around (such as abandoned uploads).
+*/
+func (this *Server) runMaintenance() {
+
+	ticker := time.NewTicker(time.Hour)
+	for {
+		select {
+
+		case <-this.stopMaintenance:
+			return
+
+		case <-ticker.C:
+			this.uploads.expire()
+			this.quotas.invalidateAll()
+			this.trash.expire()
+			this.versions.expire()
+			this.fs.changes.journal.compact()
+			this.locks.compact()
+			this.thumbnails.expire()
+		}
+	}
+}
+
+// the name of whoever made the request, once they've been authenticated.
+func requestUsername(r *http.Request) string {
+
+	username, _ := r.Context().Value(contextUsername).(string)
+	return username
+}
+
+/*
+	Asks for basic auth - unless this is a script's request, like the UI's, in which case the browser
+	shouldn't pop up its own login dialog; the script will ask for itself.
+*/
+func challenge(w http.ResponseWriter, r *http.Request) {
+
+	if r.Header.Get("X-Requested-With") == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="boji"`)
+	}
+}
+
 func parseAuth(r *http.Request) (user string, password string, key string, _ error) {
 
 	username, password, ok := r.BasicAuth()
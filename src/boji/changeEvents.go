@@ -0,0 +1,342 @@
+package boji
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"path"
+	"strings"
+	"strconv"
+	"net/http"
+	"encoding/json"
+)
+
+const eventsPrefix = "/_events"
+const changeFeedSize = 4096
+
+/*
+	A feed of everything that changes in the served tree, so clients can be told rather than having to poll.
+	The most recent events are kept in memory, and all of them in the change journal, each with an ID that always increases.
+	A client that's been away longer than the journal goes back is told to reset, and should re-read whatever it cares about with PROPFIND.
+*/
+type changeFeed struct {
+	journal *changeJournal
+	events []changeEvent
+	nextID int64
+	subscribers map[chan changeEvent]bool
+	writing map[string]int
+	mutex sync.Mutex
+}
+
+type changeEvent struct {
+	ID int64 `json:"id"`
+	Type string `json:"type"`
+	Path string `json:"path"`
+	Destination string `json:"destination,omitempty"`
+	Directory bool `json:"directory,omitempty"`
+	External bool `json:"external,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+func newChangeFeed(journal *changeJournal) (*changeFeed, error) {
+
+	// IDs start from the time, so that they keep increasing even if the journal is lost.
+	nextID := time.Now().UnixNano()
+	last, err := journal.open(nextID)
+	if err != nil {
+		return nil, err
+	}
+	if last >= nextID {
+		nextID = last + 1
+	}
+
+	return &changeFeed {
+		journal: journal,
+		nextID: nextID,
+		subscribers: make(map[chan changeEvent]bool),
+		writing: make(map[string]int),
+	}, nil
+}
+
+/*
+	Records that something changed, and tells everyone listening.
+	[kind] is one of create, modify, delete, move, compress, uncompress, encrypt, or decrypt.
+*/
+func (this *changeFeed) publish(kind string, name string, destination string, directory bool) {
+
+	if this == nil {
+		return
+	}
+
+	event := changeEvent {
+		Type: kind,
+		Path: slashClean(name),
+		Directory: directory,
+	}
+	if destination != "" {
+		event.Destination = slashClean(destination)
+	}
+	this.send(event)
+}
+
+// publishes a change that was made on disk, by something other than boji.
+func (this *changeFeed) publishExternal(kind string, name string, directory bool) {
+
+	if this == nil {
+		return
+	}
+
+	this.send(changeEvent {
+		Type: kind,
+		Path: slashClean(name),
+		Directory: directory,
+		External: true,
+	})
+}
+
+func (this *changeFeed) send(event changeEvent) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	event.ID = this.nextID
+	event.Time = time.Now()
+	this.nextID++
+
+	err := this.journal.append(event)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to record change to '%s' in the journal: %v\n", event.Path, err)
+	}
+
+	this.events = append(this.events, event)
+	if len(this.events) > changeFeedSize {
+		this.events = this.events[len(this.events) - changeFeedSize:]
+	}
+
+	// slow subscribers miss out rather than hold everyone else up; they'll be dropped and have to resume.
+	for subscriber := range this.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(this.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+/*
+	Returns every event after the given cursor (the ID of the last event a client saw), and a channel of every one after that.
+	Returns false if the cursor is too old to resume from, in which case only new events are given.
+	The channel is closed if the subscriber falls too far behind, and must be given back to unsubscribe.
+*/
+func (this *changeFeed) subscribe(cursor int64) ([]changeEvent, chan changeEvent, bool) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	subscriber := make(chan changeEvent, 256)
+	this.subscribers[subscriber] = true
+
+	missed, ok := this.since(cursor)
+	return missed, subscriber, ok
+}
+
+func (this *changeFeed) unsubscribe(subscriber chan changeEvent) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	_, ok := this.subscribers[subscriber]
+	if ok {
+		delete(this.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// every event after the cursor. Caller must hold the mutex.
+func (this *changeFeed) since(cursor int64) ([]changeEvent, bool) {
+
+	if cursor < 0 {
+		return nil, true
+	}
+
+	if cursor >= this.nextID {
+		return nil, false
+	}
+
+	// anything older than what's held in memory has to come from the journal.
+	if (len(this.events) > 0 && cursor < this.events[0].ID - 1) || (len(this.events) == 0 && cursor != this.nextID - 1) {
+		return this.journal.since(cursor)
+	}
+
+	for i, event := range this.events {
+		if event.ID > cursor {
+			return append([]changeEvent{}, this.events[i:]...), true
+		}
+	}
+	return nil, true
+}
+
+/*
+	Marks a name as being written to by boji, until [finishWriting] is called. Changes seen on disk to anything being
+	written (or anything beneath it) are boji's own, and will be published once it's done, so they aren't reported as external.
+*/
+func (this *changeFeed) startWriting(name string) {
+
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.writing[slashClean(name)]++
+}
+
+func (this *changeFeed) finishWriting(name string) {
+
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	name = slashClean(name)
+	this.writing[name]--
+	if this.writing[name] <= 0 {
+		delete(this.writing, name)
+	}
+}
+
+func (this *changeFeed) isWriting(name string) bool {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for name = slashClean(name); ; name = path.Dir(name) {
+		if this.writing[name] > 0 {
+			return true
+		}
+		if name == "/" {
+			return false
+		}
+	}
+}
+
+func (this *changeFeed) cursor() int64 {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.nextID - 1
+}
+
+//
+
+/*
+	Serves the change feed at `/_events`, returning true if this was a request for it.
+	With `Accept: text/event-stream` it's a stream of server-sent events, which resumes from the standard `Last-Event-ID` header.
+	Otherwise `GET /_events?cursor=<id>` returns, as JSON, every event since that cursor, and the cursor to use next time.
+	Without a cursor, only events from now on are given.
+*/
+func (this *Server) attemptEventRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	if (r.URL.Path != eventsPrefix && r.URL.Path != eventsPrefix + "/") || !isReservedPath(this.Settings.Root, r.URL.Path, eventsPrefix) {
+		return false
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	cursor := int64(-1)
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("cursor")
+	}
+	if value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return true
+		}
+		cursor = parsed
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		this.streamEvents(w, r, cursor)
+		return true
+	}
+
+	feed := this.fs.changes
+
+	feed.mutex.Lock()
+	events, ok := feed.since(cursor)
+	feed.mutex.Unlock()
+
+	if events == nil {
+		events = []changeEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Events []changeEvent `json:"events"`
+		Cursor int64 `json:"cursor"`
+		Reset bool `json:"reset,omitempty"`
+	}{events, feed.cursor(), !ok})
+	return true
+}
+
+func (this *Server) streamEvents(w http.ResponseWriter, r *http.Request, cursor int64) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	missed, subscriber, ok := this.fs.changes.subscribe(cursor)
+	defer this.fs.changes.unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if !ok {
+		fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", this.fs.changes.cursor())
+	}
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
+
+	// comments keep idle connections from being closed by proxies.
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event, open := <-subscriber:
+			if !open {
+				// too far behind; the client will reconnect and resume from the last event it got.
+				return
+			}
+			writeEvent(w, event)
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event changeEvent) {
+
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, encoded)
+}
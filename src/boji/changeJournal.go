@@ -0,0 +1,225 @@
+package boji
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/json"
+)
+
+// how long changes are remembered for. Clients that haven't synced in longer than this have to start over.
+const changeJournalRetention = 30 * 24 * time.Hour
+const changeJournalMaxEvents = 1000000
+
+// the type of the line at the head of every journal, whose ID is the last change the journal has forgotten.
+const changeJournalHead = "journal"
+
+/*
+	An append-only record of every change event, kept in the state dir, so that clients can ask what's changed
+	since any point in the last month - not just since the last few thousand events, or since boji last started.
+	Periodically compacted, dropping the oldest changes.
+*/
+type changeJournal struct {
+	path string
+	floor int64
+	last int64
+	mutex sync.Mutex
+}
+
+func newChangeJournal(stateDir string) (*changeJournal, error) {
+
+	ret := &changeJournal {
+		path: filepath.Join(stateDir, "changes.journal"),
+		floor: -1,
+		last: -1,
+	}
+
+	valid, err := ret.scan(func(event changeEvent) {
+		if event.Type == changeJournalHead {
+			ret.floor = event.ID
+		}
+		ret.last = event.ID
+	})
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// a torn final write only loses that one change, but must be cut off so that later changes can be read.
+	stat, err := os.Stat(ret.path)
+	if err == nil && stat.Size() > valid + 1 {
+		fmt.Fprintf(os.Stderr, "Change journal '%s' is truncated, ignoring remainder\n", ret.path)
+		err = os.Truncate(ret.path, valid)
+	}
+	return ret, err
+}
+
+/*
+	Starts a new journal if there isn't one, with the given ID as its first change.
+	Returns the ID of the last change recorded, which the next change must come after.
+*/
+func (this *changeJournal) open(firstID int64) (int64, error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.floor >= 0 {
+		return this.last, nil
+	}
+
+	this.floor = firstID - 1
+	this.last = firstID - 1
+	return this.last, this.rewrite(nil)
+}
+
+func (this *changeJournal) append(event changeEvent) error {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(this.path, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	_, err = fd.Write(append(encoded, '\n'))
+	if err != nil {
+		return err
+	}
+
+	this.last = event.ID
+	return nil
+}
+
+/*
+	Returns every change after [cursor]. Returns false if the journal doesn't go back that far (or the cursor is from the future).
+*/
+func (this *changeJournal) since(cursor int64) ([]changeEvent, bool) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if cursor < this.floor || cursor > this.last {
+		return nil, false
+	}
+
+	var ret []changeEvent
+	_, err := this.scan(func(event changeEvent) {
+		if event.Type != changeJournalHead && event.ID > cursor {
+			ret = append(ret, event)
+		}
+	})
+	return ret, err == nil
+}
+
+/*
+	Drops changes older than the retention period, or beyond the most that are kept.
+*/
+func (this *changeJournal) compact() {
+
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.floor < 0 {
+		return
+	}
+
+	var kept []changeEvent
+	floor := this.floor
+	cutoff := time.Now().Add(-changeJournalRetention)
+
+	_, err := this.scan(func(event changeEvent) {
+		if event.Type == changeJournalHead {
+			return
+		}
+		if event.Time.Before(cutoff) {
+			floor = event.ID
+			return
+		}
+		kept = append(kept, event)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to compact change journal: %v\n", err)
+		return
+	}
+
+	if len(kept) > changeJournalMaxEvents {
+		floor = kept[len(kept) - changeJournalMaxEvents - 1].ID
+		kept = kept[len(kept) - changeJournalMaxEvents:]
+	}
+	if floor == this.floor {
+		return
+	}
+
+	this.floor = floor
+	err = this.rewrite(kept)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to compact change journal: %v\n", err)
+	}
+}
+
+// replaces the journal with the given events, under a head recording the floor. Caller must hold the mutex.
+func (this *changeJournal) rewrite(events []changeEvent) error {
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+
+	err := encoder.Encode(changeEvent{ID: this.floor, Type: changeJournalHead, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		err = encoder.Encode(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	tempPath := this.path + "~"
+	err = ioutil.WriteFile(tempPath, buffer.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tempPath, this.path)
+}
+
+// calls [fn] with every readable line of the journal, in order. Returns how many bytes of it were readable.
+func (this *changeJournal) scan(fn func(changeEvent)) (int64, error) {
+
+	fd, err := os.Open(this.path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(fd))
+	for {
+		var event changeEvent
+
+		// reading stops at the end, or at the first line that was never completely written.
+		valid := decoder.InputOffset()
+		err = decoder.Decode(&event)
+		if err != nil {
+			return valid, nil
+		}
+		fn(event)
+	}
+}
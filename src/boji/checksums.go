@@ -0,0 +1,450 @@
+package boji
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"hash"
+	"bytes"
+	"sync"
+	"errors"
+	"strings"
+	"context"
+	"net/http"
+	"path/filepath"
+	"io/ioutil"
+	"archive/zip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/base64"
+	"golang.org/x/net/webdav"
+)
+
+const digestXattr = "user.boji.sha256"
+const digestSidecarName = ".boji-digest"
+
+var errChecksumMismatch = errors.New("Checksum mismatch")
+
+/*
+	Caches the SHA-256 digest of the plaintext content of every kind of file, so that checksums
+	don't require reading the whole file every time they're asked for. Digests are only ever worked out when a checksum
+	is actually asked for - ETags come from what's on disk, and never need the content (though an encrypted file's
+	ETag is its digest, once that's known).
+
+	Every cached digest is stored alongside a "stamp" describing the on-disk state it was computed from,
+	and is only used while that stamp still matches. Regular files keep theirs in an xattr (or a sidecar in the state dir),
+	archive members use their zip CRC and size as the stamp and keep digests in the sidecar,
+	and encrypted files are only ever cached in memory - a plaintext digest on disk would let anyone confirm a guess at the contents.
+*/
+type digestCache struct {
+	root string
+	sidecar string
+
+	encrypted map[string]cachedDigest
+	mutex sync.Mutex
+}
+
+type cachedDigest struct {
+	stamp string
+	digest []byte
+}
+
+// describes where a file's content lives, and how to tell if it has changed.
+type contentStamp struct {
+	stamp string
+	etag string
+	xattrTarget string
+	header *zip.FileHeader
+	encrypted bool
+}
+
+func newDigestCache(root string, stateDir string) *digestCache {
+	return &digestCache {
+		root: root,
+		sidecar: filepath.Join(stateDir, "digests"),
+		encrypted: make(map[string]cachedDigest),
+	}
+}
+
+/*
+	Returns the SHA-256 digest of the plaintext of the file at the given (plaintext, on-disk) path.
+	If it isn't cached, [open] is used to read the content.
+	[info] may be nil, but if it came from an archive it saves reopening the archive.
+*/
+func (this *digestCache) digest(path string, info os.FileInfo, open func() (io.ReadCloser, error)) ([]byte, error) {
+
+	stamp, err := this.stampOf(path, info)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := this.cached(path, stamp)
+	if digest != nil {
+		return digest, nil
+	}
+
+	reader, err := open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	digest = hasher.Sum(nil)
+	this.store(path, stamp, digest)
+	return digest, nil
+}
+
+/*
+	Returns an ETag for the file at the given path, which changes whenever its content does, without reading it.
+	Archive members use their CRC and size straight from the zip header, and regular files the size, modification time
+	and inode of what's on disk - both strong, since they describe the very bytes that are served.
+	What's on disk for an encrypted file isn't what's served, so its tag is only weak, unless its plaintext digest is already known.
+*/
+func (this *digestCache) etag(path string, info os.FileInfo) (string, error) {
+
+	if info != nil && info.IsDir() {
+		return "", webdav.ErrNotImplemented
+	}
+
+	stamp, err := this.stampOf(path, info)
+	if err != nil {
+		return "", err
+	}
+
+	if stamp.encrypted {
+		digest := this.cached(path, stamp)
+		if digest != nil {
+			return fmt.Sprintf(`"%x"`, digest), nil
+		}
+	}
+	return stamp.etag, nil
+}
+
+/*
+	Returns the digest of the file at the given path, but only if it's already known, or [compute] is set.
+	Otherwise returns nil, so that nothing has to be read just to answer a request that didn't ask for a checksum.
+*/
+func (this *digestCache) digestIf(compute bool, path string, info os.FileInfo, open func() (io.ReadCloser, error)) ([]byte, error) {
+
+	if compute {
+		return this.digest(path, info, open)
+	}
+
+	stamp, err := this.stampOf(path, info)
+	if err != nil {
+		return nil, err
+	}
+	return this.cached(path, stamp), nil
+}
+
+// forgets any digest for the given path, used whenever boji itself rewrites a file.
+func (this *digestCache) invalidate(path string) {
+
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	delete(this.encrypted, path)
+	this.mutex.Unlock()
+
+	removeXattr(path, digestXattr)
+	os.Remove(this.sidecarPath(path))
+}
+
+// forgets cached digests for the given path and everything beneath it.
+func (this *digestCache) remove(path string) {
+
+	if this == nil {
+		return
+	}
+
+	this.invalidate(path)
+	os.RemoveAll(this.sidecarDir(path))
+}
+
+//
+
+func (this *digestCache) stampOf(path string, info os.FileInfo) (contentStamp, error) {
+
+	if info != nil {
+		header, ok := info.Sys().(*zip.FileHeader)
+		if ok {
+			return archiveStamp(header), nil
+		}
+	}
+
+	// inside an archive?
+	dir := filepath.Dir(path)
+	zreader, err := zip.OpenReader(filepath.Join(dir, "archive.zip"))
+	if err == nil {
+		defer zreader.Close()
+
+		filename := filepath.Base(path)
+		for _, zfile := range zreader.File {
+			if zfile.Name == filename {
+				return archiveStamp(&zfile.FileHeader), nil
+			}
+		}
+	}
+
+	stat, err := os.Stat(path)
+	if err == nil {
+		return contentStamp {
+			stamp: fmt.Sprintf("%d:%d", stat.Size(), stat.ModTime().UnixNano()),
+			etag: statETag(stat),
+			xattrTarget: path,
+		}, nil
+	}
+
+	stat, err = os.Stat(path + encryptedExtension)
+	if err == nil {
+		return contentStamp {
+			stamp: fmt.Sprintf("%d:%d", stat.Size(), stat.ModTime().UnixNano()),
+			etag: "W/" + statETag(stat),
+			encrypted: true,
+		}, nil
+	}
+
+	return contentStamp{}, os.ErrNotExist
+}
+
+func archiveStamp(header *zip.FileHeader) contentStamp {
+	return contentStamp {
+		stamp: fmt.Sprintf("crc32:%08x:%d", header.CRC32, header.UncompressedSize64),
+		etag: fmt.Sprintf(`"%08x%x"`, header.CRC32, header.UncompressedSize64),
+		header: header,
+	}
+}
+
+// the inode is included so that a file replaced by another of the same size and time (say, by a rename) still gets a new ETag.
+func statETag(stat os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, stat.Size(), stat.ModTime().UnixNano(), inodeOf(stat))
+}
+
+func (this *digestCache) cached(path string, stamp contentStamp) []byte {
+
+	if stamp.encrypted {
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+
+		entry, ok := this.encrypted[path]
+		if ok && entry.stamp == stamp.stamp {
+			return entry.digest
+		}
+		return nil
+	}
+
+	var encoded []byte
+	if stamp.xattrTarget != "" {
+		encoded, _ = getXattr(stamp.xattrTarget, digestXattr)
+	}
+	if len(encoded) == 0 {
+		encoded, _ = ioutil.ReadFile(this.sidecarPath(path))
+	}
+
+	// "<stamp> <hex digest>"
+	fields := strings.Fields(string(encoded))
+	if len(fields) != 2 || fields[0] != stamp.stamp {
+		return nil
+	}
+
+	digest, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return nil
+	}
+	return digest
+}
+
+func (this *digestCache) store(path string, stamp contentStamp, digest []byte) {
+
+	if stamp.encrypted {
+		this.mutex.Lock()
+		this.encrypted[path] = cachedDigest{stamp: stamp.stamp, digest: digest}
+		this.mutex.Unlock()
+		return
+	}
+
+	encoded := []byte(stamp.stamp + " " + hex.EncodeToString(digest))
+	if stamp.xattrTarget != "" && setXattr(stamp.xattrTarget, digestXattr, encoded) == nil {
+		return
+	}
+
+	// a failure to cache isn't a failure to digest, just carry on.
+	sidecarPath := this.sidecarPath(path)
+	if os.MkdirAll(filepath.Dir(sidecarPath), 0700) == nil {
+		ioutil.WriteFile(sidecarPath, encoded, 0600)
+	}
+}
+
+func (this *digestCache) sidecarDir(path string) string {
+
+	relative, err := filepath.Rel(this.root, path)
+	if err != nil {
+		relative = filepath.Base(path)
+	}
+	return filepath.Join(this.sidecar, relative)
+}
+
+func (this *digestCache) sidecarPath(path string) string {
+	return filepath.Join(this.sidecarDir(path), digestSidecarName)
+}
+
+//
+
+// A checksum a client expects an upload to have.
+type expectedChecksum struct {
+	algorithm string
+	hasher hash.Hash
+	expected []byte
+}
+
+/*
+	Parses any checksums the client gave for an upload,
+	from either an ownCloud-style `OC-Checksum: SHA256:<hex>` or an RFC 3230 `Digest: SHA-256=<base64>` header.
+	Unknown algorithms are ignored.
+*/
+func parseExpectedChecksums(r *http.Request) ([]expectedChecksum, error) {
+
+	var ret []expectedChecksum
+
+	for _, value := range strings.Fields(r.Header.Get("OC-Checksum")) {
+
+		idx := strings.IndexByte(value, ':')
+		if idx <= 0 {
+			return nil, errors.New("Malformed OC-Checksum header")
+		}
+
+		hasher := newChecksumHasher(value[:idx])
+		if hasher == nil {
+			continue
+		}
+
+		expected, err := hex.DecodeString(value[idx+1:])
+		if err != nil {
+			return nil, errors.New("Malformed OC-Checksum header")
+		}
+		ret = append(ret, expectedChecksum{algorithm: value[:idx], hasher: hasher, expected: expected})
+	}
+
+	for _, value := range strings.Split(r.Header.Get("Digest"), ",") {
+
+		value = strings.TrimSpace(value)
+		idx := strings.IndexByte(value, '=')
+		if idx <= 0 {
+			continue
+		}
+
+		hasher := newChecksumHasher(value[:idx])
+		if hasher == nil {
+			continue
+		}
+
+		expected, err := base64.StdEncoding.DecodeString(value[idx+1:])
+		if err != nil {
+			return nil, errors.New("Malformed Digest header")
+		}
+		ret = append(ret, expectedChecksum{algorithm: value[:idx], hasher: hasher, expected: expected})
+	}
+
+	return ret, nil
+}
+
+func newChecksumHasher(algorithm string) hash.Hash {
+
+	switch strings.ToUpper(strings.Replace(algorithm, "-", "", -1)) {
+	case "SHA256": return sha256.New()
+	case "SHA1", "SHA": return sha1.New()
+	case "MD5": return md5.New()
+	}
+	return nil
+}
+
+/*
+	Reads the entire request body into a staging file, verifying it against the given checksums as it goes.
+	Only if every checksum matches is the request's body replaced with the staged copy - so that a corrupted upload
+	never overwrites anything. The returned func removes the staged copy, and must always be called.
+*/
+func stageVerifiedBody(r *http.Request, stagingDir string, checksums []expectedChecksum) (func(), error) {
+
+	err := os.MkdirAll(stagingDir, 0700)
+	if err != nil {
+		return func(){}, err
+	}
+
+	staged, err := ioutil.TempFile(stagingDir, "put-")
+	if err != nil {
+		return func(){}, err
+	}
+
+	cleanup := func() {
+		staged.Close()
+		os.Remove(staged.Name())
+	}
+
+	writers := []io.Writer{staged}
+	for _, checksum := range checksums {
+		writers = append(writers, checksum.hasher)
+	}
+
+	_, err = io.Copy(io.MultiWriter(writers...), r.Body)
+	if err != nil {
+		return cleanup, err
+	}
+
+	for _, checksum := range checksums {
+		if !bytes.Equal(checksum.hasher.Sum(nil), checksum.expected) {
+			return cleanup, errChecksumMismatch
+		}
+	}
+
+	_, err = staged.Seek(0, io.SeekStart)
+	if err != nil {
+		return cleanup, err
+	}
+
+	r.Body.Close()
+	r.Body = staged
+	return cleanup, nil
+}
+
+/*
+	Whether a GET asked for the content's checksum, with an RFC 3230 `Want-Digest` header that includes SHA-256.
+	Checksums that are already known are sent regardless.
+*/
+func wantsDigest(r *http.Request) bool {
+
+	for _, value := range strings.Split(r.Header.Get("Want-Digest"), ",") {
+
+		algorithm := strings.TrimSpace(value)
+		idx := strings.IndexByte(algorithm, ';')
+		if idx >= 0 {
+			algorithm = strings.TrimSpace(algorithm[:idx])
+		}
+		if strings.EqualFold(algorithm, "SHA-256") {
+			return true
+		}
+	}
+	return false
+}
+
+// sets the checksum headers for a GET of a file with the given digest.
+func setChecksumHeaders(w http.ResponseWriter, digest []byte) {
+	w.Header().Set("OC-Checksum", "SHA256:" + hex.EncodeToString(digest))
+	w.Header().Set("Digest", "SHA-256=" + base64.StdEncoding.EncodeToString(digest))
+}
+
+// returns a func that opens the given file through the filesystem, for digesting.
+func fsOpener(ctx context.Context, fs webdav.FileSystem, name string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	}
+}
@@ -0,0 +1,412 @@
+package boji
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"reflect"
+	"strings"
+	"io/ioutil"
+	"os/signal"
+	"syscall"
+	"crypto/tls"
+	"crypto/subtle"
+	"github.com/BurntSushi/toml"
+)
+
+/*
+	Settings for one directory (and, for versions, everything beneath it), as if they'd been `POST`ed to it.
+	Empty values leave the directory's setting as it was.
+*/
+type DirectoryRule struct {
+	Quota string `toml:"quota"`
+	Versions string `toml:"versions"`
+	Organize bool `toml:"organize"`
+}
+
+/*
+	Loads a config file over the given settings (usually the defaults of flags), so that anything in the file takes precedence -
+	except for whatever [overrides] sets afterwards (usually the flags that were given explicitly), which may be nil.
+	The file is TOML - the keys at the top match the flags of `boji serve`, and the rest are in tables:
+
+		root = "/var/lib/boji/data"
+		versions = "10,30d"
+		watch-interval = "5m"
+
+		[tls]
+		certificate = "/etc/boji/certificate.crt"
+		key = "/etc/boji/server.key"
+
+		[users]
+		alice = "password"
+
+		[rules."/photos"]
+		quota = "50G"
+		organize = true
+
+	The returned settings have been checked to be usable, and remember where they came from (overrides included),
+	so that the server can reload them.
+*/
+func LoadConfig(path string, settings ServerSettings, overrides func(*ServerSettings)) (ServerSettings, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return settings, err
+	}
+
+	commandLine := settings
+	commandLine.commandLine = nil
+
+	settings.ConfigPath = path
+	settings.commandLine = &commandLine
+	settings.overrides = overrides
+
+	file := newConfigFile(&settings)
+	meta, err := toml.Decode(string(data), &file)
+	if err != nil {
+		return settings, fmt.Errorf("%s: %v", path, err)
+	}
+
+	// anything the file sets that isn't a setting is almost certainly a typo, which shouldn't go unnoticed.
+	undecoded := meta.Undecoded()
+	if len(undecoded) > 0 {
+		return settings, fmt.Errorf("%s: unknown setting '%s'", path, undecoded[0])
+	}
+
+	// directories can be named however the file likes, but are looked up by their clean names.
+	if settings.Rules != nil {
+		rules := make(map[string]DirectoryRule)
+		for dir, rule := range settings.Rules {
+			rules[slashClean(dir)] = rule
+		}
+		settings.Rules = rules
+	}
+
+	if overrides != nil {
+		overrides(&settings)
+	}
+
+	err = validateSettings(settings)
+	if err != nil {
+		return settings, fmt.Errorf("%s: %v", path, err)
+	}
+	return settings, nil
+}
+
+/*
+	What a config file can hold, each pointing at the setting it's decoded into -
+	so that settings the file doesn't mention are left as they were.
+*/
+type configFile struct {
+	Address *string `toml:"address"`
+	Port *int `toml:"port"`
+	Root *string `toml:"root"`
+	StateDir *string `toml:"state"`
+	StagingDir *string `toml:"staging"`
+	StaticDir *string `toml:"static"`
+	Quota *string `toml:"quota"`
+	TrashRetention *int `toml:"trash-retention"`
+	Versions *string `toml:"versions"`
+	WatchInterval *time.Duration `toml:"watch-interval"`
+	SearchIndex *bool `toml:"search-index"`
+	FullTextIndex *bool `toml:"full-text-index"`
+
+	TLS struct {
+		Certificate *string `toml:"certificate"`
+		Key *string `toml:"key"`
+	} `toml:"tls"`
+
+	Replication struct {
+		Peer *string `toml:"peer"`
+		Interval *time.Duration `toml:"interval"`
+		Accept *bool `toml:"accept"`
+	} `toml:"replication"`
+
+	Telemetry struct {
+		InfluxURL *string `toml:"influx-url"`
+		InfluxBucket *string `toml:"influx-bucket"`
+	} `toml:"telemetry"`
+
+	Users *map[string]string `toml:"users"`
+	Rules *map[string]DirectoryRule `toml:"rules"`
+}
+
+func newConfigFile(settings *ServerSettings) configFile {
+
+	ret := configFile {
+		Address: &settings.Address,
+		Port: &settings.Port,
+		Root: &settings.Root,
+		StateDir: &settings.StateDir,
+		StagingDir: &settings.StagingDir,
+		StaticDir: &settings.StaticDir,
+		Quota: &settings.Quota,
+		TrashRetention: &settings.TrashRetention,
+		Versions: &settings.Versions,
+		WatchInterval: &settings.WatchInterval,
+		SearchIndex: &settings.SearchIndex,
+		FullTextIndex: &settings.FullTextIndex,
+		Users: &settings.Users,
+		Rules: &settings.Rules,
+	}
+
+	ret.TLS.Certificate = &settings.TLSCertPath
+	ret.TLS.Key = &settings.TLSKeyPath
+	ret.Replication.Peer = &settings.ReplicationPeer
+	ret.Replication.Interval = &settings.ReplicationInterval
+	ret.Replication.Accept = &settings.AcceptReplicas
+	ret.Telemetry.InfluxURL = &settings.InfluxURL
+	ret.Telemetry.InfluxBucket = &settings.InfluxBucket
+	return ret
+}
+
+/*
+	Checks that settings can actually be used, before anything's done with them - whether they're being served,
+	reloaded, or just checked with `boji config check`.
+*/
+func validateSettings(settings ServerSettings) error {
+
+	if isWithin(settings.Root, settings.StateDir) {
+		return errors.New("State directory must not be inside the served root")
+	}
+	if isWithin(settings.Root, settings.StagingDir) {
+		return errors.New("Staging directory must not be inside the served root")
+	}
+
+	_, err := parseQuotaSize(settings.Quota)
+	if err != nil {
+		return fmt.Errorf("quota: %v", err)
+	}
+	_, err = parseVersionRule(settings.Versions)
+	if err != nil {
+		return fmt.Errorf("versions: %v", err)
+	}
+	if settings.ReplicationPeer != "" && settings.ReplicationInterval <= 0 {
+		return errors.New("replication: interval must be longer than zero")
+	}
+
+	for name, password := range settings.Users {
+		if name == "" || password == "" || strings.Contains(name, ":") {
+			return fmt.Errorf("users: '%s' needs a name without colons, and a password", name)
+		}
+	}
+
+	for dir, rule := range settings.Rules {
+
+		if rule.Quota != "" && rule.Quota != "none" && rule.Quota != "default" {
+			_, err = parseQuotaSize(rule.Quota)
+			if err != nil {
+				return fmt.Errorf("rules for '%s': quota: %v", dir, err)
+			}
+		}
+		if rule.Quota != "" && (dir == "/" || strings.Count(dir, "/") > 1) {
+			return fmt.Errorf("rules for '%s': quotas can only be set on top-level directories", dir)
+		}
+		if rule.Versions != "" && rule.Versions != "default" {
+			_, err = parseVersionRule(rule.Versions)
+			if err != nil {
+				return fmt.Errorf("rules for '%s': versions: %v", dir, err)
+			}
+		}
+	}
+
+	// served over TLS only if both exist, same as ever - but if they do, they have to work.
+	_, certErr := os.Stat(settings.TLSCertPath)
+	_, keyErr := os.Stat(settings.TLSKeyPath)
+	if certErr == nil && keyErr == nil {
+		_, err = tls.LoadX509KeyPair(settings.TLSCertPath, settings.TLSKeyPath)
+		if err != nil {
+			return fmt.Errorf("tls: %v", err)
+		}
+	}
+	return nil
+}
+
+//
+
+/*
+	The accounts that can log in. Either those given in the config file, or just the admin.
+*/
+type userAccounts struct {
+	passwords map[string]string
+	mutex sync.RWMutex
+}
+
+func newUserAccounts(settings ServerSettings) *userAccounts {
+
+	ret := &userAccounts{}
+	ret.set(settings)
+	return ret
+}
+
+func (this *userAccounts) set(settings ServerSettings) {
+
+	passwords := settings.Users
+	if len(passwords) == 0 {
+		passwords = map[string]string{settings.AdminUsername: settings.AdminPassword}
+	}
+
+	this.mutex.Lock()
+	this.passwords = passwords
+	this.mutex.Unlock()
+}
+
+func (this *userAccounts) check(username string, password string) bool {
+
+	this.mutex.RLock()
+	expected, ok := this.passwords[username]
+	this.mutex.RUnlock()
+
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+/*
+	The TLS certificate being served, which can be replaced (say, once it's been renewed) without restarting.
+*/
+type certificateStore struct {
+	certificate *tls.Certificate
+	mutex sync.RWMutex
+}
+
+func (this *certificateStore) load(certPath string, keyPath string) error {
+
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	this.certificate = &certificate
+	this.mutex.Unlock()
+	return nil
+}
+
+func (this *certificateStore) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return this.certificate, nil
+}
+
+//
+
+/*
+	Applies the rules for each directory, as if they'd been `POST`ed.
+	Anything that was set by the previous rules, but isn't any more, goes back to its default.
+*/
+func (this *Server) applyRules(rules map[string]DirectoryRule, previous map[string]DirectoryRule) {
+
+	dirs := make(map[string]bool)
+	for dir := range rules {
+		dirs[dir] = true
+	}
+	for dir := range previous {
+		dirs[dir] = true
+	}
+
+	for dir := range dirs {
+
+		rule := rules[dir]
+		old := previous[dir]
+		var err error
+
+		switch {
+		case rule.Quota != "":
+			err = this.quotas.setLimit(dir, rule.Quota)
+		case old.Quota != "":
+			err = this.quotas.setLimit(dir, "default")
+		}
+		if err == nil {
+			switch {
+			case rule.Versions != "":
+				err = this.versions.setRule(dir, rule.Versions)
+			case old.Versions != "":
+				err = this.versions.setRule(dir, "default")
+			}
+		}
+		if err == nil && (rule.Organize || old.Organize) {
+			err = this.fs.photos.setOrganized(dir, rule.Organize)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to apply rules for '%s': %v\n", dir, err)
+		}
+	}
+}
+
+// reloads the config file whenever boji is sent SIGHUP, until [stop] is closed.
+func (this *Server) runConfigReloads(stop chan bool) {
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hangups:
+			this.reloadConfig()
+		}
+	}
+}
+
+/*
+	Rereads the config file, and applies whatever can be changed without dropping anyone's connection:
+	users, rules, the TLS certificate, and where telemetry goes. Anything else that's changed only takes effect after a restart.
+	If the file isn't valid any more, nothing changes at all.
+*/
+func (this *Server) reloadConfig() {
+
+	current := *this.applied
+
+	settings, err := LoadConfig(current.ConfigPath, *current.commandLine, current.overrides)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Not reloading config: %v\n", err)
+		return
+	}
+
+	this.users.set(settings)
+	this.applyRules(settings.Rules, current.Rules)
+	this.telemetry.retarget(settings.InfluxURL, settings.InfluxBucket)
+
+	if this.certificates != nil {
+		err = this.certificates.load(settings.TLSCertPath, settings.TLSKeyPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to reload TLS certificate: %v\n", err)
+		}
+	}
+
+	for _, name := range changedSettings(current, settings) {
+		switch name {
+		case "Users", "Rules", "AdminUsername", "AdminPassword", "InfluxURL", "InfluxBucket", "TLSCertPath", "TLSKeyPath":
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "'%s' has changed, but only takes effect after a restart\n", name)
+	}
+
+	*this.applied = settings
+	fmt.Println("Reloaded config")
+}
+
+// the names of the settings which differ between two sets of them.
+func changedSettings(old ServerSettings, new ServerSettings) []string {
+
+	var ret []string
+
+	oldValue := reflect.ValueOf(old)
+	newValue := reflect.ValueOf(new)
+	for i := 0; i < oldValue.NumField(); i++ {
+
+		field := oldValue.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			ret = append(ret, field.Name)
+		}
+	}
+	return ret
+}
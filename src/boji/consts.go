@@ -1,5 +1,9 @@
 package boji
 
 const contextEncryptionKey = "key"
+const contextModTime = "mtime"
+const contextUsername = "username"
+const contextReplacing = "replacing"
+const contextQuotaExceeded = "quotaExceeded"
 const encryptionProvidedHeaderValue = "aes-256"
 const encryptedExtension = ".pgp-boji"
\ No newline at end of file
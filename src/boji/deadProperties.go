@@ -0,0 +1,274 @@
+package boji
+
+import (
+	"os"
+	"path/filepath"
+	"io/ioutil"
+	"encoding/json"
+	"encoding/xml"
+	"golang.org/x/net/webdav"
+)
+
+const propertiesXattr = "user.boji.props"
+const propertiesSidecarName = ".boji-props"
+
+/*
+	Stores webdav "dead" properties (anything a client PROPPATCHes which isn't a live property) without a database.
+	Properties are kept in an xattr on the file itself wherever possible, so that they survive the file being moved around on disk.
+	Where that's not possible (archive members, filesystems without xattrs, properties too large for an xattr)
+	they're kept in a sidecar tree under the state dir which mirrors the served tree.
+
+	All paths given to the store are on-disk plaintext paths - that is, without any encryption extension.
+*/
+type propertyStore struct {
+	root string
+	sidecar string
+}
+
+func newPropertyStore(root string, stateDir string) *propertyStore {
+	return &propertyStore {
+		root: root,
+		sidecar: filepath.Join(stateDir, "props"),
+	}
+}
+
+func (this *propertyStore) load(path string) (map[xml.Name]webdav.Property, error) {
+
+	props := make(map[xml.Name]webdav.Property)
+	if this == nil {
+		return props, nil
+	}
+
+	var encoded []byte
+
+	target := this.xattrTarget(path)
+	if target != "" {
+		encoded, _ = getXattr(target, propertiesXattr)
+	}
+
+	if len(encoded) == 0 {
+		var err error
+		encoded, err = ioutil.ReadFile(this.sidecarPath(path))
+		if os.IsNotExist(err) {
+			return props, nil
+		}
+		if err != nil {
+			return props, err
+		}
+	}
+
+	var list []webdav.Property
+	err := json.Unmarshal(encoded, &list)
+	if err != nil {
+		return props, err
+	}
+
+	for _, prop := range list {
+		props[prop.XMLName] = prop
+	}
+	return props, nil
+}
+
+/*
+	Saves the given properties against the given path, replacing whatever was there before.
+	Saving an empty set removes them entirely.
+*/
+func (this *propertyStore) save(path string, props map[xml.Name]webdav.Property) error {
+
+	if this == nil {
+		return nil
+	}
+
+	sidecarPath := this.sidecarPath(path)
+	target := this.xattrTarget(path)
+
+	if len(props) == 0 {
+		if target != "" {
+			removeXattr(target, propertiesXattr)
+		}
+		return this.removeSidecar(sidecarPath)
+	}
+
+	encoded, err := json.Marshal(propertyList(props))
+	if err != nil {
+		return err
+	}
+
+	if target != "" {
+		err = setXattr(target, propertiesXattr, encoded)
+		if err == nil {
+			return this.removeSidecar(sidecarPath)
+		}
+	}
+
+	// no xattr available, use the sidecar.
+	err = os.MkdirAll(filepath.Dir(sidecarPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	tempPath := sidecarPath + "~"
+	err = ioutil.WriteFile(tempPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, sidecarPath)
+}
+
+/*
+	Forgets any sidecar properties for the given path, and everything beneath it.
+	xattrs need no help, they're removed along with their file.
+*/
+func (this *propertyStore) remove(path string) error {
+
+	if this == nil {
+		return nil
+	}
+	return os.RemoveAll(this.sidecarDir(path))
+}
+
+/*
+	Called after something at [oldPath] has been moved to [newPath], with the properties that were read from [oldPath] before the move.
+	Carries along sidecar properties for any children, and re-homes the moved item's own properties.
+*/
+func (this *propertyStore) move(oldPath string, newPath string, props map[xml.Name]webdav.Property) error {
+
+	if this == nil {
+		return nil
+	}
+
+	oldDir := this.sidecarDir(oldPath)
+	newDir := this.sidecarDir(newPath)
+
+	_, err := os.Stat(oldDir)
+	if err == nil {
+
+		err = os.RemoveAll(newDir)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(filepath.Dir(newDir), 0700)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(oldDir, newDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	return this.save(newPath, props)
+}
+
+/*
+	Moves any xattr properties on the given file into the sidecar.
+	Used when a file is about to stop existing on its own (for example, when it's being compressed into an archive).
+*/
+func (this *propertyStore) detach(path string) error {
+
+	if this == nil {
+		return nil
+	}
+
+	props, err := this.load(path)
+	if err != nil || len(props) == 0 {
+		return err
+	}
+
+	encoded, err := json.Marshal(propertyList(props))
+	if err != nil {
+		return err
+	}
+
+	sidecarPath := this.sidecarPath(path)
+	err = os.MkdirAll(filepath.Dir(sidecarPath), 0700)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sidecarPath, encoded, 0600)
+}
+
+//
+
+/*
+	Returns the on-disk file whose xattrs should hold properties for the given path, or an empty string if there isn't one.
+	Archive members are never given an xattr target, since the archive's own xattrs would be shared by every member.
+*/
+func (this *propertyStore) xattrTarget(path string) string {
+
+	_, err := os.Stat(filepath.Join(filepath.Dir(path), "archive.zip"))
+	if err == nil && filepath.Base(path) != "archive.zip" {
+		return ""
+	}
+
+	_, err = os.Stat(path)
+	if err == nil {
+		return path
+	}
+
+	_, err = os.Stat(path + encryptedExtension)
+	if err == nil {
+		return path + encryptedExtension
+	}
+	return ""
+}
+
+// the sidecar directory which mirrors the given path. Properties for children of [path] live under this.
+func (this *propertyStore) sidecarDir(path string) string {
+
+	relative, err := filepath.Rel(this.root, path)
+	if err != nil {
+		relative = filepath.Base(path)
+	}
+	return filepath.Join(this.sidecar, relative)
+}
+
+func (this *propertyStore) sidecarPath(path string) string {
+	return filepath.Join(this.sidecarDir(path), propertiesSidecarName)
+}
+
+// removes a sidecar file, and its mirrored directory if that leaves it empty.
+func (this *propertyStore) removeSidecar(sidecarPath string) error {
+
+	err := removeIfExists(sidecarPath)
+	if err != nil {
+		return err
+	}
+
+	// only succeeds if there's nothing left for any children.
+	os.Remove(filepath.Dir(sidecarPath))
+	return nil
+}
+
+//
+
+/*
+	Copies xattr properties between two on-disk files.
+	Used when a file is replaced by a transformed copy of itself (such as when it's encrypted or decrypted).
+*/
+func copyPropertiesXattr(from string, to string) {
+
+	encoded, err := getXattr(from, propertiesXattr)
+	if err != nil || len(encoded) == 0 {
+		return
+	}
+	setXattr(to, propertiesXattr, encoded)
+}
+
+func propertyList(props map[xml.Name]webdav.Property) []webdav.Property {
+
+	list := make([]webdav.Property, 0, len(props))
+	for _, prop := range props {
+		list = append(list, prop)
+	}
+	return list
+}
+
+func removeIfExists(path string) error {
+
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package boji
+
+import (
+	"syscall"
+)
+
+// the number of bytes available to unprivileged users on the filesystem holding the given path.
+func diskFree(path string) (int64, error) {
+
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package boji
+
+import (
+	"errors"
+)
+
+// free space isn't portable, everywhere else only reports quota limits.
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("free space is not supported on this platform")
+}
@@ -3,8 +3,11 @@ package boji
 import (
 	"io"
 	"os"
+	"fmt"
+	"sync"
 	"io/ioutil"
 	"errors"
+	"time"
 	"golang.org/x/crypto/openpgp"
 )
 
@@ -15,13 +18,26 @@ type encryptedFile struct {
 	path string
 	key []byte
 	
-	encryptedReader io.Reader
-	seekPos int64
-	plaintextSize int64 // optimization. Only set after getPlaintextSize() is called.
+	stream *seekableStream
 	stats *telemetryStats
 
 	flag int
 	perm os.FileMode
+	modTime time.Time
+}
+
+/*
+	Plaintext sizes of encrypted files, by path, which are expensive to find (the whole file must be decrypted).
+	Only kept in memory, and only valid while the encrypted file is unchanged.
+*/
+var plaintextSizes = struct {
+	sizes map[string]cachedSize
+	mutex sync.Mutex
+}{sizes: make(map[string]cachedSize)}
+
+type cachedSize struct {
+	stamp string
+	size int64
 }
 
 func newEncryptedFile(path string, key []byte, flag int, perm os.FileMode, stats *telemetryStats) (*encryptedFile, error) {
@@ -33,111 +49,41 @@ func newEncryptedFile(path string, key []byte, flag int, perm os.FileMode, stats
 		perm: perm,
 		stats: stats,
 	}
+	ret.stream = newSeekableStream(ret.decrypt, ret.getPlaintextSize)
 
-	err := ret.open(false)
-	return ret, err
+	fd, err := os.OpenFile(path, flag, perm)
+	if err != nil {
+		return ret, err
+	}
+	ret.File = fd
+	return ret, nil
 }
 
 func (this *encryptedFile) Read(p []byte) (n int, err error) {
-	
-	if this.encryptedReader == nil {
-		err := this.open(true)
-		if err != nil {
-			return 0, err
-		}
-
-		// if there's no reader, but no error, empty file.
-		if this.encryptedReader == nil {
-			return 0, io.EOF
-		}
-	}
-
-	read, err := this.encryptedReader.Read(p)
-	if err == nil {
-		this.seekPos += int64(read)
-	}
-	this.stats.bytesRead += int64(read)
-	return read, err
+	n, err = this.stream.Read(p)
+	this.stats.bytesRead += int64(n)
+	return n, err
 }
 
 func (this *encryptedFile) Seek(offset int64, whence int) (n int64, err error) {
-	
-	if this.encryptedReader == nil {
-		err := this.open(true)
-		if err != nil {
-			return 0, err
-		}
-	}
-
-	switch whence {
-		case os.SEEK_SET:
-
-			err := this.open(true)
-			if err != nil {
-				return -1, err
-			}
-			// if empty
-			if this.encryptedReader == nil {
-				return offset, nil
-			}
-			
-			io.CopyN(ioutil.Discard, this.encryptedReader, offset)
-			this.seekPos = offset
-	
-		case os.SEEK_CUR: 
-			
-			if this.encryptedReader != nil {
-				io.CopyN(ioutil.Discard, this.encryptedReader, offset)
-				this.seekPos += offset
-			}
-	
-		case os.SEEK_END:
-
-			// if empty
-			if this.encryptedReader == nil {
-				return offset, nil
-			}
-
-			totalSize, reopened, err := this.getPlaintextSize()
-			if err != nil {
-				return -1, err
-			}
-
-			if !reopened {
-				err = this.open(true)
-				if err != nil {
-					return -1, err
-				}
-			}
-
-			io.CopyN(ioutil.Discard, this.encryptedReader, totalSize + offset)
-			this.seekPos = totalSize + offset
-		}
-	
-		return this.seekPos, nil
+	return this.stream.Seek(offset, whence)
 }
 
 func (this *encryptedFile) Stat() (os.FileInfo, error) {
 
-	var size int64
-
 	this.stats.filesStatted++
 
 	// file stat isn't good enough, size the pgp headers (and block padding) inflate size.
-	// so we have to _read the whole damn file_ to get full size, then return a revised fileinfo
+	// but don't decrypt the entire file just to stat, only use the real size if it's already known.
 	stat, err := this.File.Stat()
 	if err != nil {
 		return stat, err
 	}
 
-	// don't decrypt the entire file just to stat.
-	if this.plaintextSize > 0 || this.encryptedReader != nil {
-		size, _, err = this.getPlaintextSize()
-		if err != nil {
-			return stat, err
-		}
-	}else {
-		size = stat.Size()
+	size := stat.Size()
+	known, ok := cachedPlaintextSize(this.path, stat)
+	if ok {
+		size = known
 	}
 
 	trimmed, _ := hideEncryptionExtension(stat.Name())
@@ -151,10 +97,21 @@ func (this *encryptedFile) Stat() (os.FileInfo, error) {
 
 func (this *encryptedFile) Close() error {
 	
+	this.stream.Close()
 	if this.File == nil {
 		return nil
 	}
-	return this.File.Close()
+
+	err := this.File.Close()
+	if err != nil || this.modTime.IsZero() {
+		return err
+	}
+	return os.Chtimes(this.path, this.modTime, this.modTime)
+}
+
+func (this *encryptedFile) SetModTime(modTime time.Time) error {
+	this.modTime = modTime
+	return nil
 }
 
 //
@@ -169,77 +126,98 @@ func (this *encryptedFile) Write(p []byte) (n int, err error) {
 
 // 
 
-func (this *encryptedFile) open(makeReader bool) error {
+/*
+	Opens a new decrypting reader from the start of the file.
+	Each reader has its own fd, so that finding the plaintext size never disturbs a read in progress.
+*/
+func (this *encryptedFile) decrypt() (io.ReadCloser, error) {
 
-	if this.File != nil {
-		this.File.Close()
-	}
-
-	fd, err := os.OpenFile(this.path, this.flag, this.perm)
+	fd, err := os.Open(this.path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	this.File = fd
 
-	// if we aren't requested to decrypt, don't.
-	// used so that we don't need to decrypt every file in a dir just to stat them. 
-	if !makeReader {
-		return nil
-	}
-
-	// if we're supposed to decrypt, check if there's any data at all.
+	// if there's no data at all, it's an empty file, not an encrypted one.
 	stat, err := fd.Stat()
 	if err != nil {
-		return err
+		fd.Close()
+		return nil, err
 	}
 
 	if stat.Size() <= 0 {
-		this.plaintextSize = 0
-		return nil
+		return fd, nil
 	}
 
 	message, err := openpgp.ReadMessage(fd, defaultEmptyKeyring, newNoPromptKey(this.key).prompt, nil)
 	if err != nil {
-		return err
+		fd.Close()
+		return nil, err
 	}
 
 	if !message.IsEncrypted {
-		return errors.New("File is not encrypted, but has pgp extension")
+		fd.Close()
+		return nil, errors.New("File is not encrypted, but has pgp extension")
 	}
 	if !message.IsSymmetricallyEncrypted {
-		return errors.New("File is encrypted, but not symmetrically")
+		fd.Close()
+		return nil, errors.New("File is encrypted, but not symmetrically")
 	}
 
-	this.encryptedReader = message.UnverifiedBody
-	this.seekPos = 0
-	return nil
+	return decryptedReader{Reader: message.UnverifiedBody, fd: fd}, nil
 }
 
-// return the plaintext size, whether or not the file had to be reopened to determine that size, and any errors.
-func (this *encryptedFile) getPlaintextSize() (int64, bool, error) {
-	
-	// if we have a "cached" size, just use that.
-	if this.plaintextSize > 0 {
-		return this.plaintextSize, false, nil
+// returns the plaintext size, decrypting the whole file to find it if it isn't already known.
+func (this *encryptedFile) getPlaintextSize() (int64, error) {
+
+	stat, err := this.File.Stat()
+	if err != nil {
+		return -1, err
 	}
 
-	if this.encryptedReader == nil {
-		return -1, false, errors.New("no encrypted reader initialized")
+	size, ok := cachedPlaintextSize(this.path, stat)
+	if ok {
+		return size, nil
 	}
 
-	written, err := io.Copy(ioutil.Discard, this.encryptedReader)
+	reader, err := this.decrypt()
 	if err != nil {
-		return -1, false, err
+		return -1, err
 	}
+	defer reader.Close()
 
-	totalSize := written + this.seekPos
-	
-	// reopen, since we've now changed the reader
-	err = this.open(true)
+	size, err = io.Copy(ioutil.Discard, reader)
 	if err != nil {
-		return -1, false, err
+		return -1, err
 	}
 
-	this.plaintextSize = totalSize
-	return totalSize, true, nil
+	plaintextSizes.mutex.Lock()
+	plaintextSizes.sizes[this.path] = cachedSize{stamp: encryptedStamp(stat), size: size}
+	plaintextSizes.mutex.Unlock()
+	return size, nil
+}
+
+func cachedPlaintextSize(path string, stat os.FileInfo) (int64, bool) {
+
+	plaintextSizes.mutex.Lock()
+	defer plaintextSizes.mutex.Unlock()
+
+	cached, ok := plaintextSizes.sizes[path]
+	if !ok || cached.stamp != encryptedStamp(stat) {
+		return 0, false
+	}
+	return cached.size, true
+}
+
+func encryptedStamp(stat os.FileInfo) string {
+	return fmt.Sprintf("%d:%d", stat.Size(), stat.ModTime().UnixNano())
+}
+
+// a decrypted stream, which closes the underlying encrypted file when closed.
+type decryptedReader struct {
+	io.Reader
+	fd *os.File
+}
+
+func (this decryptedReader) Close() error {
+	return this.fd.Close()
 }
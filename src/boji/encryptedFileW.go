@@ -4,6 +4,7 @@ import (
 	"io"
 	"os"
 	"errors"
+	"time"
 	"golang.org/x/crypto/openpgp"
 )
 
@@ -19,6 +20,7 @@ type encryptedFileW struct {
 	key []byte
 	flag int
 	perm os.FileMode
+	modTime time.Time
 }
 
 func newEncryptedFileW(path string, key []byte, flag int, perm os.FileMode, stats *telemetryStats) (*encryptedFileW, error) {
@@ -63,14 +65,37 @@ func (this *encryptedFileW) Write(p []byte) (int, error) {
 
 func (this *encryptedFileW) Close() error {
 	
+	var err error
+
 	// if we haven't written anything, return the fd closure err
 	if this.encryptedWriter == nil {
-		return this.fd.Close()
+		err = this.fd.Close()
+	} else {
+
+		// otherwise, make sure fd closes, but preferentially return encrypted writer closure
+		err = this.encryptedWriter.Close()
+		closeErr := this.fd.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	if err != nil || this.modTime.IsZero() {
+		return err
 	}
+	return os.Chtimes(this.Path, this.modTime, this.modTime)
+}
 
-	// otherwise, make sure fd closes, but preferentially return encrypted writer closure
-	defer this.fd.Close()
-	return this.encryptedWriter.Close()
+// closes and removes the file without finishing its encryption, for a write that's being thrown away.
+func (this *encryptedFileW) Discard() error {
+	this.fd.Close()
+	return os.Remove(this.Path)
+}
+
+// the given time is applied to the on-disk encrypted file once it's closed.
+func (this *encryptedFileW) SetModTime(modTime time.Time) error {
+	this.modTime = modTime
+	return nil
 }
 
 func (this *encryptedFileW) Stat() (os.FileInfo, error) {
@@ -90,15 +115,33 @@ func (this *encryptedFileW) Stat() (os.FileInfo, error) {
 		return nil, err
 	}
 
+	// what's on disk is the encrypted file, but it's served by its plaintext name.
+	trimmed, _ := hideEncryptionExtension(info.Name())
+
 	return overrideFileInfo {
 		FixedSize: this.plaintextBytes,
-		FixedName: info.Name() + encryptedExtension,
+		FixedName: trimmed,
 		wrapped: info,
 	}, nil
 }
 
+/*
+	Encryption is a stream, so the only seeks that make sense are the ones which don't actually move anywhere -
+	asking where we are, or seeking to the end of what's been written so far.
+*/
 func (this *encryptedFileW) Seek(offset int64, whence int) (n int64, err error) {
-	return -1, errors.New("Cannot seek an encrypted file")
+
+	switch whence {
+	case io.SeekStart:
+		if offset == this.plaintextBytes {
+			return this.plaintextBytes, nil
+		}
+	case io.SeekCurrent, io.SeekEnd:
+		if offset == 0 {
+			return this.plaintextBytes, nil
+		}
+	}
+	return this.plaintextBytes, errors.New("Cannot seek an encrypted file while writing it")
 }
 func (this *encryptedFileW) Readdir(count int) ([]os.FileInfo, error) {
 	return []os.FileInfo{}, nil
@@ -97,6 +97,7 @@ func encryptFile(path string, key []byte) error {
 		return err
 	}
 
+	copyPropertiesXattr(path, encryptedPath)
 	return os.Remove(path)
 }
 
@@ -124,22 +125,24 @@ func decryptFile(path string, key []byte) error {
 		return err
 	}
 
-	dst, err := os.Create(decryptPath)
+	// the key is checked first, so a wrong one doesn't leave an empty file behind.
+	message, err := openpgp.ReadMessage(src, defaultEmptyKeyring, newNoPromptKey(key).prompt, nil)
 	if err != nil {
 		return err
 	}
-	defer dst.Close()
 
-	message, err := openpgp.ReadMessage(src, defaultEmptyKeyring, newNoPromptKey(key).prompt, nil)
+	dst, err := os.Create(decryptPath)
 	if err != nil {
 		return err
 	}
+	defer dst.Close()
 	
 	_, err = io.Copy(dst, message.UnverifiedBody)
 	if err != nil {
 		return err
 	}
 
+	copyPropertiesXattr(path, decryptPath)
 	return os.Remove(path)
 }
 
@@ -0,0 +1,312 @@
+package boji
+
+import (
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"encoding/binary"
+)
+
+const exifOrientationTag = 0x0112
+const exifMakeTag = 0x010F
+const exifModelTag = 0x0110
+const exifIFDTag = 0x8769
+const exifGPSIFDTag = 0x8825
+const exifDateTimeOriginalTag = 0x9003
+const exifOffsetTimeOriginalTag = 0x9011
+const exifGPSLatitudeRefTag = 0x0001
+const exifGPSLatitudeTag = 0x0002
+const exifGPSLongitudeRefTag = 0x0003
+const exifGPSLongitudeTag = 0x0004
+
+// EXIF is kept in an APP1 segment near the start, which is never bigger than 64K.
+const exifReadLimit = 128 << 10
+
+var errNoExif = errors.New("No EXIF data")
+
+/*
+	What boji cares about from a photo's EXIF data.
+*/
+type exifData struct {
+	// how the image has to be turned to be the right way up, from 1 (it already is) to 8.
+	Orientation int
+
+	// when the photo was taken, as the camera's clock had it. Zero if it isn't known.
+	Taken time.Time
+	// whether the camera also recorded its timezone; if it didn't, Taken is in UTC but means local time.
+	TakenZoned bool
+
+	Camera string
+
+	HasLocation bool
+	Latitude float64
+	Longitude float64
+}
+
+/*
+	Reads the EXIF data from a JPEG, which is kept in an APP1 segment before the image itself.
+*/
+func readExif(jpeg []byte) (exifData, error) {
+
+	var ret exifData
+
+	tiff, err := exifSegment(jpeg)
+	if err != nil {
+		return ret, err
+	}
+
+	reader, err := newTiffReader(tiff)
+	if err != nil {
+		return ret, err
+	}
+
+	ifd0, err := reader.ifd(reader.first)
+	if err != nil {
+		return ret, err
+	}
+
+	orientation, ok := ifd0[exifOrientationTag].uint(reader.order, 0)
+	if ok && orientation >= 1 && orientation <= 8 {
+		ret.Orientation = int(orientation)
+	}
+
+	// the model usually has the maker in it already ("Canon EOS 5D"), but not always ("Pixel 7").
+	maker := ifd0[exifMakeTag].string()
+	model := ifd0[exifModelTag].string()
+	if maker != "" && !strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		model = strings.TrimSpace(maker + " " + model)
+	}
+	ret.Camera = model
+
+	// the date and location are in IFDs of their own, which either might be missing or broken.
+	exifIFD, ok := reader.subIFD(ifd0, exifIFDTag)
+	if ok {
+		ret.Taken, ret.TakenZoned = parseExifTime(exifIFD[exifDateTimeOriginalTag].string(), exifIFD[exifOffsetTimeOriginalTag].string())
+	}
+
+	gps, ok := reader.subIFD(ifd0, exifGPSIFDTag)
+	if ok {
+		latitude, latitudeOK := gps[exifGPSLatitudeTag].degrees(reader.order)
+		longitude, longitudeOK := gps[exifGPSLongitudeTag].degrees(reader.order)
+
+		if latitudeOK && longitudeOK {
+			if gps[exifGPSLatitudeRefTag].string() == "S" {
+				latitude = -latitude
+			}
+			if gps[exifGPSLongitudeRefTag].string() == "W" {
+				longitude = -longitude
+			}
+			ret.HasLocation = true
+			ret.Latitude = latitude
+			ret.Longitude = longitude
+		}
+	}
+	return ret, nil
+}
+
+/*
+	Parses an EXIF date, like "2023:05:04 13:22:11", and the offset of the timezone it's in, like "+01:00", if there is one.
+	Cameras that don't know the date write it as zeroes or spaces, which come out as a zero time.
+*/
+func parseExifTime(value string, offset string) (time.Time, bool) {
+
+	if offset != "" {
+		ret, err := time.Parse("2006:01:02 15:04:05-07:00", value + offset)
+		if err == nil {
+			return ret, true
+		}
+	}
+
+	ret, err := time.Parse("2006:01:02 15:04:05", value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return ret, false
+}
+
+// the TIFF structure inside a JPEG's Exif segment.
+func exifSegment(jpeg []byte) ([]byte, error) {
+
+	if len(jpeg) < 4 || jpeg[0] != 0xFF || jpeg[1] != 0xD8 {
+		return nil, errNoExif
+	}
+
+	for offset := 2; offset + 4 <= len(jpeg); {
+
+		if jpeg[offset] != 0xFF {
+			return nil, errNoExif
+		}
+
+		marker := jpeg[offset+1]
+		length := int(binary.BigEndian.Uint16(jpeg[offset+2:]))
+
+		// the image data starts at start-of-scan, and EXIF is always before it.
+		if marker == 0xDA || length < 2 || offset + 2 + length > len(jpeg) {
+			return nil, errNoExif
+		}
+
+		segment := jpeg[offset+4 : offset+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		offset += 2 + length
+	}
+	return nil, errNoExif
+}
+
+//
+
+type tiffReader struct {
+	data []byte
+	order binary.ByteOrder
+	first uint32
+}
+
+// one entry of an image file directory (IFD); its value, however many of whatever type it is.
+type tiffEntry struct {
+	kind uint16
+	count uint32
+	value []byte
+}
+
+func newTiffReader(data []byte) (tiffReader, error) {
+
+	ret := tiffReader{data: data}
+	if len(data) < 8 {
+		return ret, errNoExif
+	}
+
+	switch string(data[:2]) {
+	case "II": ret.order = binary.LittleEndian
+	case "MM": ret.order = binary.BigEndian
+	default: return ret, errNoExif
+	}
+
+	ret.first = ret.order.Uint32(data[4:])
+	return ret, nil
+}
+
+// the IFD that the given tag of another points to.
+func (this tiffReader) subIFD(parent map[uint16]tiffEntry, tag uint16) (map[uint16]tiffEntry, bool) {
+
+	offset, ok := parent[tag].uint(this.order, 0)
+	if !ok {
+		return nil, false
+	}
+
+	ret, err := this.ifd(offset)
+	return ret, err == nil
+}
+
+// the size of one value of each TIFF type.
+func tiffTypeSize(kind uint16) int {
+
+	switch kind {
+	case 1, 2, 6, 7: return 1
+	case 3, 8: return 2
+	case 4, 9, 11: return 4
+	case 5, 10, 12: return 8
+	}
+	return 0
+}
+
+/*
+	Reads the IFD at the given offset. Values of four bytes or less are kept in the entry itself;
+	anything bigger is somewhere else, at an offset the entry gives.
+*/
+func (this tiffReader) ifd(offset uint32) (map[uint16]tiffEntry, error) {
+
+	if uint64(offset) + 2 > uint64(len(this.data)) {
+		return nil, errNoExif
+	}
+
+	count := int(this.order.Uint16(this.data[offset:]))
+	ret := make(map[uint16]tiffEntry, count)
+
+	for i := 0; i < count; i++ {
+
+		start := int(offset) + 2 + i * 12
+		if start + 12 > len(this.data) {
+			break
+		}
+		raw := this.data[start : start+12]
+
+		entry := tiffEntry {
+			kind: this.order.Uint16(raw[2:]),
+			count: this.order.Uint32(raw[4:]),
+		}
+
+		size := uint64(tiffTypeSize(entry.kind)) * uint64(entry.count)
+		if size == 0 {
+			continue
+		}
+
+		if size <= 4 {
+			entry.value = raw[8 : 8+size]
+		} else {
+			at := uint64(this.order.Uint32(raw[8:]))
+			if at + size > uint64(len(this.data)) {
+				continue
+			}
+			entry.value = this.data[at : at+size]
+		}
+		ret[this.order.Uint16(raw)] = entry
+	}
+	return ret, nil
+}
+
+// the [index]th value of an entry of any unsigned integer type.
+func (this tiffEntry) uint(order binary.ByteOrder, index int) (uint32, bool) {
+
+	size := tiffTypeSize(this.kind)
+	if uint32(index) >= this.count || len(this.value) < (index + 1) * size {
+		return 0, false
+	}
+
+	switch this.kind {
+	case 1: return uint32(this.value[index]), true
+	case 3: return uint32(order.Uint16(this.value[index*2:])), true
+	case 4: return order.Uint32(this.value[index*4:]), true
+	}
+	return 0, false
+}
+
+// an ASCII entry's value, without the NUL at the end (or the padding some cameras add).
+func (this tiffEntry) string() string {
+
+	if this.kind != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(this.value), "\x00"))
+}
+
+// the [index]th value of an unsigned rational entry.
+func (this tiffEntry) rational(order binary.ByteOrder, index int) (float64, bool) {
+
+	if this.kind != 5 || uint32(index) >= this.count || len(this.value) < (index + 1) * 8 {
+		return 0, false
+	}
+
+	numerator := order.Uint32(this.value[index*8:])
+	denominator := order.Uint32(this.value[index*8+4:])
+	if denominator == 0 {
+		return 0, false
+	}
+	return float64(numerator) / float64(denominator), true
+}
+
+// a GPS coordinate, which is kept as degrees, minutes and seconds.
+func (this tiffEntry) degrees(order binary.ByteOrder) (float64, bool) {
+
+	var parts [3]float64
+	for i := range parts {
+
+		value, ok := this.rational(order, i)
+		if !ok {
+			return 0, false
+		}
+		parts[i] = value
+	}
+	return parts[0] + parts[1] / 60 + parts[2] / 3600, true
+}
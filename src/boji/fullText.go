@@ -0,0 +1,706 @@
+package boji
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"context"
+	"unicode"
+	"net/http"
+	"io/ioutil"
+	"encoding/gob"
+	"path/filepath"
+)
+
+const fullTextParameter = "fulltext"
+
+// how much of any one file is read. Anything past this isn't indexed.
+const fullTextMaxBytes = 32 << 20
+
+// words longer than this are more likely to be noise (hashes, base64) than anything anyone would search for.
+const fullTextMaxTermLength = 40
+
+var errFullTextDisabled = errors.New("Full-text search isn't enabled")
+
+/*
+	An index of the words in every text, Markdown and PDF file, so that files can be searched for by what's in them.
+	Kept in a single file in the state dir, and kept up to date from the change feed.
+
+	Encrypted files are left out, unless a directory has been opted in by someone with its key - in which case each
+	encrypted file's words are indexed whenever it's written with the key, which does keep derived plaintext on disk.
+	The key itself is never kept.
+*/
+type fullTextIndex struct {
+	path string
+	fs archivableFS
+
+	documents map[string]fullTextDocument
+	postings map[string]map[string]bool
+	encrypted map[string]bool
+	dirty bool
+
+	pending chan fullTextJob
+	stop chan bool
+	mutex sync.RWMutex
+}
+
+// what's kept about each file; enough to tell whether it's changed since.
+type fullTextDocument struct {
+	Size int64
+	ModTime time.Time
+	Encrypted bool
+	Terms []string
+}
+
+// what's kept in the state dir.
+type fullTextState struct {
+	Documents map[string]fullTextDocument
+	Encrypted []string
+}
+
+// an encrypted file that's been written with a key, which has to be read with it while it's still known.
+type fullTextJob struct {
+	name string
+	key []byte
+}
+
+func newFullTextIndex(stateDir string, enabled bool) (*fullTextIndex, error) {
+
+	if !enabled {
+		return nil, nil
+	}
+
+	ret := &fullTextIndex {
+		path: filepath.Join(stateDir, "fulltext.index"),
+		documents: make(map[string]fullTextDocument),
+		postings: make(map[string]map[string]bool),
+		encrypted: make(map[string]bool),
+		pending: make(chan fullTextJob, 1024),
+		stop: make(chan bool),
+	}
+
+	fd, err := os.Open(ret.path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var state fullTextState
+	err = gob.NewDecoder(bufio.NewReader(fd)).Decode(&state)
+	if err != nil {
+		// it can always be built again.
+		fmt.Fprintf(os.Stderr, "Unable to read full-text index '%s' (%v), rebuilding it\n", ret.path, err)
+		return ret, nil
+	}
+
+	for name, document := range state.Documents {
+		ret.add(name, document)
+	}
+	for _, dir := range state.Encrypted {
+		ret.encrypted[dir] = true
+	}
+	return ret, nil
+}
+
+func (this *fullTextIndex) run() {
+
+	if this == nil {
+		return
+	}
+
+	cursor := this.fs.changes.cursor()
+	_, events, _ := this.fs.changes.subscribe(cursor)
+
+	// anything could have changed while boji wasn't running.
+	this.updateTree("/")
+	this.save()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.stop:
+			this.fs.changes.unsubscribe(events)
+			this.save()
+			return
+
+		case job := <-this.pending:
+			// saved straight away, since this can't be read again without the key.
+			this.update(job.name, job.key)
+			this.save()
+
+		case event, open := <-events:
+			if !open {
+				var missed []changeEvent
+				var ok bool
+
+				missed, events, ok = this.fs.changes.subscribe(cursor)
+				if !ok {
+					this.updateTree("/")
+					cursor = this.fs.changes.cursor()
+					continue
+				}
+				for _, event := range missed {
+					this.apply(event)
+					cursor = event.ID
+				}
+				continue
+			}
+			this.apply(event)
+			cursor = event.ID
+
+		case <-ticker.C:
+			this.save()
+		}
+	}
+}
+
+func (this *fullTextIndex) Close() {
+
+	if this == nil {
+		return
+	}
+	this.stop <- true
+}
+
+/*
+	Called when a file has been written. Only encrypted files written with a key need anything done here,
+	since those can't be read once the key's gone - everything else is picked up from the change feed.
+*/
+func (this *fullTextIndex) wrote(name string, key []byte) {
+
+	if this == nil || len(key) == 0 {
+		return
+	}
+
+	select {
+	case this.pending <- fullTextJob{name: slashClean(name), key: key}:
+	default:
+		fmt.Fprintf(os.Stderr, "Full-text index is falling behind, not indexing '%s'\n", name)
+	}
+}
+
+func (this *fullTextIndex) apply(event changeEvent) {
+
+	switch {
+	case event.Type == "delete":
+		this.remove(event.Path, event.Directory)
+
+	case event.Type == "move":
+		this.move(event.Path, event.Destination, event.Directory)
+		if event.Directory {
+			this.updateTree(event.Destination)
+		} else {
+			this.update(event.Destination, nil)
+		}
+
+	case event.Directory:
+		this.updateTree(event.Path)
+
+	default:
+		this.update(event.Path, nil)
+	}
+}
+
+/*
+	Brings every file beneath a directory up to date, and forgets any that aren't there any more.
+*/
+func (this *fullTextIndex) updateTree(dir string) {
+
+	dir = slashClean(dir)
+	seen := make(map[string]bool)
+
+	this.fs.walk(context.Background(), dir, true, func(entry searchEntry) {
+		if !entry.Directory {
+			seen[entry.Path] = true
+			this.updateEntry(entry, nil)
+		}
+	})
+
+	var gone []string
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	this.mutex.RLock()
+	for name := range this.documents {
+		if strings.HasPrefix(name, prefix) && !seen[name] {
+			gone = append(gone, name)
+		}
+	}
+	this.mutex.RUnlock()
+
+	for _, name := range gone {
+		this.remove(name, false)
+	}
+}
+
+func (this *fullTextIndex) update(name string, key []byte) {
+
+	ctx := context.Background()
+	name = slashClean(name)
+
+	info, err := this.fs.statListed(ctx, name)
+	if err != nil {
+		this.remove(name, false)
+		return
+	}
+	if info.IsDir() {
+		return
+	}
+	this.updateEntry(newSearchEntry(name, info, this.fs.mimeTypes), key)
+}
+
+/*
+	Reads and indexes a file, unless it hasn't changed since it was last indexed.
+	Encrypted files can only be read with a key, and only in opted-in directories. Without one, whatever was indexed
+	for them is kept as it is (since it was indexed when they were written), or dropped if they aren't opted in any more.
+*/
+func (this *fullTextIndex) updateEntry(entry searchEntry, key []byte) {
+
+	name := entry.Path
+	encrypted := existsOnDisk(this.fs.resolve(name) + encryptedExtension)
+
+	this.mutex.RLock()
+	existing, indexed := this.documents[name]
+	optedIn := this.isOptedIn(name)
+	this.mutex.RUnlock()
+
+	if !isFullTextIndexable(entry) || (encrypted && !optedIn) {
+		this.remove(name, false)
+		return
+	}
+
+	if encrypted && len(key) == 0 {
+		if indexed && !existing.Encrypted {
+			existing.Encrypted = true
+			this.store(name, existing)
+		}
+		return
+	}
+
+	if indexed && existing.Size == entry.Size && existing.ModTime.Equal(entry.Modified) && existing.Encrypted == encrypted {
+		return
+	}
+
+	ctx := context.Background()
+	if len(key) > 0 {
+		ctx = context.WithValue(ctx, contextEncryptionKey, key)
+	}
+
+	terms, err := this.extract(ctx, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to index the content of '%s': %v\n", name, err)
+		this.remove(name, false)
+		return
+	}
+
+	this.store(name, fullTextDocument {
+		Size: entry.Size,
+		ModTime: entry.Modified,
+		Encrypted: encrypted,
+		Terms: terms,
+	})
+}
+
+// every distinct word in a file.
+func (this *fullTextIndex) extract(ctx context.Context, name string) ([]string, error) {
+
+	file, err := this.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = io.LimitReader(file, fullTextMaxBytes)
+	if strings.ToLower(path.Ext(name)) == ".pdf" {
+		contents, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(extractPDFText(contents))
+	}
+
+	unique := make(map[string]bool)
+	err = fullTextTerms(bufio.NewReader(reader), func(term string) {
+		unique[term] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	terms := make([]string, 0, len(unique))
+	for term := range unique {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	return terms, nil
+}
+
+func (this *fullTextIndex) store(name string, document fullTextDocument) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.drop(name)
+	this.add(name, document)
+	this.dirty = true
+}
+
+func (this *fullTextIndex) remove(name string, dir bool) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.drop(name)
+	if !dir {
+		return
+	}
+
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for known := range this.documents {
+		if strings.HasPrefix(known, prefix) {
+			this.drop(known)
+		}
+	}
+}
+
+// carries whatever was indexed for something that's moved along with it, so that encrypted files don't have to be read again.
+func (this *fullTextIndex) move(from string, to string, dir bool) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	moved := make(map[string]fullTextDocument)
+	prefix := strings.TrimSuffix(from, "/") + "/"
+
+	for name, document := range this.documents {
+		switch {
+		case name == from:
+			moved[to] = document
+		case dir && strings.HasPrefix(name, prefix):
+			moved[path.Join(to, strings.TrimPrefix(name, prefix))] = document
+		default:
+			continue
+		}
+		this.drop(name)
+	}
+
+	// whatever was at the destination has been replaced.
+	for name, document := range moved {
+		this.drop(name)
+		if !document.Encrypted || this.isOptedIn(name) {
+			this.add(name, document)
+		}
+	}
+	this.dirty = true
+}
+
+// adds a document and its postings. Caller must hold the mutex.
+func (this *fullTextIndex) add(name string, document fullTextDocument) {
+
+	this.documents[name] = document
+	for _, term := range document.Terms {
+
+		documents, ok := this.postings[term]
+		if !ok {
+			documents = make(map[string]bool)
+			this.postings[term] = documents
+		}
+		documents[name] = true
+	}
+}
+
+// removes a document and its postings. Caller must hold the mutex.
+func (this *fullTextIndex) drop(name string) {
+
+	document, ok := this.documents[name]
+	if !ok {
+		return
+	}
+
+	for _, term := range document.Terms {
+		delete(this.postings[term], name)
+		if len(this.postings[term]) == 0 {
+			delete(this.postings, term)
+		}
+	}
+	delete(this.documents, name)
+	this.dirty = true
+}
+
+// whether encrypted files at this name are indexed. Caller must hold the mutex.
+func (this *fullTextIndex) isOptedIn(name string) bool {
+
+	for name = slashClean(name); ; name = path.Dir(name) {
+		if this.encrypted[name] {
+			return true
+		}
+		if name == "/" {
+			return false
+		}
+	}
+}
+
+/*
+	Starts indexing encrypted files beneath a directory, reading every one that's there now with the given key.
+*/
+func (this *fullTextIndex) includeEncrypted(dir string, key []byte) {
+
+	dir = slashClean(dir)
+
+	this.mutex.Lock()
+	this.encrypted[dir] = true
+	this.dirty = true
+	this.mutex.Unlock()
+
+	ctx := context.WithValue(context.Background(), contextEncryptionKey, key)
+	this.fs.walk(ctx, dir, true, func(entry searchEntry) {
+		if !entry.Directory && existsOnDisk(this.fs.resolve(entry.Path) + encryptedExtension) {
+			this.updateEntry(entry, key)
+		}
+	})
+	this.save()
+}
+
+/*
+	Stops indexing encrypted files beneath a directory, and forgets everything that was indexed from them.
+*/
+func (this *fullTextIndex) excludeEncrypted(dir string) {
+
+	dir = slashClean(dir)
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	this.mutex.Lock()
+	for optedIn := range this.encrypted {
+		if optedIn == dir || strings.HasPrefix(optedIn, prefix) {
+			delete(this.encrypted, optedIn)
+		}
+	}
+	for name, document := range this.documents {
+		if document.Encrypted && !this.isOptedIn(name) {
+			this.drop(name)
+		}
+	}
+	this.dirty = true
+	this.mutex.Unlock()
+
+	this.save()
+}
+
+/*
+	Every file containing all of the given words (ignoring case). A word ending in * matches any word starting with it.
+*/
+func (this *fullTextIndex) matching(query string) map[string]bool {
+
+	var ret map[string]bool
+
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+
+		prefix := strings.HasSuffix(word, "*")
+		var found map[string]bool
+
+		fullTextTerms(strings.NewReader(strings.TrimSuffix(word, "*")), func(term string) {
+
+			// a word with punctuation in it is indexed as several; all of them have to be there.
+			var matches map[string]bool
+			if prefix {
+				matches = make(map[string]bool)
+				for indexed, documents := range this.postings {
+					if strings.HasPrefix(indexed, term) {
+						for name := range documents {
+							matches[name] = true
+						}
+					}
+				}
+			} else {
+				matches = this.postings[term]
+			}
+
+			found = intersect(found, matches)
+		})
+		if found == nil {
+			found = make(map[string]bool)
+		}
+		ret = intersect(ret, found)
+	}
+
+	if ret == nil {
+		ret = make(map[string]bool)
+	}
+	return ret
+}
+
+/*
+	Matches files containing all of the given words. The files are found once, up front,
+	so that a search sees the index as it was when it started.
+	Encrypted files are only matched for a request with a key, so that nobody without one can learn what's in them.
+*/
+func (this *fullTextIndex) containing(query string, keyed bool) (searchMatcher, error) {
+
+	if this == nil {
+		return nil, errFullTextDisabled
+	}
+
+	found := this.matching(query)
+	if !keyed {
+		this.mutex.RLock()
+		for name := range found {
+			if this.documents[name].Encrypted {
+				delete(found, name)
+			}
+		}
+		this.mutex.RUnlock()
+	}
+
+	return func(entry searchEntry) bool {
+		return found[entry.Path]
+	}, nil
+}
+
+// the names in both sets. A nil set is the first, and doesn't narrow anything down.
+func intersect(a map[string]bool, b map[string]bool) map[string]bool {
+
+	ret := make(map[string]bool)
+	if a == nil {
+		for name := range b {
+			ret[name] = true
+		}
+		return ret
+	}
+
+	for name := range a {
+		if b[name] {
+			ret[name] = true
+		}
+	}
+	return ret
+}
+
+func (this *fullTextIndex) save() {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if !this.dirty {
+		return
+	}
+
+	state := fullTextState {
+		Documents: this.documents,
+	}
+	for dir := range this.encrypted {
+		state.Encrypted = append(state.Encrypted, dir)
+	}
+
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(state)
+	if err == nil {
+		tempPath := this.path + "~"
+		err = ioutil.WriteFile(tempPath, buffer.Bytes(), 0600)
+		if err == nil {
+			err = os.Rename(tempPath, this.path)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to save full-text index: %v\n", err)
+		return
+	}
+	this.dirty = false
+}
+
+func isFullTextIndexable(entry searchEntry) bool {
+
+	switch strings.ToLower(path.Ext(entry.Path)) {
+	case ".txt", ".text", ".md", ".markdown", ".pdf":
+		return true
+	}
+	return strings.HasPrefix(entry.ContentType, "text/")
+}
+
+// calls [fn] with every word in some text, lowercased.
+func fullTextTerms(reader io.RuneReader, fn func(string)) error {
+
+	var term []rune
+	emit := func() {
+		if len(term) > 1 && len(term) <= fullTextMaxTermLength {
+			fn(string(term))
+		}
+		term = term[:0]
+	}
+
+	for {
+		r, _, err := reader.ReadRune()
+		if err == io.EOF {
+			emit()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			term = append(term, unicode.ToLower(r))
+		} else {
+			emit()
+		}
+	}
+}
+
+//
+
+/*
+	Handles `POST <dir>?fulltext=encrypted`, which opts a directory's encrypted files into the full-text index
+	(reading them with the key given), and `POST <dir>?fulltext=plain`, which opts them out again.
+	Returns true if this was one of those.
+*/
+func (this *Server) attemptFullTextRequest(w http.ResponseWriter, r *http.Request, key string) bool {
+
+	value, ok := r.URL.Query()[fullTextParameter]
+	if r.Method != "POST" || !ok {
+		return false
+	}
+
+	if this.fs.fulltext == nil {
+		http.Error(w, errFullTextDisabled.Error(), http.StatusNotFound)
+		return true
+	}
+
+	_, err := this.checkDir(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	switch value[0] {
+	case "encrypted":
+		if key == "" {
+			http.Error(w, "A key is needed to index encrypted files", http.StatusBadRequest)
+			return true
+		}
+		this.fs.fulltext.includeEncrypted(r.URL.Path, []byte(key))
+
+	case "plain":
+		this.fs.fulltext.excludeEncrypted(r.URL.Path)
+
+	default:
+		http.Error(w, "Invalid fulltext, expected encrypted or plain", http.StatusBadRequest)
+		return true
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
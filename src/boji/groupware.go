@@ -0,0 +1,1011 @@
+package boji
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"context"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/xml"
+	"encoding/json"
+	"golang.org/x/net/webdav"
+)
+
+const carddavNamespace = "urn:ietf:params:xml:ns:carddav"
+const caldavNamespace = "urn:ietf:params:xml:ns:caldav"
+const calendarServerNamespace = "http://calendarserver.org/ns/"
+
+const groupwareRulesFileName = "collections.json"
+const addressBookKind = "addressbook"
+const calendarKind = "calendar"
+
+// contacts and events are small; anything this big isn't one.
+const maxGroupwareObjectSize = 10 << 20
+
+var resourceTypeName = xml.Name{Space: "DAV:", Local: "resourcetype"}
+var getContentTypeName = xml.Name{Space: "DAV:", Local: "getcontenttype"}
+var currentUserPrincipalName = xml.Name{Space: "DAV:", Local: "current-user-principal"}
+var principalURLName = xml.Name{Space: "DAV:", Local: "principal-URL"}
+var currentUserPrivilegeSetName = xml.Name{Space: "DAV:", Local: "current-user-privilege-set"}
+var addressBookHomeSetName = xml.Name{Space: carddavNamespace, Local: "addressbook-home-set"}
+var supportedAddressDataName = xml.Name{Space: carddavNamespace, Local: "supported-address-data"}
+var maxAddressResourceSizeName = xml.Name{Space: carddavNamespace, Local: "max-resource-size"}
+var addressDataName = xml.Name{Space: carddavNamespace, Local: "address-data"}
+var calendarHomeSetName = xml.Name{Space: caldavNamespace, Local: "calendar-home-set"}
+var supportedCalendarComponentSetName = xml.Name{Space: caldavNamespace, Local: "supported-calendar-component-set"}
+var supportedCalendarDataName = xml.Name{Space: caldavNamespace, Local: "supported-calendar-data"}
+var maxCalendarResourceSizeName = xml.Name{Space: caldavNamespace, Local: "max-resource-size"}
+var calendarDataName = xml.Name{Space: caldavNamespace, Local: "calendar-data"}
+var getctagName = xml.Name{Space: calendarServerNamespace, Local: "getctag"}
+
+// the properties boji works out for itself, which can't be set by clients.
+var protectedGroupwareProperties = map[xml.Name]bool {
+	currentUserPrincipalName: true,
+	principalURLName: true,
+	currentUserPrivilegeSetName: true,
+	addressBookHomeSetName: true,
+	supportedAddressDataName: true,
+	maxAddressResourceSizeName: true,
+	addressDataName: true,
+	calendarHomeSetName: true,
+	supportedCalendarComponentSetName: true,
+	supportedCalendarDataName: true,
+	maxCalendarResourceSizeName: true,
+	calendarDataName: true,
+	getctagName: true,
+}
+
+var errGroupwareObjectTooLarge = errors.New("Too large to be a contact or event")
+
+/*
+	Directories which are CardDAV address books or CalDAV calendars. Their contacts and events are kept as plain
+	.vcf and .ics files, one for each that clients upload, so they're as readable on disk as anything else -
+	and can be compressed or encrypted just the same.
+
+	boji has only one user, so the root is their principal, and the home of all of their address books and calendars.
+	Collections can be anywhere, but clients looking for them will only find the ones at the top.
+*/
+type groupwareCollections struct {
+	rulesPath string
+	changes *changeFeed
+
+	kinds map[string]string
+	mutex sync.Mutex
+}
+
+func newGroupwareCollections(stateDir string, changes *changeFeed) (*groupwareCollections, error) {
+
+	ret := &groupwareCollections {
+		rulesPath: filepath.Join(stateDir, groupwareRulesFileName),
+		changes: changes,
+		kinds: make(map[string]string),
+	}
+
+	encoded, err := ioutil.ReadFile(ret.rulesPath)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(encoded, &ret.kinds)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// makes a directory an address book or a calendar - or, with an empty kind, neither.
+func (this *groupwareCollections) setKind(name string, kind string) error {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if kind == "" {
+		delete(this.kinds, slashClean(name))
+	} else {
+		this.kinds[slashClean(name)] = kind
+	}
+	return this.save()
+}
+
+func (this *groupwareCollections) kindOf(name string) string {
+
+	if this == nil {
+		return ""
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.kinds[slashClean(name)]
+}
+
+// collections stay collections when they (or a directory they're in) are moved.
+func (this *groupwareCollections) move(oldName string, newName string) {
+
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	oldName = slashClean(oldName)
+	newName = slashClean(newName)
+	moved := false
+
+	for name, kind := range this.kinds {
+		if name == oldName || strings.HasPrefix(name, oldName + "/") {
+			delete(this.kinds, name)
+			this.kinds[newName + strings.TrimPrefix(name, oldName)] = kind
+			moved = true
+		}
+	}
+
+	if moved {
+		err := this.save()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to save collections: %v\n", err)
+		}
+	}
+}
+
+func (this *groupwareCollections) save() error {
+
+	encoded, err := json.Marshal(this.kinds)
+	if err != nil {
+		return err
+	}
+
+	tempPath := this.rulesPath + "~"
+	err = ioutil.WriteFile(tempPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, this.rulesPath)
+}
+
+/*
+	The live properties that clients look for to find address books and calendars, and to know what they can do with them.
+	Every directory points at the principal; address books and calendars say what they are.
+	Contacts and events inside them are given their proper content types, whatever they're named.
+*/
+func (this *groupwareCollections) properties(name string, info os.FileInfo) map[xml.Name]webdav.Property {
+
+	if this == nil {
+		return nil
+	}
+
+	ret := make(map[xml.Name]webdav.Property)
+	add := func(name xml.Name, value string) {
+		ret[name] = webdav.Property{XMLName: name, InnerXML: []byte(value)}
+	}
+
+	if !info.IsDir() {
+		kind := this.kindOf(path.Dir(slashClean(name)))
+		if kind != "" {
+			add(getContentTypeName, groupwareContentType(kind))
+		}
+		return ret
+	}
+
+	add(currentUserPrincipalName, `<D:href xmlns:D="DAV:">/</D:href>`)
+	if slashClean(name) == "/" {
+		add(principalURLName, `<D:href xmlns:D="DAV:">/</D:href>`)
+		add(addressBookHomeSetName, `<D:href xmlns:D="DAV:">/</D:href>`)
+		add(calendarHomeSetName, `<D:href xmlns:D="DAV:">/</D:href>`)
+	}
+
+	kind := this.kindOf(name)
+	if kind == "" {
+		return ret
+	}
+
+	add(currentUserPrivilegeSetName, `<D:privilege xmlns:D="DAV:"><D:read/></D:privilege>` +
+		`<D:privilege xmlns:D="DAV:"><D:write/></D:privilege>` +
+		`<D:privilege xmlns:D="DAV:"><D:write-properties/></D:privilege>` +
+		`<D:privilege xmlns:D="DAV:"><D:write-content/></D:privilege>` +
+		`<D:privilege xmlns:D="DAV:"><D:bind/></D:privilege>` +
+		`<D:privilege xmlns:D="DAV:"><D:unbind/></D:privilege>`)
+
+	if this.changes != nil {
+		add(getctagName, syncTokenPrefix + strconv.FormatInt(this.changes.cursor(), 10))
+	}
+
+	switch kind {
+	case addressBookKind:
+		add(resourceTypeName, `<D:collection xmlns:D="DAV:"/><C:addressbook xmlns:C="` + carddavNamespace + `"/>`)
+		add(supportedAddressDataName,
+			`<C:address-data-type xmlns:C="` + carddavNamespace + `" content-type="text/vcard" version="3.0"/>` +
+			`<C:address-data-type xmlns:C="` + carddavNamespace + `" content-type="text/vcard" version="4.0"/>`)
+		add(maxAddressResourceSizeName, strconv.Itoa(maxGroupwareObjectSize))
+		add(supportedReportSetName, supportedReports(
+			`<D:sync-collection xmlns:D="DAV:"/>`,
+			`<C:addressbook-query xmlns:C="` + carddavNamespace + `"/>`,
+			`<C:addressbook-multiget xmlns:C="` + carddavNamespace + `"/>`))
+
+	case calendarKind:
+		add(resourceTypeName, `<D:collection xmlns:D="DAV:"/><C:calendar xmlns:C="` + caldavNamespace + `"/>`)
+		add(supportedCalendarComponentSetName,
+			`<C:comp xmlns:C="` + caldavNamespace + `" name="VEVENT"/>` +
+			`<C:comp xmlns:C="` + caldavNamespace + `" name="VTODO"/>` +
+			`<C:comp xmlns:C="` + caldavNamespace + `" name="VJOURNAL"/>`)
+		add(supportedCalendarDataName, `<C:calendar-data xmlns:C="` + caldavNamespace + `" content-type="text/calendar" version="2.0"/>`)
+		add(maxCalendarResourceSizeName, strconv.Itoa(maxGroupwareObjectSize))
+		add(supportedReportSetName, supportedReports(
+			`<D:sync-collection xmlns:D="DAV:"/>`,
+			`<C:calendar-query xmlns:C="` + caldavNamespace + `"/>`,
+			`<C:calendar-multiget xmlns:C="` + caldavNamespace + `"/>`,
+			`<C:free-busy-query xmlns:C="` + caldavNamespace + `"/>`))
+	}
+	return ret
+}
+
+func supportedReports(reports ...string) string {
+
+	var ret string
+	for _, report := range reports {
+		ret += `<D:supported-report xmlns:D="DAV:"><D:report>` + report + `</D:report></D:supported-report>`
+	}
+	return ret
+}
+
+func groupwareContentType(kind string) string {
+
+	if kind == calendarKind {
+		return "text/calendar; charset=utf-8"
+	}
+	return "text/vcard; charset=utf-8"
+}
+
+func isGroupwareProperty(name xml.Name) bool {
+	return protectedGroupwareProperties[name]
+}
+
+//
+
+/*
+	Handles what CardDAV and CalDAV add to webdav, returning true if the request has been dealt with:
+		discovery through `/.well-known/carddav` and `/.well-known/caldav`, which lead to the root,
+		making address books and calendars with an extended MKCOL (RFC 5689) or MKCALENDAR,
+		and the REPORTs for querying them.
+	Contacts and events going in are checked to be valid first, and so are the If-Match and If-None-Match headers
+	that clients use so as not to overwrite changes they haven't seen yet - then they're written as usual.
+*/
+func (this *Server) attemptGroupwareRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	switch {
+	case r.URL.Path == "/.well-known/carddav" || r.URL.Path == "/.well-known/caldav":
+		http.Redirect(w, r, "/", http.StatusMovedPermanently)
+		return true
+
+	case r.Method == "OPTIONS":
+		// webdav sets its own DAV header, but doesn't write anything, so it can still be added to afterwards.
+		this.wdav.ServeHTTP(w, r)
+		w.Header().Set("DAV", w.Header().Get("DAV") + ", addressbook, calendar-access")
+		return true
+
+	case r.Method == "MKCALENDAR" || (r.Method == "MKCOL" && r.ContentLength != 0):
+		this.serveExtendedMkcol(w, r)
+		return true
+
+	case r.Method == "REPORT":
+		return this.attemptGroupwareReport(w, r)
+	}
+
+	kind := this.fs.groupware.kindOf(path.Dir(slashClean(r.URL.Path)))
+	if kind == "" {
+		return false
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		w.Header().Set("Content-Type", groupwareContentType(kind))
+	case "PUT":
+		return this.checkGroupwareUpload(w, r, kind)
+	case "DELETE":
+		return !this.checkPreconditions(w, r)
+	}
+	return false
+}
+
+// the body of an extended MKCOL or MKCALENDAR; the properties to give the new collection.
+type mkcolRequest struct {
+	XMLName xml.Name
+	Sets []struct {
+		Prop struct {
+			Props []mkcolProperty `xml:",any"`
+		} `xml:"DAV: prop"`
+	} `xml:"DAV: set"`
+}
+
+type mkcolProperty struct {
+	XMLName xml.Name
+	InnerXML string `xml:",innerxml"`
+	Children []xmlNode `xml:",any"`
+}
+
+/*
+	Makes a collection - an address book or calendar, if its resourcetype says so (or it's a MKCALENDAR) -
+	with whatever other properties it's given, like its name and colour.
+*/
+func (this *Server) serveExtendedMkcol(w http.ResponseWriter, r *http.Request) {
+
+	var request mkcolRequest
+	err := xml.NewDecoder(r.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	kind := ""
+	if r.Method == "MKCALENDAR" {
+		kind = calendarKind
+	}
+
+	var props []webdav.Property
+	for _, set := range request.Sets {
+		for _, prop := range set.Prop.Props {
+
+			if prop.XMLName == resourceTypeName {
+				for _, child := range prop.Children {
+					switch child.XMLName {
+					case xml.Name{Space: carddavNamespace, Local: "addressbook"}: kind = addressBookKind
+					case xml.Name{Space: caldavNamespace, Local: "calendar"}: kind = calendarKind
+					}
+				}
+				continue
+			}
+
+			// every collection supports every component, so there's no need to remember which a client asked for.
+			if isGroupwareProperty(prop.XMLName) {
+				continue
+			}
+			props = append(props, webdav.Property{XMLName: prop.XMLName, InnerXML: []byte(prop.InnerXML)})
+		}
+	}
+
+	ctx := r.Context()
+	name := slashClean(r.URL.Path)
+
+	release, err := this.locks.claimForWrite(name, r.Header.Get("If"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
+	defer release()
+
+	err = this.fs.Mkdir(ctx, name, 0777)
+	if os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if kind != "" {
+		err = this.fs.groupware.setKind(name, kind)
+	}
+	if err == nil && len(props) > 0 {
+		err = this.patchProperties(ctx, name, props)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (this *Server) patchProperties(ctx context.Context, name string, props []webdav.Property) error {
+
+	file, err := this.fs.OpenFile(ctx, name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	holder, ok := file.(webdav.DeadPropsHolder)
+	if !ok {
+		return webdav.ErrNotImplemented
+	}
+	_, err = holder.Patch([]webdav.Proppatch{{Props: props}})
+	return err
+}
+
+/*
+	Checks that a contact or event being uploaded is one - a single vCard, or an iCalendar object with one
+	event, to-do or journal entry in it (and any exceptions to its recurrence) - before it's written.
+	Returns true if it wasn't, and has been refused.
+*/
+func (this *Server) checkGroupwareUpload(w http.ResponseWriter, r *http.Request, kind string) bool {
+
+	if r.ContentLength > maxGroupwareObjectSize {
+		writeGroupwareError(w, http.StatusForbidden, kind, "max-resource-size")
+		return true
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxGroupwareObjectSize + 1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	if len(body) > maxGroupwareObjectSize {
+		writeGroupwareError(w, http.StatusForbidden, kind, "max-resource-size")
+		return true
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if !this.checkPreconditions(w, r) {
+		return true
+	}
+
+	precondition := validateGroupwareObject(kind, body)
+	if precondition != "" {
+		writeGroupwareError(w, http.StatusForbidden, kind, precondition)
+		return true
+	}
+	return false
+}
+
+// the precondition that an uploaded contact or event fails, or an empty string if it's fine.
+func validateGroupwareObject(kind string, body []byte) string {
+
+	object, err := parseVObject(body)
+
+	if kind == addressBookKind {
+		if err != nil || object.Name != "VCARD" {
+			return "valid-address-data"
+		}
+		return ""
+	}
+
+	if err != nil || object.Name != "VCALENDAR" {
+		return "valid-calendar-data"
+	}
+
+	componentType := ""
+	uid := ""
+	for _, child := range object.Children {
+
+		if child.Name == "VTIMEZONE" {
+			continue
+		}
+		if child.Name != "VEVENT" && child.Name != "VTODO" && child.Name != "VJOURNAL" {
+			return "supported-calendar-component"
+		}
+
+		// exceptions to a recurring event are more components of the same type, with the same UID.
+		childUID, _ := child.property("UID")
+		if componentType == "" {
+			componentType = child.Name
+			uid = childUID.Value
+		}
+		if child.Name != componentType || childUID.Value != uid || uid == "" {
+			return "valid-calendar-object-resource"
+		}
+	}
+
+	if componentType == "" {
+		return "valid-calendar-object-resource"
+	}
+	return ""
+}
+
+/*
+	Checks If-Match and If-None-Match against the ETag of what's there now (or isn't), which webdav itself doesn't.
+	Returns false, having refused the request, if either isn't met.
+*/
+func (this *Server) checkPreconditions(w http.ResponseWriter, r *http.Request) bool {
+
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return true
+	}
+
+	ctx := r.Context()
+	etag := ""
+
+	info, err := this.fs.Stat(ctx, r.URL.Path)
+	exists := err == nil
+	if exists {
+		etagger, ok := info.(webdav.ETager)
+		if ok {
+			etag, _ = etagger.ETag(ctx)
+		}
+	}
+
+	failed := (ifMatch != "" && !(exists && (ifMatch == "*" || etagListContains(ifMatch, etag)))) ||
+		(ifNoneMatch == "*" && exists) ||
+		(ifNoneMatch != "" && exists && etagListContains(ifNoneMatch, etag))
+
+	if failed {
+		http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+func etagListContains(list string, etag string) bool {
+
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// responds with a DAV:error body naming the CardDAV or CalDAV precondition that failed.
+func writeGroupwareError(w http.ResponseWriter, status int, kind string, precondition string) {
+
+	namespace := carddavNamespace
+	if kind == calendarKind {
+		namespace = caldavNamespace
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:error xmlns:D="DAV:" xmlns:C="%s"><C:%s/></D:error>`, namespace, precondition)
+}
+
+//
+
+/*
+	Handles the CardDAV and CalDAV REPORTs, returning true if this was one:
+		addressbook-query and calendar-query, which give the contacts or events in a collection that match a filter,
+		addressbook-multiget and calendar-multiget, which give the ones asked for by name,
+		and free-busy-query, which says when the events in a calendar make someone busy.
+	Along with any properties, the queries and multigets can give the contacts or events themselves.
+*/
+func (this *Server) attemptGroupwareReport(w http.ResponseWriter, r *http.Request) bool {
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	report := reportName(body)
+	switch report {
+	case xml.Name{Space: carddavNamespace, Local: "addressbook-query"},
+		xml.Name{Space: carddavNamespace, Local: "addressbook-multiget"},
+		xml.Name{Space: caldavNamespace, Local: "calendar-query"},
+		xml.Name{Space: caldavNamespace, Local: "calendar-multiget"},
+		xml.Name{Space: caldavNamespace, Local: "free-busy-query"}:
+	default:
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return false
+	}
+
+	var request xmlNode
+	err = xml.Unmarshal(body, &request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	ctx := r.Context()
+	target := slashClean(r.URL.Path)
+
+	info, err := this.fs.Stat(ctx, target)
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+
+	if report.Local == "free-busy-query" {
+		this.serveFreeBusy(w, request, this.groupwareMembers(ctx, target, info))
+		return true
+	}
+
+	props := request.propNames()
+	if len(props) == 0 {
+		props = propNames{{Space: "DAV:", Local: "getetag"}}
+	}
+
+	dataName := addressDataName
+	if report.Space == caldavNamespace {
+		dataName = calendarDataName
+	}
+
+	multiget := strings.HasSuffix(report.Local, "-multiget")
+	filter, hasFilter := request.childIn(report.Space, "filter")
+
+	var members []string
+	if multiget {
+		for _, href := range request.childrenIn("DAV:", "href") {
+			parsed, err := url.Parse(strings.TrimSpace(href.Text))
+			if err == nil {
+				members = append(members, slashClean(parsed.Path))
+			}
+		}
+	} else {
+		members = this.groupwareMembers(ctx, target, info)
+	}
+
+	// only address book queries can be limited.
+	limit := 0
+	limitNode, ok := request.childIn(carddavNamespace, "limit")
+	if ok {
+		results, _ := limitNode.childIn(carddavNamespace, "nresults")
+		limit, _ = strconv.Atoi(strings.TrimSpace(results.Text))
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+
+	count := 0
+	for _, member := range members {
+
+		data, object, err := this.readGroupwareObject(ctx, member)
+		if err != nil {
+			if multiget {
+				fmt.Fprintf(w, "<D:response><D:href>%s</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response>", escapeXML(memberHref(member, false)))
+			}
+			continue
+		}
+
+		if hasFilter && !matchesGroupwareFilter(report.Space, object, filter) {
+			continue
+		}
+
+		count++
+		if limit > 0 && count > limit {
+			fmt.Fprintf(w, "<D:response><D:href>%s</D:href><D:status>HTTP/1.1 507 Insufficient Storage</D:status>" +
+				"<D:error><D:number-of-matches-within-limits/></D:error></D:response>", escapeXML(memberHref(target, info.IsDir())))
+			break
+		}
+
+		this.writeMemberProps(ctx, w, member, props, map[xml.Name]string{dataName: escapeXML(string(data))})
+	}
+	fmt.Fprint(w, "</D:multistatus>")
+	return true
+}
+
+// the contacts or events in a collection, or just the one, if that's what's asked about.
+func (this *Server) groupwareMembers(ctx context.Context, target string, info os.FileInfo) []string {
+
+	if !info.IsDir() {
+		return []string{target}
+	}
+
+	file, err := this.fs.OpenFile(ctx, target, os.O_RDONLY, 0)
+	if err != nil {
+		return nil
+	}
+	children, _ := file.Readdir(-1)
+	file.Close()
+
+	var ret []string
+	for _, child := range children {
+		if !child.IsDir() && !strings.HasSuffix(child.Name(), "~") {
+			ret = append(ret, path.Join(target, child.Name()))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// reads and parses a contact or event.
+func (this *Server) readGroupwareObject(ctx context.Context, name string) ([]byte, *vComponent, error) {
+
+	file, err := this.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, maxGroupwareObjectSize + 1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) > maxGroupwareObjectSize {
+		return nil, nil, errGroupwareObjectTooLarge
+	}
+
+	object, err := parseVObject(data)
+	return data, object, err
+}
+
+/*
+	Answers a free-busy-query with a VFREEBUSY, giving every period within the time range in which an event
+	makes someone busy. Transparent and cancelled events don't; tentative ones make them tentatively busy.
+*/
+func (this *Server) serveFreeBusy(w http.ResponseWriter, request xmlNode, members []string) {
+
+	timeRange, ok := request.childIn(caldavNamespace, "time-range")
+	if !ok {
+		http.Error(w, "A free-busy-query needs a time-range", http.StatusBadRequest)
+		return
+	}
+
+	start, end, err := parseTimeRange(timeRange)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	const format = "20060102T150405Z"
+	var busy []string
+
+	for _, member := range members {
+
+		_, object, err := this.readGroupwareObject(context.Background(), member)
+		if err != nil {
+			continue
+		}
+
+		for _, event := range object.Children {
+
+			if event.Name != "VEVENT" {
+				continue
+			}
+			transparency, _ := event.property("TRANSP")
+			status, _ := event.property("STATUS")
+			if strings.ToUpper(transparency.Value) == "TRANSPARENT" || strings.ToUpper(status.Value) == "CANCELLED" {
+				continue
+			}
+
+			kind := "BUSY"
+			if strings.ToUpper(status.Value) == "TENTATIVE" {
+				kind = "BUSY-TENTATIVE"
+			}
+
+			periods, _ := event.occurrences(start, end)
+			for _, period := range periods {
+
+				if period.start.Before(start) {
+					period.start = start
+				}
+				if period.end.After(end) {
+					period.end = end
+				}
+				if !period.end.After(period.start) {
+					continue
+				}
+				busy = append(busy, fmt.Sprintf("FREEBUSY;FBTYPE=%s:%s/%s", kind, period.start.UTC().Format(format), period.end.UTC().Format(format)))
+			}
+		}
+	}
+
+	lines := []string {
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//boji//free-busy//EN",
+		"BEGIN:VFREEBUSY",
+		"DTSTAMP:" + time.Now().UTC().Format(format),
+		"DTSTART:" + start.UTC().Format(format),
+		"DTEND:" + end.UTC().Format(format),
+	}
+	lines = append(lines, busy...)
+	lines = append(lines, "END:VFREEBUSY", "END:VCALENDAR", "")
+
+	w.Header().Set("Content-Type", groupwareContentType(calendarKind))
+	fmt.Fprint(w, strings.Join(lines, "\r\n"))
+}
+
+//
+
+// whether a contact or calendar object matches the filter of an addressbook-query or calendar-query.
+func matchesGroupwareFilter(space string, object *vComponent, filter xmlNode) bool {
+
+	if space == caldavNamespace {
+		for _, compFilter := range filter.childrenIn(caldavNamespace, "comp-filter") {
+			if !matchesCompFilter([]*vComponent{object}, compFilter) {
+				return false
+			}
+		}
+		return true
+	}
+
+	propFilters := filter.childrenIn(carddavNamespace, "prop-filter")
+	if len(propFilters) == 0 {
+		return true
+	}
+
+	allOf := filter.attr("test") == "allof"
+	for _, propFilter := range propFilters {
+		if matchesPropFilter(object, propFilter, carddavNamespace) != allOf {
+			return !allOf
+		}
+	}
+	return allOf
+}
+
+/*
+	Whether any of the given components is one the comp-filter names, and meets all of its conditions:
+	that it happens within a time range, and has the properties and sub-components it's filtered on.
+*/
+func matchesCompFilter(components []*vComponent, filter xmlNode) bool {
+
+	name := strings.ToUpper(filter.attr("name"))
+	var named []*vComponent
+	for _, component := range components {
+		if component.Name == name {
+			named = append(named, component)
+		}
+	}
+
+	_, isNotDefined := filter.childIn(caldavNamespace, "is-not-defined")
+	if isNotDefined {
+		return len(named) == 0
+	}
+
+	for _, component := range named {
+		if matchesComponent(component, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesComponent(component *vComponent, filter xmlNode) bool {
+
+	timeRange, ok := filter.childIn(caldavNamespace, "time-range")
+	if ok {
+		start, end, err := parseTimeRange(timeRange)
+		if err != nil {
+			return false
+		}
+
+		// components without any time, like undated to-dos, are in every range.
+		_, timed := component.period()
+		periods, exact := component.occurrences(start, end)
+		if timed && exact && len(periods) == 0 {
+			return false
+		}
+	}
+
+	for _, propFilter := range filter.childrenIn(caldavNamespace, "prop-filter") {
+		if !matchesPropFilter(component, propFilter, caldavNamespace) {
+			return false
+		}
+	}
+
+	for _, compFilter := range filter.childrenIn(caldavNamespace, "comp-filter") {
+		if !matchesCompFilter(component.Children, compFilter) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Whether a component has a property which meets a prop-filter's conditions.
+	CardDAV filters can ask for any or all of their conditions to be met (any, by default); CalDAV's always need all of them.
+*/
+func matchesPropFilter(component *vComponent, filter xmlNode, space string) bool {
+
+	properties := component.properties(strings.ToUpper(filter.attr("name")))
+
+	_, isNotDefined := filter.childIn(space, "is-not-defined")
+	if isNotDefined {
+		return len(properties) == 0
+	}
+
+	var conditions []func(vProperty) bool
+	for _, textMatch := range filter.childrenIn(space, "text-match") {
+		match := textMatch
+		conditions = append(conditions, func(property vProperty) bool {
+			return matchesText(property.Value, match)
+		})
+	}
+	for _, paramFilter := range filter.childrenIn(space, "param-filter") {
+		match := paramFilter
+		conditions = append(conditions, func(property vProperty) bool {
+			return matchesParamFilter(property, match, space)
+		})
+	}
+	timeRange, ok := filter.childIn(space, "time-range")
+	if ok {
+		conditions = append(conditions, func(property vProperty) bool {
+			start, end, err := parseTimeRange(timeRange)
+			at, _, timeErr := property.time()
+			return err == nil && timeErr == nil && !at.Before(start) && at.Before(end)
+		})
+	}
+
+	allOf := space == caldavNamespace || filter.attr("test") == "allof"
+
+	for _, property := range properties {
+
+		matched := allOf || len(conditions) == 0
+		for _, condition := range conditions {
+			if condition(property) != allOf {
+				matched = !allOf
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesParamFilter(property vProperty, filter xmlNode, space string) bool {
+
+	values, ok := property.Params[strings.ToUpper(filter.attr("name"))]
+
+	_, isNotDefined := filter.childIn(space, "is-not-defined")
+	if isNotDefined {
+		return !ok
+	}
+
+	textMatch, hasTextMatch := filter.childIn(space, "text-match")
+	if !hasTextMatch {
+		return ok
+	}
+
+	for _, value := range values {
+		if matchesText(value, textMatch) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Whether a value matches a text-match: containing its text (or equal to, starting or ending with it, for CardDAV),
+	ignoring case unless the collation is i;octet. negate-condition turns it around.
+*/
+func matchesText(value string, match xmlNode) bool {
+
+	text := match.Text
+	if match.attr("collation") != "i;octet" {
+		value = strings.ToLower(value)
+		text = strings.ToLower(text)
+	}
+
+	var ret bool
+	switch match.attr("match-type") {
+	case "equals": ret = value == text
+	case "starts-with": ret = strings.HasPrefix(value, text)
+	case "ends-with": ret = strings.HasSuffix(value, text)
+	default: ret = strings.Contains(value, text)
+	}
+
+	if match.attr("negate-condition") == "yes" {
+		return !ret
+	}
+	return ret
+}
+
+// the start and end of a time-range, either of which can be left out to mean forever.
+func parseTimeRange(node xmlNode) (time.Time, time.Time, error) {
+
+	start := time.Time{}
+	end := time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	for _, bound := range []struct{ value string; into *time.Time }{{node.attr("start"), &start}, {node.attr("end"), &end}} {
+
+		if bound.value == "" {
+			continue
+		}
+		parsed, _, err := parseICalTime(bound.value, time.UTC)
+		if err != nil {
+			return start, end, errors.New("Invalid time-range")
+		}
+		*bound.into = parsed
+	}
+	return start, end, nil
+}
@@ -0,0 +1,61 @@
+package boji
+
+import (
+	"os"
+	"fmt"
+	"bufio"
+	"errors"
+	"strings"
+)
+
+var errEmptyKey = errors.New("No key was given")
+
+/*
+	Reads encryption keys for the offline tools - never from their arguments, where anyone else on the machine could see them.
+	Keys are either typed at a prompt (without being shown, where that's possible),
+	or read from a file descriptor, one key to a line, for scripts.
+*/
+type KeyReader struct {
+	prompted bool
+	file *os.File
+	reader *bufio.Reader
+}
+
+// reads keys from the given file descriptor, or prompts for them on the terminal if it's negative.
+func NewKeyReader(fd int) *KeyReader {
+
+	ret := &KeyReader {
+		prompted: fd < 0,
+		file: os.Stdin,
+	}
+	if fd >= 0 {
+		ret.file = os.NewFile(uintptr(fd), "key")
+	}
+	ret.reader = bufio.NewReader(ret.file)
+	return ret
+}
+
+// reads the next key, showing [prompt] first if it's being typed.
+func (this *KeyReader) Read(prompt string) ([]byte, error) {
+
+	if this.prompted {
+		fmt.Fprint(os.Stderr, prompt)
+
+		restore, err := disableEcho(this.file.Fd())
+		if err == nil {
+			defer fmt.Fprintln(os.Stderr)
+			defer restore()
+		}
+	}
+
+	line, err := this.reader.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, errEmptyKey
+	}
+
+	key := strings.TrimRight(line, "\r\n")
+	if key == "" {
+		return nil, errEmptyKey
+	}
+	return []byte(key), nil
+}
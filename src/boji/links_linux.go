@@ -0,0 +1,45 @@
+package boji
+
+import (
+	"os"
+	"syscall"
+)
+
+// FICLONE, from linux/fs.h
+const ioctlFileClone = 0x40049409
+
+/*
+	Makes [to] a copy-on-write clone of [from], on filesystems which support it (btrfs, xfs, and others).
+	Returns an error if the filesystem doesn't, in which case [to] is left empty.
+*/
+func cloneFile(from string, to string) error {
+
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(to, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, destination.Fd(), ioctlFileClone, source.Fd())
+	closeErr := destination.Close()
+	if errno != 0 {
+		os.Remove(to)
+		return errno
+	}
+	return closeErr
+}
+
+// the inode of the file the given info came from, or 0 if it isn't known.
+func inodeOf(info os.FileInfo) uint64 {
+
+	sys, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0
+	}
+	return uint64(sys.Ino)
+}
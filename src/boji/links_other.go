@@ -0,0 +1,17 @@
+// +build !linux
+
+package boji
+
+import (
+	"os"
+	"errors"
+)
+
+// clones aren't portable, everywhere else snapshots are plain copies.
+func cloneFile(from string, to string) error {
+	return errors.New("file clones are not supported on this platform")
+}
+
+func inodeOf(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,196 @@
+package boji
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"mime"
+	"path"
+	"sync"
+	"time"
+	"bufio"
+	"strings"
+	"context"
+	"net/http"
+	"path/filepath"
+	"golang.org/x/net/webdav"
+)
+
+// a file at the top of the served tree, in the same format as /etc/mime.types, giving types for extensions.
+const mimeTypesFileName = ".boji-mimetypes"
+
+// as much as net/http ever looks at to guess a type.
+const sniffLength = 512
+
+const defaultContentType = "application/octet-stream"
+
+/*
+	Works out the content types of files, the same way for everything - by their plaintext names,
+	so encrypted files have the type of what's in them, and so do files inside archives.
+
+	Types can be given for extensions by a `.boji-mimetypes` file at the top of the served tree,
+	which is reread whenever it changes. Otherwise, the system's own types are used, and if the extension isn't
+	known at all, the start of the file is sniffed (from the start, whatever else has been reading it).
+*/
+type mimeResolver struct {
+	path string
+
+	overrides map[string]string
+	modTime time.Time
+	mutex sync.Mutex
+}
+
+func newMimeResolver(root string) *mimeResolver {
+	return &mimeResolver {
+		path: filepath.Join(root, mimeTypesFileName),
+	}
+}
+
+/*
+	The content type of a file by its name alone, or an empty string if its extension doesn't say.
+*/
+func (this *mimeResolver) byName(name string) string {
+
+	extension := strings.ToLower(path.Ext(name))
+	if extension == "" {
+		return ""
+	}
+
+	override, ok := this.lookup(extension)
+	if ok {
+		return override
+	}
+	return mime.TypeByExtension(extension)
+}
+
+/*
+	The content type of a file, by its name if that says, or else by sniffing what [open] reads.
+	Anything that can't be read is just a stream of bytes.
+*/
+func (this *mimeResolver) typeOf(name string, open func() (io.ReadCloser, error)) string {
+
+	contentType := this.byName(name)
+	if contentType != "" {
+		return contentType
+	}
+
+	reader, err := open()
+	if err != nil {
+		return defaultContentType
+	}
+	defer reader.Close()
+
+	buffer := make([]byte, sniffLength)
+	n, err := io.ReadFull(reader, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return defaultContentType
+	}
+	return http.DetectContentType(buffer[:n])
+}
+
+func (this *mimeResolver) lookup(extension string) (string, bool) {
+
+	if this == nil {
+		return "", false
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.reload()
+	contentType, ok := this.overrides[extension]
+	return contentType, ok
+}
+
+// rereads the overrides, if they've changed since they were last read. Must be called while holding the mutex.
+func (this *mimeResolver) reload() {
+
+	stat, err := os.Stat(this.path)
+	if err != nil {
+		this.overrides = nil
+		this.modTime = time.Time{}
+		return
+	}
+	if stat.ModTime().Equal(this.modTime) {
+		return
+	}
+	this.modTime = stat.ModTime()
+
+	overrides, err := readMimeTypes(this.path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read '%s': %v\n", this.path, err)
+	}
+	this.overrides = overrides
+}
+
+/*
+	Reads a mime.types file - one type to a line, followed by its extensions, with comments starting with #.
+	Extensions are returned lowercased and with a leading dot, whether or not they were given with one.
+*/
+func readMimeTypes(path string) (map[string]string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ret := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+
+		line := scanner.Text()
+		comment := strings.Index(line, "#")
+		if comment >= 0 {
+			line = line[:comment]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		for _, extension := range fields[1:] {
+			ret["." + strings.ToLower(strings.TrimPrefix(extension, "."))] = fields[0]
+		}
+	}
+	return ret, scanner.Err()
+}
+
+//
+
+/*
+	Lets webdav ask for the content type of anything it serves, rather than guessing from the name on disk
+	or sniffing from wherever the file it's been given happens to be.
+*/
+func (this servedInfo) ContentType(ctx context.Context) (string, error) {
+
+	if this.IsDir() {
+		return "", webdav.ErrNotImplemented
+	}
+	return this.fs.mimeTypes.typeOf(this.name, fsOpener(ctx, this.fs, this.name)), nil
+}
+
+// Sets the content type of the requested file (if it is one, and nothing else has already said what it is).
+func (this Server) addContentTypeHeader(w http.ResponseWriter, r *http.Request) {
+
+	if w.Header().Get("Content-Type") != "" {
+		return
+	}
+
+	info, err := this.fs.Stat(r.Context(), r.URL.Path)
+	if err != nil || info.IsDir() {
+		return
+	}
+
+	typer, ok := info.(webdav.ContentTyper)
+	if !ok {
+		return
+	}
+
+	contentType, err := typer.ContentType(r.Context())
+	if err == nil {
+		w.Header().Set("Content-Type", contentType)
+	}
+}
@@ -0,0 +1,45 @@
+package boji
+
+import (
+	"time"
+	"strconv"
+	"strings"
+	"net/http"
+	"encoding/xml"
+)
+
+// the property windows clients PROPPATCH after an upload, to set the file's original modification time.
+var win32LastModifiedTime = xml.Name{Space: "urn:schemas-microsoft-com:", Local: "Win32LastModifiedTime"}
+
+/*
+	Implemented by files which can have their modification time set by a client.
+	The time is applied when the file is closed, so that it isn't immediately clobbered by whatever is being written.
+*/
+type modTimeSetter interface {
+	SetModTime(time.Time) error
+}
+
+/*
+	Parses the ownCloud-style `X-OC-Mtime` header, which is unix seconds (possibly fractional).
+	Returns a zero time if the header isn't present.
+*/
+func parseOCMtime(r *http.Request) (time.Time, error) {
+
+	header := strings.TrimSpace(r.Header.Get("X-OC-Mtime"))
+	if header == "" {
+		return time.Time{}, nil
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	whole := int64(seconds)
+	return time.Unix(whole, int64((seconds - float64(whole)) * float64(time.Second))), nil
+}
+
+// Parses the value of a Win32LastModifiedTime property, which is an http date.
+func parseWin32Time(innerXML []byte) (time.Time, error) {
+	return http.ParseTime(strings.TrimSpace(string(innerXML)))
+}
@@ -0,0 +1,103 @@
+package boji
+
+import (
+	"sync"
+	"unsafe"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ATTRIB | syscall.IN_ONLYDIR
+
+/*
+	Tells the watcher which directories have had something change in them, using inotify.
+	Each directory needs a watch of its own, and the kernel limits how many there can be.
+*/
+type dirNotifier struct {
+	fd int
+	dirs map[int32]string
+	changed func(string)
+	overflowed func()
+	mutex sync.Mutex
+}
+
+func newDirNotifier(changed func(string), overflowed func()) (*dirNotifier, error) {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &dirNotifier {
+		fd: fd,
+		dirs: make(map[int32]string),
+		changed: changed,
+		overflowed: overflowed,
+	}
+
+	go ret.read()
+	return ret, nil
+}
+
+// watches the directory at [path], which is served as [dir].
+func (this *dirNotifier) add(dir string, path string) error {
+
+	wd, err := syscall.InotifyAddWatch(this.fd, path, inotifyMask)
+	if err != nil {
+		return err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.dirs[int32(wd)] = dir
+	return nil
+}
+
+func (this *dirNotifier) Close() {
+
+	if this == nil {
+		return
+	}
+	syscall.Close(this.fd)
+}
+
+func (this *dirNotifier) read() {
+
+	buffer := make([]byte, 64 * 1024)
+	for {
+		count, err := syscall.Read(this.fd, buffer)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || count <= 0 {
+			return
+		}
+
+		for offset := 0; offset + syscall.SizeofInotifyEvent <= count; {
+
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			switch {
+			case event.Mask & syscall.IN_Q_OVERFLOW != 0:
+				this.overflowed()
+				continue
+
+			// new files are only interesting once they're written and closed, but new directories need watching straight away.
+			case event.Mask & syscall.IN_CREATE != 0 && event.Mask & syscall.IN_ISDIR == 0:
+				continue
+			}
+
+			this.mutex.Lock()
+			dir, ok := this.dirs[event.Wd]
+			if event.Mask & syscall.IN_IGNORED != 0 {
+				delete(this.dirs, event.Wd)
+			}
+			this.mutex.Unlock()
+
+			if ok {
+				this.changed(dir)
+			}
+		}
+	}
+}
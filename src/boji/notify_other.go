@@ -0,0 +1,21 @@
+// +build !linux
+
+package boji
+
+import (
+	"errors"
+)
+
+// inotify is linux-only; everywhere else, changes on disk are found by scanning.
+type dirNotifier struct {}
+
+func newDirNotifier(changed func(string), overflowed func()) (*dirNotifier, error) {
+	return nil, errors.New("watching directories is not supported on this platform")
+}
+
+func (this *dirNotifier) add(dir string, path string) error {
+	return errors.New("watching directories is not supported on this platform")
+}
+
+func (this *dirNotifier) Close() {
+}
@@ -0,0 +1,286 @@
+package boji
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"bytes"
+	"strings"
+	"io/ioutil"
+	"crypto/sha256"
+	"archive/zip"
+	"path/filepath"
+	"golang.org/x/crypto/openpgp"
+)
+
+/*
+	Encrypts a file in place, or every file in a directory (and its subdirectories, if [recursive]).
+
+	This, and the rest of the jobs here, are what `POST ?encrypt=`, `?compress=` and so on do, for when boji isn't running -
+	on a served tree while the server is stopped, or on files copied somewhere else entirely.
+	None of them should be used on a tree that's being served, since the server won't know what they've changed.
+*/
+func Encrypt(path string, key []byte, recursive bool) error {
+	return eachPath(path, key, recursive, encryptFile, encryptDir)
+}
+
+/*
+	Decrypts a file in place, or every encrypted file in a directory (and its subdirectories, if [recursive]).
+	Encrypted files can be given by either their name on disk, or the plaintext name they're served as.
+*/
+func Decrypt(path string, key []byte, recursive bool) error {
+
+	if !strings.HasSuffix(path, encryptedExtension) && existsOnDisk(path + encryptedExtension) {
+		path += encryptedExtension
+	}
+	return eachPath(path, key, recursive, decryptFile, decryptDir)
+}
+
+func eachPath(path string, key []byte, recursive bool, fileFunc singleWalkFunc, dirFunc func(string, []byte, bool) error) error {
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return dirFunc(path, key, recursive)
+	}
+	return fileFunc(path, key)
+}
+
+/*
+	Compresses a directory into an archive. If the directory is within [root], any properties its files have are kept
+	in the state dir, where the server will find them.
+*/
+func Compress(root string, stateDir string, dir string) error {
+
+	var props *propertyStore
+	if root != "" && isWithin(root, dir) {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		props = newPropertyStore(absRoot, stateDir)
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	return archiveDir(dir, props)
+}
+
+// Extracts a compressed directory's archive.
+func Uncompress(dir string) error {
+	return unarchiveDir(dir)
+}
+
+//
+
+/*
+	Checks that everything beneath [path] can still be read as it was written:
+		every member of every archive against its CRC,
+		every encrypted file against its own integrity check (only if a key is given - otherwise they're skipped),
+		and every other file against the digest boji last cached for it in [stateDir], if any, which catches files
+		whose content has changed without their size or modification time changing - usually, a failing disk.
+	[report] is called with each problem found. Returns how many files were checked, and how many had problems.
+*/
+func Verify(root string, stateDir string, path string, key []byte, report func(path string, err error)) (int, int, error) {
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var digests *digestCache
+	if root != "" && isWithin(root, path) {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return 0, 0, err
+		}
+		digests = newDigestCache(absRoot, stateDir)
+	}
+
+	checked := 0
+	failed := 0
+
+	err = filepath.Walk(path, func(walkedPath string, info os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		switch {
+		case info.Name() == "archive.zip":
+			err = verifyArchive(walkedPath)
+		case strings.HasSuffix(walkedPath, encryptedExtension):
+			if len(key) == 0 {
+				return nil
+			}
+			err = verifyEncrypted(walkedPath, key)
+		default:
+			err = verifyDigest(digests, walkedPath, info)
+		}
+
+		checked++
+		if err != nil {
+			failed++
+			report(walkedPath, err)
+		}
+		return nil
+	})
+	return checked, failed, err
+}
+
+func verifyArchive(path string) error {
+
+	zreader, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zreader.Close()
+
+	// the CRC of each member is checked once it's been read to the end.
+	for _, zfile := range zreader.File {
+
+		member, err := zfile.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %v", zfile.Name, err)
+		}
+		_, err = io.Copy(ioutil.Discard, member)
+		member.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", zfile.Name, err)
+		}
+	}
+	return nil
+}
+
+func verifyEncrypted(path string, key []byte) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	message, err := openpgp.ReadMessage(file, defaultEmptyKeyring, newNoPromptKey(key).prompt, nil)
+	if err != nil {
+		return err
+	}
+
+	// as with archives, the integrity check is only made at the end.
+	_, err = io.Copy(ioutil.Discard, message.UnverifiedBody)
+	return err
+}
+
+func verifyDigest(digests *digestCache, path string, info os.FileInfo) error {
+
+	if digests == nil {
+		return nil
+	}
+
+	stamp, err := digests.stampOf(path, info)
+	if err != nil {
+		return err
+	}
+	expected := digests.cached(path, stamp)
+	if expected == nil {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(hasher.Sum(nil), expected) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+//
+
+/*
+	Re-encrypts every encrypted file beneath [path] (or just [path], if it's a file) with a new key.
+	Each file is rewritten beside itself and then moved into place, so one that fails partway is left as it was.
+	Stops at the first file that can't be decrypted with [oldKey].
+*/
+func ChangeKey(path string, oldKey []byte, newKey []byte) error {
+
+	return filepath.Walk(path, func(walkedPath string, info os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(walkedPath, encryptedExtension) {
+			return nil
+		}
+
+		err = reencryptFile(walkedPath, info, oldKey, newKey)
+		if err != nil {
+			return fmt.Errorf("%s: %v", walkedPath, err)
+		}
+		return nil
+	})
+}
+
+func reencryptFile(path string, info os.FileInfo, oldKey []byte, newKey []byte) error {
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	message, err := openpgp.ReadMessage(src, defaultEmptyKeyring, newNoPromptKey(oldKey).prompt, nil)
+	if err != nil {
+		return err
+	}
+
+	tempPath := path + "~"
+	dst, err := os.OpenFile(tempPath, os.O_CREATE | os.O_EXCL | os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	err = copyEncrypted(dst, message.UnverifiedBody, newKey)
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	copyPropertiesXattr(path, tempPath)
+	os.Chtimes(tempPath, info.ModTime(), info.ModTime())
+	return os.Rename(tempPath, path)
+}
+
+func copyEncrypted(dst io.Writer, plaintext io.Reader, key []byte) error {
+
+	encrypted, err := defaultEncryptor(dst, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(encrypted, plaintext)
+	if err != nil {
+		encrypted.Close()
+		return err
+	}
+	return encrypted.Close()
+}
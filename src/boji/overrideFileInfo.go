@@ -5,10 +5,11 @@ import (
 	"os"
 )
 
-// FileInfo wrapper that overrides wrapped values for size or name, depending on what was given during construction.
+// FileInfo wrapper that overrides wrapped values for size, name, or modification time, depending on what was given during construction.
 type overrideFileInfo struct {
 	FixedSize int64
 	FixedName string
+	FixedModTime time.Time
 	wrapped os.FileInfo
 }
 
@@ -31,11 +32,25 @@ func (this overrideFileInfo) Mode() os.FileMode {
 	return this.wrapped.Mode()
 }
 func (this overrideFileInfo) ModTime() time.Time {
-	return this.wrapped.ModTime()
+	if this.FixedModTime.IsZero() {
+		return this.wrapped.ModTime()
+	}
+	return this.FixedModTime
 }
 func (this overrideFileInfo) IsDir() bool {
 	return this.wrapped.IsDir()
 }
 func (this overrideFileInfo) Sys() interface{} {
 	return this.wrapped.Sys()
+}
+
+// returns the given info, but with the given modification time (unless that time is zero).
+func withModTime(info os.FileInfo, modTime time.Time) os.FileInfo {
+	if modTime.IsZero() {
+		return info
+	}
+	return overrideFileInfo {
+		FixedModTime: modTime,
+		wrapped: info,
+	}
 }
\ No newline at end of file
@@ -0,0 +1,328 @@
+package boji
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"errors"
+	"strings"
+	"strconv"
+	"context"
+	"net/http"
+	"io/ioutil"
+)
+
+var errInvalidRange = errors.New("Invalid range")
+
+// a byte range to be overwritten. [end] is inclusive. A negative [start] means "the last -start bytes".
+type updateRange struct {
+	start int64
+	end int64
+	appending bool
+}
+
+/*
+	Handles partial updates of existing files, returning true if this was one.
+	Two forms are understood:
+		`PUT` with a `Content-Range: bytes <start>-<end>/<total>` header (as Apache does)
+		`PATCH` with `Content-Type: application/x-sabredav-partialupdate` and `X-Update-Range: bytes=<start>-<end>` (as SabreDAV does),
+		where the range may also be `bytes=-<n>` (the last n bytes) or `append`.
+
+	Regular files are written in place. Compressed and encrypted files can't be, so they're staged,
+	patched, and rewritten through the filesystem - which recompresses/re-encrypts them as usual.
+*/
+func (this *Server) attemptPartialUpdate(w http.ResponseWriter, r *http.Request) bool {
+
+	var header string
+
+	switch {
+	case r.Method == "PUT" && r.Header.Get("Content-Range") != "":
+		header = r.Header.Get("Content-Range")
+	case r.Method == "PATCH" && r.Header.Get("Content-Type") == "application/x-sabredav-partialupdate":
+		header = r.Header.Get("X-Update-Range")
+	default:
+		return false
+	}
+
+	update, err := parseUpdateRange(header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	name := slashClean(r.URL.Path)
+	release, err := this.locks.claimForWrite(name, r.Header.Get("If"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return true
+	}
+	defer release()
+
+	// a body without a length is spooled first, so that it's measured against the quota before anything is changed.
+	var body io.Reader = r.Body
+	length := r.ContentLength
+	allowance, limited := this.quotas.allowance(name, false)
+
+	if length < 0 && limited {
+		spooled, err := spoolBody(this.Settings.StagingDir, r.Body, allowance)
+		if err == errQuotaExceeded {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return true
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+
+		body = spooled
+		length, _ = spooled.Seek(0, io.SeekEnd)
+		spooled.Seek(0, io.SeekStart)
+	}
+
+	err = this.quotas.check(name, length, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return true
+	}
+
+	ctx := r.Context()
+	path := this.fs.resolve(name)
+
+	this.fs.changes.startWriting(name)
+	defer this.fs.changes.finishWriting(name)
+	tracked := this.quotas.track(name)
+
+	// it's the kind of file that decides, not whether there's a key - a key doesn't make a plain file encrypted.
+	if this.fs.isPlainFile(name) {
+		_, err = this.versions.capture(ctx, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		err = patchInPlace(path, update, body, length)
+	} else {
+		err = this.patchRewrite(ctx, name, update, body, length)
+	}
+	this.fs.digests.invalidate(path)
+	tracked()
+
+	switch {
+	case err == nil:
+		this.fs.changes.publish("modify", name, "", false)
+		w.WriteHeader(http.StatusNoContent)
+	case os.IsNotExist(err):
+		http.Error(w, "File does not exist", http.StatusNotFound)
+	case err == errInvalidRange:
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+	case err == errQuotaExceeded:
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+	return true
+}
+
+func patchInPlace(path string, update updateRange, body io.Reader, length int64) error {
+
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = applyUpdate(file, stat.Size(), update, body, length)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+/*
+	Reads the whole plaintext of a compressed or encrypted file into the staging dir, patches that, then writes it back.
+*/
+func (this *Server) patchRewrite(ctx context.Context, name string, update updateRange, body io.Reader, length int64) error {
+
+	source, err := this.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(this.Settings.StagingDir, 0700)
+	if err != nil {
+		source.Close()
+		return err
+	}
+
+	staged, err := ioutil.TempFile(this.Settings.StagingDir, "patch-")
+	if err != nil {
+		source.Close()
+		return err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+
+	size, err := io.Copy(staged, source)
+	source.Close()
+	if err != nil {
+		return err
+	}
+
+	err = applyUpdate(staged, size, update, body, length)
+	if err != nil {
+		return err
+	}
+
+	_, err = staged.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	destination, err := this.fs.OpenFile(ctx, name, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destination, staged)
+	closeErr := destination.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+/*
+	Copies [body] into a file in the staging dir, giving up once it's more than [limit] bytes.
+*/
+func spoolBody(stagingDir string, body io.Reader, limit int64) (*os.File, error) {
+
+	err := os.MkdirAll(stagingDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	spooled, err := ioutil.TempFile(stagingDir, "body-")
+	if err != nil {
+		return nil, err
+	}
+
+	written, err := io.Copy(spooled, io.LimitReader(body, limit + 1))
+	if err == nil && written > limit {
+		err = errQuotaExceeded
+	}
+	if err != nil {
+		spooled.Close()
+		os.Remove(spooled.Name())
+		return nil, err
+	}
+	return spooled, nil
+}
+
+// writes [body] into [file] (currently [size] bytes long) at the given range.
+func applyUpdate(file *os.File, size int64, update updateRange, body io.Reader, length int64) error {
+
+	start := update.start
+	switch {
+	case update.appending:
+		start = size
+	case start < 0:
+		start = size + start
+		if start < 0 {
+			return errInvalidRange
+		}
+	}
+
+	// without an explicit end, the body decides how much is written.
+	expected := int64(-1)
+	if !update.appending && update.end >= 0 {
+		expected = update.end - start + 1
+	}
+	if update.start < 0 {
+		expected = -update.start
+	}
+	if expected < 0 {
+		expected = length
+	}
+
+	if start > size {
+		return errInvalidRange
+	}
+
+	_, err := file.Seek(start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if expected < 0 {
+		_, err = io.Copy(file, body)
+		return err
+	}
+
+	written, err := io.CopyN(file, body, expected)
+	if err == io.EOF || written != expected {
+		return fmt.Errorf("Expected %d bytes for the range, but got %d", expected, written)
+	}
+	return err
+}
+
+/*
+	Parses either a `Content-Range: bytes 0-99/1000` or an `X-Update-Range: bytes=0-99` value.
+*/
+func parseUpdateRange(header string) (updateRange, error) {
+
+	header = strings.TrimSpace(header)
+	if header == "append" {
+		return updateRange{appending: true}, nil
+	}
+
+	var spec string
+	switch {
+	case strings.HasPrefix(header, "bytes="):
+		spec = strings.TrimPrefix(header, "bytes=")
+	case strings.HasPrefix(header, "bytes "):
+		spec = strings.TrimPrefix(header, "bytes ")
+
+		// the total length isn't needed, the range is enough.
+		idx := strings.IndexByte(spec, '/')
+		if idx >= 0 {
+			spec = spec[:idx]
+		}
+	default:
+		return updateRange{}, errInvalidRange
+	}
+
+	idx := strings.IndexByte(spec, '-')
+	if idx < 0 {
+		return updateRange{}, errInvalidRange
+	}
+
+	// "-n" means the last n bytes.
+	if idx == 0 {
+		count, err := strconv.ParseInt(spec[1:], 10, 64)
+		if err != nil || count <= 0 {
+			return updateRange{}, errInvalidRange
+		}
+		return updateRange{start: -count, end: -1}, nil
+	}
+
+	start, err := strconv.ParseInt(spec[:idx], 10, 64)
+	if err != nil || start < 0 {
+		return updateRange{}, errInvalidRange
+	}
+
+	end := int64(-1)
+	if spec[idx+1:] != "" {
+		end, err = strconv.ParseInt(spec[idx+1:], 10, 64)
+		if err != nil || end < start {
+			return updateRange{}, errInvalidRange
+		}
+	}
+
+	return updateRange{start: start, end: end}, nil
+}
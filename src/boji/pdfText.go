@@ -0,0 +1,291 @@
+package boji
+
+import (
+	"io"
+	"bytes"
+	"io/ioutil"
+	"compress/zlib"
+)
+
+/*
+	Pulls what text it can out of a PDF, for indexing - the strings shown by every content stream, in order.
+	This is best-effort: it doesn't follow fonts' encodings, so text in fonts with their own glyph numbering
+	(common for non-Latin scripts) comes out as nothing useful, and is skipped where it can be recognised.
+*/
+func extractPDFText(data []byte) []byte {
+
+	var out bytes.Buffer
+
+	for offset := 0; ; {
+
+		start := bytes.Index(data[offset:], []byte("stream"))
+		if start < 0 {
+			break
+		}
+		start += offset
+		offset = start + len("stream")
+
+		// "endstream" has "stream" in it too, and a stream keyword is only ever followed by a newline.
+		if start >= 3 && string(data[start-3:start]) == "end" {
+			continue
+		}
+		body := offset
+		if bytes.HasPrefix(data[body:], []byte("\r\n")) {
+			body += 2
+		} else if bytes.HasPrefix(data[body:], []byte("\n")) {
+			body++
+		} else {
+			continue
+		}
+
+		end := bytes.Index(data[body:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		end += body
+		offset = end
+
+		// the stream's dictionary is somewhere between the start of its object and the stream.
+		dictStart := bytes.LastIndex(data[:start], []byte("obj"))
+		if dictStart < 0 {
+			dictStart = 0
+		}
+
+		content, ok := decodePDFStream(data[dictStart:start], data[body:end])
+		if ok {
+			extractPDFContent(content, &out)
+		}
+	}
+	return out.Bytes()
+}
+
+// the decoded content of a stream, if it's one that could have text in it, with a filter that can be undone.
+func decodePDFStream(dict []byte, raw []byte) ([]byte, bool) {
+
+	compact := bytes.Join(bytes.Fields(dict), nil)
+	if bytes.Contains(compact, []byte("/Subtype/Image")) {
+		return nil, false
+	}
+
+	if !bytes.Contains(compact, []byte("/Filter")) {
+		return raw, true
+	}
+
+	// anything other than plain deflate is an image, or rare enough not to bother with.
+	filters := bytes.Count(compact, []byte("Decode"))
+	if filters != 1 || !bytes.Contains(compact, []byte("/FlateDecode")) || bytes.Contains(compact, []byte("/DecodeParms")) {
+		return nil, false
+	}
+
+	reader, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	defer reader.Close()
+
+	// a truncated stream still has text in it up to where it stops.
+	decoded, _ := ioutil.ReadAll(io.LimitReader(reader, fullTextMaxBytes))
+	return decoded, len(decoded) > 0
+}
+
+/*
+	Writes the text shown by a content stream's Tj, TJ, ' and " operators, with a space wherever it moves to somewhere new.
+	Within a TJ array, only a large enough gap between strings is taken to be a space between words.
+*/
+func extractPDFContent(content []byte, out *bytes.Buffer) {
+
+	var operands [][]byte
+	inText := false
+	inArray := false
+
+	for i := 0; i < len(content); {
+
+		c := content[i]
+		switch {
+		case c == '(':
+			text, next := readPDFLiteral(content, i)
+			operands = append(operands, text)
+			i = next
+
+		case c == '<' && i + 1 < len(content) && content[i+1] != '<':
+			text, next := readPDFHex(content, i)
+			operands = append(operands, text)
+			i = next
+
+		case c == '[':
+			inArray = true
+			i++
+
+		case c == ']':
+			inArray = false
+			i++
+
+		case c == '/':
+			// a name, like a font's; nothing to show.
+			for i++; i < len(content) && !isPDFDelimiter(content[i]); i++ {
+			}
+
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+
+		case (c >= '0' && c <= '9') || c == '-' || c == '.':
+			start := i
+			for i < len(content) && ((content[i] >= '0' && content[i] <= '9') || content[i] == '-' || content[i] == '.') {
+				i++
+			}
+			if inArray && isPDFWordGap(content[start:i]) {
+				operands = append(operands, []byte(" "))
+			}
+
+		case isPDFOperatorByte(c):
+			start := i
+			for i < len(content) && isPDFOperatorByte(content[i]) {
+				i++
+			}
+
+			switch string(content[start:i]) {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+				out.WriteByte(' ')
+			case "Tj", "TJ", "'", "\"":
+				if inText {
+					for _, text := range operands {
+						writePDFString(text, out)
+					}
+				}
+			case "Td", "TD", "T*", "Tm":
+				out.WriteByte(' ')
+			}
+			if !inArray {
+				operands = operands[:0]
+			}
+
+		default:
+			i++
+		}
+	}
+}
+
+func isPDFDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte(" \t\r\n\f\x00()<>[]{}/%"), c) >= 0
+}
+
+func isPDFOperatorByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '*' || c == '\'' || c == '"'
+}
+
+// TJ offsets are in thousandths of the font size; anything more than about a quarter of it is a space.
+func isPDFWordGap(number []byte) bool {
+
+	if len(number) < 4 || number[0] != '-' {
+		return false
+	}
+	digits := bytes.IndexByte(number, '.')
+	if digits < 0 {
+		digits = len(number)
+	}
+	return digits > 3 && (digits > 4 || number[1] >= '2')
+}
+
+// reads a (literal string), which can have balanced parentheses and escapes in it. Returns the string and where it ends.
+func readPDFLiteral(content []byte, i int) ([]byte, int) {
+
+	var ret []byte
+	depth := 0
+
+	for i++; i < len(content); i++ {
+
+		c := content[i]
+		switch {
+		case c == '\\' && i + 1 < len(content):
+			i++
+			switch e := content[i]; e {
+			case 'n': ret = append(ret, '\n')
+			case 'r': ret = append(ret, '\r')
+			case 't': ret = append(ret, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// a line continuation.
+			default:
+				if e >= '0' && e <= '7' {
+					value := 0
+					for n := 0; n < 3 && i < len(content) && content[i] >= '0' && content[i] <= '7'; n++ {
+						value = value * 8 + int(content[i] - '0')
+						i++
+					}
+					i--
+					ret = append(ret, byte(value))
+				} else {
+					ret = append(ret, e)
+				}
+			}
+		case c == '(':
+			depth++
+			ret = append(ret, c)
+		case c == ')':
+			if depth == 0 {
+				return ret, i + 1
+			}
+			depth--
+			ret = append(ret, c)
+		default:
+			ret = append(ret, c)
+		}
+	}
+	return ret, i
+}
+
+// reads a <hex string>. Returns the string and where it ends.
+func readPDFHex(content []byte, i int) ([]byte, int) {
+
+	var ret []byte
+	var digits []byte
+
+	for i++; i < len(content) && content[i] != '>'; i++ {
+		value := hexValue(content[i])
+		if value >= 0 {
+			digits = append(digits, byte(value))
+		}
+	}
+	if len(digits) % 2 == 1 {
+		digits = append(digits, 0)
+	}
+	for n := 0; n < len(digits); n += 2 {
+		ret = append(ret, digits[n] << 4 | digits[n+1])
+	}
+	return ret, i + 1
+}
+
+func hexValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9': return int(c - '0')
+	case c >= 'a' && c <= 'f': return int(c - 'a' + 10)
+	case c >= 'A' && c <= 'F': return int(c - 'A' + 10)
+	}
+	return -1
+}
+
+/*
+	Writes a string as text, taking each byte as Latin-1 - close enough to the standard PDF encodings for indexing.
+	Strings that are mostly control characters are glyph numbers rather than text, and are left out.
+*/
+func writePDFString(text []byte, out *bytes.Buffer) {
+
+	control := 0
+	for _, c := range text {
+		if c < 0x20 && c != '\n' && c != '\r' && c != '\t' {
+			control++
+		}
+	}
+	if control * 2 > len(text) {
+		return
+	}
+
+	for _, c := range text {
+		out.WriteRune(rune(c))
+	}
+}
@@ -0,0 +1,497 @@
+package boji
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"bufio"
+	"sync"
+	"time"
+	"strings"
+	"net/http"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"golang.org/x/net/webdav"
+)
+
+/*
+	A webdav.LockSystem that journals every lock to a single file, so that locks held by clients
+	(Office, LibreOffice, Finder) survive a restart.
+	The actual conflict checking is delegated to the in-memory lock system. Since a restored lock is necessarily
+	recreated in that system under a new internal token, the tokens handed to clients are our own, and are translated.
+*/
+type persistentLS struct {
+	path string
+	inner webdav.LockSystem
+	locks map[string]*persistedLock
+
+	journal *os.File
+	records int // entries in the journal, whether their locks are still live or not.
+	mutex sync.Mutex
+	stats *telemetryStats
+}
+
+// a single journal line. Also used as the in-memory record of a live lock.
+type persistedLock struct {
+	Op string `json:"op,omitempty"`
+	Token string `json:"token"`
+	Root string `json:"root,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	ZeroDepth bool `json:"zeroDepth,omitempty"`
+	Expires time.Time `json:"expires"` // zero means it never expires.
+
+	innerToken string
+	ephemeral bool
+}
+
+// the journal is never compacted while it's smaller than this, however much of it is dead.
+const lockJournalMinimumRecords = 256
+
+const (
+	lockOpCreate = "create"
+	lockOpRefresh = "refresh"
+	lockOpUnlock = "unlock"
+)
+
+/*
+	Opens (or creates) the lock journal at the given path, restoring any locks which haven't yet expired.
+	The journal is compacted on open, and again whenever most of what's in it is for locks that are gone.
+*/
+func newPersistentLS(path string, stats *telemetryStats) (*persistentLS, error) {
+
+	ret := &persistentLS {
+		path: path,
+		inner: webdav.NewMemLS(),
+		locks: make(map[string]*persistedLock),
+		stats: stats,
+	}
+
+	err := ret.replay()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ret.rewrite()
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (this *persistentLS) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+
+	this.mutex.Lock()
+	translated := make([]webdav.Condition, len(conditions))
+	for i, condition := range conditions {
+
+		translated[i] = condition
+		if condition.Token == "" {
+			continue
+		}
+
+		// unknown tokens must never match an internal one by accident.
+		lock, ok := this.locks[condition.Token]
+		if ok {
+			translated[i].Token = lock.innerToken
+		} else {
+			translated[i].Token = "unknown:" + condition.Token
+		}
+	}
+	this.mutex.Unlock()
+
+	return this.inner.Confirm(now, name0, name1, translated...)
+}
+
+func (this *persistentLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return this.create(now, details, false)
+}
+
+/*
+	Creates a lock, which is journaled unless it's [ephemeral] - taken by boji or the webdav handler just for
+	the length of a single request, rather than asked for by a client, so that it'll never outlive the request.
+*/
+func (this *persistentLS) create(now time.Time, details webdav.LockDetails, ephemeral bool) (string, error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	innerToken, err := this.inner.Create(now, details)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := newLockToken()
+	if err != nil {
+		this.inner.Unlock(now, innerToken)
+		return "", err
+	}
+
+	lock := &persistedLock {
+		Token: token,
+		Root: details.Root,
+		Owner: details.OwnerXML,
+		ZeroDepth: details.ZeroDepth,
+		Expires: lockExpiry(now, details.Duration),
+		innerToken: innerToken,
+		ephemeral: ephemeral,
+	}
+
+	// added before it's journaled, so that it survives if journaling it compacts the journal.
+	this.prune(now)
+	this.locks[token] = lock
+
+	if !ephemeral {
+		err = this.record(lockOpCreate, *lock)
+		if err != nil {
+			delete(this.locks, token)
+			this.inner.Unlock(now, innerToken)
+			return "", err
+		}
+		this.stats.locksCreated++
+	}
+	return token, nil
+}
+
+func (this *persistentLS) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	lock, ok := this.locks[token]
+	if !ok {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+
+	details, err := this.inner.Refresh(now, lock.innerToken, duration)
+	if err != nil {
+		return details, err
+	}
+
+	lock.Expires = lockExpiry(now, details.Duration)
+	return details, this.record(lockOpRefresh, *lock)
+}
+
+func (this *persistentLS) Unlock(now time.Time, token string) error {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	lock, ok := this.locks[token]
+	if !ok {
+		return webdav.ErrNoSuchLock
+	}
+
+	err := this.inner.Unlock(now, lock.innerToken)
+	if err != nil && err != webdav.ErrNoSuchLock {
+		return err
+	}
+
+	delete(this.locks, token)
+	if lock.ephemeral {
+		return err
+	}
+	this.stats.locksReleased++
+
+	recordErr := this.record(lockOpUnlock, persistedLock{Token: token})
+	if err != nil {
+		return err
+	}
+	return recordErr
+}
+
+/*
+	Claims [name] for a write made outside of the webdav handler, the same way that handler would.
+	If the request gave lock tokens in its If header, one of them must cover the resource;
+	otherwise a temporary lock is taken, which only succeeds if no other client holds one.
+	The returned func releases the claim.
+*/
+func (this *persistentLS) claimForWrite(name string, ifHeader string) (func(), error) {
+	return this.claim(name, ifHeader, true)
+}
+
+// as claimForWrite, but for everything beneath [name] too - for when a whole directory is replaced at once.
+func (this *persistentLS) claimTreeForWrite(name string, ifHeader string) (func(), error) {
+	return this.claim(name, ifHeader, false)
+}
+
+func (this *persistentLS) claim(name string, ifHeader string, zeroDepth bool) (func(), error) {
+
+	now := time.Now()
+	tokens := ifHeaderTokens(ifHeader)
+
+	if len(tokens) > 0 {
+		conditions := make([]webdav.Condition, len(tokens))
+		for i, token := range tokens {
+			conditions[i] = webdav.Condition{Token: token}
+		}
+		return this.Confirm(now, name, "", conditions...)
+	}
+
+	token, err := this.create(now, webdav.LockDetails {
+		Root: name,
+		Duration: -1,
+		ZeroDepth: zeroDepth,
+	}, true)
+	if err != nil {
+		return nil, webdav.ErrLocked
+	}
+	return func() { this.Unlock(now, token) }, nil
+}
+
+/*
+	The lock system as the webdav handler sees it while serving the given request.
+	Only a LOCK asks for a lock that should outlive the request - any other lock the handler creates is the one it holds
+	for the length of a write that didn't provide a lock of its own, so it's created as ephemeral.
+*/
+func (this *persistentLS) forRequest(r *http.Request) webdav.LockSystem {
+
+	if r.Method == "LOCK" {
+		return this
+	}
+	return requestLS{this}
+}
+
+type requestLS struct {
+	*persistentLS
+}
+
+func (this requestLS) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	return this.persistentLS.create(now, details, true)
+}
+
+func (this *persistentLS) Close() error {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.journal == nil {
+		return nil
+	}
+	return this.journal.Close()
+}
+
+//
+
+// reads every journal entry, and recreates any locks that are still live.
+func (this *persistentLS) replay() error {
+
+	fd, err := os.Open(this.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	entries := make(map[string]persistedLock)
+	decoder := json.NewDecoder(bufio.NewReader(fd))
+
+	for {
+		var entry persistedLock
+
+		err = decoder.Decode(&entry)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a torn final write shouldn't cost us every other lock.
+			fmt.Fprintf(os.Stderr, "Lock journal '%s' is truncated, ignoring remainder: %v\n", this.path, err)
+			break
+		}
+
+		switch entry.Op {
+		case lockOpCreate:
+			entries[entry.Token] = entry
+		case lockOpRefresh:
+			existing, ok := entries[entry.Token]
+			if ok {
+				existing.Expires = entry.Expires
+				entries[entry.Token] = existing
+			}
+		case lockOpUnlock:
+			delete(entries, entry.Token)
+		}
+	}
+
+	now := time.Now()
+	for token, entry := range entries {
+
+		if !entry.Expires.IsZero() && !entry.Expires.After(now) {
+			continue
+		}
+
+		duration := time.Duration(-1)
+		if !entry.Expires.IsZero() {
+			duration = entry.Expires.Sub(now)
+		}
+
+		innerToken, err := this.inner.Create(now, webdav.LockDetails {
+			Root: entry.Root,
+			Duration: duration,
+			OwnerXML: entry.Owner,
+			ZeroDepth: entry.ZeroDepth,
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to restore lock on '%s': %v\n", entry.Root, err)
+			continue
+		}
+
+		restored := entry
+		restored.Op = ""
+		restored.innerToken = innerToken
+		this.locks[token] = &restored
+	}
+
+	return nil
+}
+
+// drops expired locks, and rewrites the journal so that it contains only the ones that are left.
+func (this *persistentLS) compact() error {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.prune(time.Now())
+	return this.rewrite()
+}
+
+// rewrites the journal so that it contains only live locks, then leaves it open for appending. Caller must hold the mutex.
+func (this *persistentLS) rewrite() error {
+
+	tempPath := this.path + "~"
+	fd, err := os.OpenFile(tempPath, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	records := 0
+	encoder := json.NewEncoder(fd)
+	for _, lock := range this.locks {
+
+		if lock.ephemeral {
+			continue
+		}
+
+		entry := *lock
+		entry.Op = lockOpCreate
+
+		err = encoder.Encode(entry)
+		if err != nil {
+			fd.Close()
+			return err
+		}
+		records++
+	}
+
+	err = fd.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempPath, this.path)
+	if err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(this.path, os.O_APPEND | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if this.journal != nil {
+		this.journal.Close()
+	}
+	this.journal = journal
+	this.records = records
+	return nil
+}
+
+// appends a single entry to the journal. Caller must hold the mutex.
+func (this *persistentLS) record(op string, lock persistedLock) error {
+
+	lock.Op = op
+	encoded, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	_, err = this.journal.Write(append(encoded, '\n'))
+	if err != nil {
+		return err
+	}
+	this.records++
+
+	err = this.journal.Sync()
+	if err != nil {
+		return err
+	}
+
+	// every refresh and unlock is appended, so a long-running server would otherwise grow the journal forever.
+	live := 0
+	for _, lock := range this.locks {
+		if !lock.ephemeral {
+			live++
+		}
+	}
+	if this.records >= lockJournalMinimumRecords && this.records - live > live {
+		return this.rewrite()
+	}
+	return nil
+}
+
+// forgets token translations for locks that have expired. Caller must hold the mutex.
+func (this *persistentLS) prune(now time.Time) {
+	for token, lock := range this.locks {
+		if !lock.Expires.IsZero() && !lock.Expires.After(now) {
+			delete(this.locks, token)
+		}
+	}
+}
+
+func lockExpiry(now time.Time, duration time.Duration) time.Time {
+	if duration < 0 {
+		return time.Time{}
+	}
+	return now.Add(duration)
+}
+
+/*
+	Returns the state tokens from an If header, such as `(<opaquelocktoken:...>)` or `<http://host/a> (<opaquelocktoken:...> ["etag"])`.
+	Resource tags are the bracketed URLs outside of any parentheses, and are skipped.
+*/
+func ifHeaderTokens(header string) []string {
+
+	var ret []string
+	depth := 0
+
+	for i := 0; i < len(header); i++ {
+		switch header[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case '<':
+			end := strings.IndexByte(header[i:], '>')
+			if end < 0 {
+				return ret
+			}
+			if depth > 0 {
+				ret = append(ret, header[i+1:i+end])
+			}
+			i += end
+		}
+	}
+	return ret
+}
+
+func newLockToken() (string, error) {
+
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return "opaquelocktoken:" + hex.EncodeToString(raw), nil
+}
@@ -0,0 +1,305 @@
+package boji
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+	"strconv"
+	"strings"
+	"context"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+	"encoding/xml"
+	"encoding/json"
+	"golang.org/x/net/webdav"
+)
+
+const photoRulesFileName = "organize.json"
+
+// how many photos' EXIF data is remembered, so that listing a big folder doesn't reread every photo each time.
+const exifCacheLimit = 10000
+
+const exifNamespace = "urn:boji:exif"
+
+var exifDateTaken = xml.Name{Space: exifNamespace, Local: "date-taken"}
+var exifCamera = xml.Name{Space: exifNamespace, Local: "camera"}
+var exifLatitude = xml.Name{Space: exifNamespace, Local: "latitude"}
+var exifLongitude = xml.Name{Space: exifNamespace, Local: "longitude"}
+
+/*
+	Helps with backing up photos from a phone.
+
+	Directories can be set to be organized, so that anything uploaded into them is filed into a `YYYY/MM/` folder
+	beneath, by when it was taken (according to its EXIF data) or, failing that, its modification time.
+	Only files written directly into an organized directory are filed - its subfolders are left as they are.
+
+	Also gives the EXIF data of JPEGs as read-only properties - when they were taken, on what camera, and where.
+*/
+type photoOrganizer struct {
+	rulesPath string
+	fs archivableFS
+
+	dirs map[string]bool
+	mutex sync.Mutex
+
+	metadata map[string]cachedExif
+	metadataMutex sync.Mutex
+}
+
+type cachedExif struct {
+	stamp string
+	exif exifData
+	err error
+}
+
+func newPhotoOrganizer(stateDir string) (*photoOrganizer, error) {
+
+	ret := &photoOrganizer {
+		rulesPath: filepath.Join(stateDir, photoRulesFileName),
+		dirs: make(map[string]bool),
+		metadata: make(map[string]cachedExif),
+	}
+
+	encoded, err := ioutil.ReadFile(ret.rulesPath)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(encoded, &ret.dirs)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// sets whether uploads into the given directory are filed by date.
+func (this *photoOrganizer) setOrganized(name string, organized bool) error {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if organized {
+		this.dirs[slashClean(name)] = true
+	} else {
+		delete(this.dirs, slashClean(name))
+	}
+
+	encoded, err := json.Marshal(this.dirs)
+	if err != nil {
+		return err
+	}
+
+	tempPath := this.rulesPath + "~"
+	err = ioutil.WriteFile(tempPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, this.rulesPath)
+}
+
+func (this *photoOrganizer) isOrganized(dir string) bool {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	return this.dirs[slashClean(dir)]
+}
+
+/*
+	Files something just written into an organized directory into the `YYYY/MM/` folder for when it was taken.
+	Returns where the file is now - which is where it was, if it didn't need to be (or couldn't be) moved.
+	Anything already in the folder with the same name is left alone, and so is the new file.
+*/
+func (this *photoOrganizer) organize(name string, key []byte) string {
+
+	if this == nil {
+		return name
+	}
+
+	name = slashClean(name)
+	dir, base := path.Split(name)
+
+	// hidden files and temporary ones are usually about to be renamed or deleted by whatever wrote them.
+	if !this.isOrganized(dir) || strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") {
+		return name
+	}
+
+	ctx := context.Background()
+	if key != nil {
+		ctx = context.WithValue(ctx, contextEncryptionKey, key)
+	}
+
+	// PROPPATCH opens things for writing too, including the folders that have already been made.
+	info, err := this.fs.Stat(ctx, name)
+	if err != nil || info.IsDir() {
+		return name
+	}
+
+	taken, err := this.takenAt(ctx, name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to organize '%s': %v\n", name, err)
+		return name
+	}
+
+	year := path.Join(dir, fmt.Sprintf("%04d", taken.Year()))
+	month := path.Join(year, fmt.Sprintf("%02d", int(taken.Month())))
+	destination := path.Join(month, base)
+
+	_, err = this.fs.statListed(ctx, destination)
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "Not organizing '%s', '%s' already exists\n", name, destination)
+		return name
+	}
+
+	for _, folder := range []string{year, month} {
+		_, err = this.fs.Stat(ctx, folder)
+		if err != nil {
+			err = this.fs.Mkdir(ctx, folder, 0777)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to organize '%s': %v\n", name, err)
+			return name
+		}
+	}
+
+	err = this.fs.Rename(ctx, name, destination)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to organize '%s': %v\n", name, err)
+		return name
+	}
+	return destination
+}
+
+// when a file was taken, if it says - otherwise, when it was last modified (which uploads usually keep from the original).
+func (this *photoOrganizer) takenAt(ctx context.Context, name string) (time.Time, error) {
+
+	file, err := this.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+
+	header, err := ioutil.ReadAll(io.LimitReader(file, exifReadLimit))
+	if err == nil {
+		exif, err := readExif(header)
+		if err == nil && !exif.Taken.IsZero() {
+			return exif.Taken, nil
+		}
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+//
+
+/*
+	The EXIF properties of a JPEG, read from the file it's been opened as.
+	Reading a photo's header costs far more than anything else in a PROPFIND, so what's found is remembered until the file changes.
+*/
+func (this *photoOrganizer) properties(file *servedFile, info os.FileInfo) map[xml.Name]webdav.Property {
+
+	if this == nil || info.IsDir() || isFlagWriteable(file.flag) || !isExifReadable(file.name) {
+		return nil
+	}
+
+	stamp := fmt.Sprintf("%d/%d", info.Size(), info.ModTime().UnixNano())
+
+	this.metadataMutex.Lock()
+	cached, ok := this.metadata[file.path]
+	this.metadataMutex.Unlock()
+
+	if !ok || cached.stamp != stamp {
+		cached = cachedExif{stamp: stamp}
+		cached.exif, cached.err = readExifFrom(file.File)
+
+		this.metadataMutex.Lock()
+		if len(this.metadata) >= exifCacheLimit {
+			this.metadata = make(map[string]cachedExif)
+		}
+		this.metadata[file.path] = cached
+		this.metadataMutex.Unlock()
+	}
+
+	if cached.err != nil {
+		return nil
+	}
+
+	exif := cached.exif
+	ret := make(map[xml.Name]webdav.Property)
+
+	if !exif.Taken.IsZero() {
+		format := "2006-01-02T15:04:05"
+		if exif.TakenZoned {
+			format = time.RFC3339
+		}
+		ret[exifDateTaken] = webdav.Property{XMLName: exifDateTaken, InnerXML: []byte(exif.Taken.Format(format))}
+	}
+	if exif.Camera != "" {
+		ret[exifCamera] = webdav.Property{XMLName: exifCamera, InnerXML: []byte(escapeXML(exif.Camera))}
+	}
+	if exif.HasLocation {
+		ret[exifLatitude] = webdav.Property{XMLName: exifLatitude, InnerXML: []byte(strconv.FormatFloat(exif.Latitude, 'f', 6, 64))}
+		ret[exifLongitude] = webdav.Property{XMLName: exifLongitude, InnerXML: []byte(strconv.FormatFloat(exif.Longitude, 'f', 6, 64))}
+	}
+	return ret
+}
+
+// reads the EXIF data from the start of an open file, leaving it where it was found - at the start, for whatever reads it next.
+func readExifFrom(file webdav.File) (exifData, error) {
+
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return exifData{}, err
+	}
+	defer file.Seek(0, io.SeekStart)
+
+	header, err := ioutil.ReadAll(io.LimitReader(file, exifReadLimit))
+	if err != nil {
+		return exifData{}, err
+	}
+	return readExif(header)
+}
+
+func isExifReadable(name string) bool {
+
+	extension := strings.ToLower(path.Ext(name))
+	return extension == ".jpg" || extension == ".jpeg"
+}
+
+func isExifProperty(name xml.Name) bool {
+	return name.Space == exifNamespace
+}
+
+/*
+	Handles `POST /dir?organize=true` (or `false`), which sets whether uploads into a directory are filed by date.
+	Returns true if this was one.
+*/
+func (this *Server) attemptOrganizeRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	query := r.URL.Query()
+	_, ok := query["organize"]
+	if r.Method != "POST" || !ok {
+		return false
+	}
+
+	_, err := this.checkDir(r.URL.Path)
+	if err == nil {
+		err = this.fs.photos.setOrganized(r.URL.Path, query.Get("organize") == "true")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,425 @@
+package boji
+
+import (
+	"os"
+	"errors"
+	"strings"
+	"strconv"
+	"sync"
+	"net/http"
+	"path/filepath"
+	"io/ioutil"
+	"encoding/json"
+	"encoding/xml"
+	"golang.org/x/net/webdav"
+)
+
+const quotasFileName = "quotas.json"
+
+var errQuotaExceeded = errors.New("Insufficient storage, quota exceeded")
+var errAdminOnly = errors.New("Only the admin can set quotas")
+
+var quotaAvailableBytes = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+var quotaUsedBytes = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+
+/*
+	Tracks how much space each quota root uses, and enforces their limits.
+	Every top-level directory is its own quota root, limited by the default quota unless it's been given one of its own.
+	The served root as a whole is also a quota root (for any files directly inside it), limited only by the disk.
+
+	Usage is what's actually on disk, so compressed and encrypted files count for what they take up, not for their plaintext.
+	It's counted the first time it's needed, and then kept up to date by however much each change made through boji
+	grew or shrank what's on disk. Changes made any other way have it counted again.
+*/
+type quotaManager struct {
+	root string
+	path string
+	defaultLimit int64
+
+	limits map[string]int64
+	usage map[string]int64
+	mutex sync.Mutex
+}
+
+func newQuotaManager(root string, stateDir string, defaultQuota string) (*quotaManager, error) {
+
+	defaultLimit, err := parseQuotaSize(defaultQuota)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &quotaManager {
+		root: root,
+		path: filepath.Join(stateDir, quotasFileName),
+		defaultLimit: defaultLimit,
+		limits: make(map[string]int64),
+		usage: make(map[string]int64),
+	}
+
+	encoded, err := ioutil.ReadFile(ret.path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(encoded, &ret.limits)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+	Returns an error if writing [incoming] more bytes to the given name would exceed its quota root's limit.
+	If [overwrite] is set, whatever is already on disk for the name will be freed by the write, and doesn't count.
+	An [incoming] of -1 means the size isn't known, in which case the write is only refused if the root is already full.
+*/
+func (this *quotaManager) check(name string, incoming int64, overwrite bool) error {
+
+	allowance, limited := this.allowance(name, overwrite)
+	if !limited {
+		return nil
+	}
+
+	if incoming < 0 {
+		incoming = 0
+		if allowance <= 0 {
+			return errQuotaExceeded
+		}
+	}
+
+	if incoming > allowance {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+/*
+	How many more bytes can be written to the given name before its quota root's limit is reached,
+	or false if there's no limit. [overwrite] is as for check().
+*/
+func (this *quotaManager) allowance(name string, overwrite bool) (int64, bool) {
+
+	if this == nil {
+		return 0, false
+	}
+
+	quotaRoot := this.rootOf(name)
+	limit := this.limitOf(quotaRoot)
+	if limit <= 0 {
+		return 0, false
+	}
+
+	used := this.used(quotaRoot)
+	if overwrite {
+		used -= this.replacedSize(name)
+	}
+	return limit - used, true
+}
+
+/*
+	Measures what's on disk for [name] before it's changed, and returns a func to call once it has been,
+	which adjusts the usage of its quota root (and of the served root) by however much that changed.
+*/
+func (this *quotaManager) track(name string) func() {
+
+	if this == nil {
+		return func(){}
+	}
+
+	quotaRoot := this.rootOf(name)
+	before := this.footprint(name)
+
+	return func() {
+
+		delta := this.footprint(name) - before
+		if delta == 0 {
+			return
+		}
+
+		this.mutex.Lock()
+		defer this.mutex.Unlock()
+
+		// only usage that's already been counted needs adjusting, the rest will be counted with the change.
+		for _, counted := range []string{quotaRoot, ""} {
+			used, ok := this.usage[counted]
+			if ok {
+				this.usage[counted] = used + delta
+			}
+			if quotaRoot == "" {
+				break
+			}
+		}
+	}
+}
+
+// forgets the usage of the quota root containing the given name, so it's recounted next time it's needed.
+func (this *quotaManager) invalidate(name string) {
+
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	delete(this.usage, this.rootOf(name))
+	delete(this.usage, "")
+	this.mutex.Unlock()
+}
+
+// forgets every usage, so they're all recounted. Used by maintenance to pick up changes made outside of boji.
+func (this *quotaManager) invalidateAll() {
+
+	if this == nil {
+		return
+	}
+
+	this.mutex.Lock()
+	this.usage = make(map[string]int64)
+	this.mutex.Unlock()
+}
+
+// returns the RFC 4331 quota properties for a collection.
+func (this *quotaManager) properties(name string) map[xml.Name]webdav.Property {
+
+	ret := make(map[xml.Name]webdav.Property)
+	if this == nil {
+		return ret
+	}
+
+	quotaRoot := this.rootOf(name)
+	used := this.used(quotaRoot)
+
+	ret[quotaUsedBytes] = quotaProperty(quotaUsedBytes, used)
+
+	available, ok := this.available(quotaRoot, used)
+	if ok {
+		ret[quotaAvailableBytes] = quotaProperty(quotaAvailableBytes, available)
+	}
+	return ret
+}
+
+/*
+	Sets the limit of the top-level directory containing the given name, where a size of "none" removes any limit
+	and "default" reverts to the default quota.
+*/
+func (this *quotaManager) setLimit(name string, size string) error {
+
+	quotaRoot := this.rootOf(name)
+	if quotaRoot == "" {
+		return errors.New("Quotas can only be set on top-level directories")
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	switch size {
+	case "default":
+		delete(this.limits, quotaRoot)
+	case "none":
+		this.limits[quotaRoot] = 0
+	default:
+		limit, err := parseQuotaSize(size)
+		if err != nil {
+			return err
+		}
+		this.limits[quotaRoot] = limit
+	}
+
+	encoded, err := json.Marshal(this.limits)
+	if err != nil {
+		return err
+	}
+
+	tempPath := this.path + "~"
+	err = ioutil.WriteFile(tempPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, this.path)
+}
+
+//
+
+// the top-level directory containing the given name, or an empty string for the served root.
+func (this *quotaManager) rootOf(name string) string {
+
+	name = strings.TrimPrefix(slashClean(name), "/")
+	idx := strings.IndexByte(name, '/')
+	if idx >= 0 {
+		return name[:idx]
+	}
+
+	stat, err := os.Stat(filepath.Join(this.root, name))
+	if name != "" && err == nil && stat.IsDir() {
+		return name
+	}
+	return ""
+}
+
+func (this *quotaManager) limitOf(quotaRoot string) int64 {
+
+	if quotaRoot == "" {
+		return 0
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	limit, ok := this.limits[quotaRoot]
+	if ok {
+		return limit
+	}
+	return this.defaultLimit
+}
+
+func (this *quotaManager) used(quotaRoot string) int64 {
+
+	this.mutex.Lock()
+	used, ok := this.usage[quotaRoot]
+	this.mutex.Unlock()
+
+	if ok {
+		return used
+	}
+
+	used = diskUsage(filepath.Join(this.root, quotaRoot))
+
+	this.mutex.Lock()
+	this.usage[quotaRoot] = used
+	this.mutex.Unlock()
+	return used
+}
+
+// the space left in the given quota root, which is never more than is left on the disk.
+func (this *quotaManager) available(quotaRoot string, used int64) (int64, bool) {
+
+	free, err := diskFree(this.root)
+	limit := this.limitOf(quotaRoot)
+
+	if limit <= 0 {
+		return free, err == nil
+	}
+
+	available := limit - used
+	if available < 0 {
+		available = 0
+	}
+	if err == nil && free < available {
+		available = free
+	}
+	return available, true
+}
+
+/*
+	How much is on disk for the given name - the file or directory itself, or its encrypted form.
+	A name inside an archive can't be measured on its own, so it's the whole archive.
+*/
+func (this *quotaManager) footprint(name string) int64 {
+
+	path := resolve(this.root, name)
+	_, plainErr := os.Lstat(path)
+	_, encryptedErr := os.Lstat(path + encryptedExtension)
+	if plainErr == nil || encryptedErr == nil {
+		return diskUsage(path) + diskUsage(path + encryptedExtension)
+	}
+
+	stat, err := os.Stat(filepath.Join(filepath.Dir(path), "archive.zip"))
+	if err != nil {
+		return 0
+	}
+	return stat.Size()
+}
+
+// how much an overwrite of the given name would free; plain and encrypted files only, since an archive member can't be told apart.
+func (this *quotaManager) replacedSize(name string) int64 {
+
+	path := resolve(this.root, name)
+	for _, candidate := range []string{path, path + encryptedExtension} {
+		stat, err := os.Stat(candidate)
+		if err == nil && stat.Mode().IsRegular() {
+			return stat.Size()
+		}
+	}
+	return 0
+}
+
+// the total on-disk size of every file beneath the given path.
+func diskUsage(path string) int64 {
+
+	var total int64
+	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+/*
+	Answers a request whose write ran out of quota part way through with 507, instead of whatever failure webdav gave it.
+*/
+type quotaResponse struct {
+	http.ResponseWriter
+	exceeded *bool
+	answered bool
+}
+
+func (this *quotaResponse) WriteHeader(status int) {
+
+	if *this.exceeded && status >= 400 {
+		this.answered = true
+		http.Error(this.ResponseWriter, errQuotaExceeded.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func (this *quotaResponse) Write(p []byte) (int, error) {
+
+	if this.answered {
+		return len(p), nil
+	}
+	return this.ResponseWriter.Write(p)
+}
+
+func quotaProperty(name xml.Name, value int64) webdav.Property {
+	return webdav.Property {
+		XMLName: name,
+		InnerXML: []byte(strconv.FormatInt(value, 10)),
+	}
+}
+
+func isQuotaProperty(name xml.Name) bool {
+	return name == quotaAvailableBytes || name == quotaUsedBytes
+}
+
+/*
+	Parses a size like "500M" or "10G" (or just a number of bytes). An empty string means no limit.
+*/
+func parseQuotaSize(size string) (int64, error) {
+
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	switch size[len(size)-1] {
+	case 'K': multiplier = 1 << 10
+	case 'M': multiplier = 1 << 20
+	case 'G': multiplier = 1 << 30
+	case 'T': multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		size = size[:len(size)-1]
+	}
+
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || value < 0 {
+		return 0, errors.New("Invalid quota size, expected something like 500M or 10G")
+	}
+	return value * multiplier, nil
+}
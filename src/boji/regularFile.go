@@ -4,6 +4,7 @@ import (
 	"os"
 	"context"
 	"strings"
+	"time"
 	"golang.org/x/net/webdav"
 )
 
@@ -13,6 +14,8 @@ import (
 */
 type regularFile struct {
 	wrapped webdav.File
+	path string
+	modTime time.Time
 }
 
 func newRegularFile(base string, ctx context.Context, path string, flag int, perm os.FileMode) (*regularFile, error) {
@@ -24,6 +27,7 @@ func newRegularFile(base string, ctx context.Context, path string, flag int, per
 
 	return &regularFile {
 		wrapped: wrapped,
+		path: resolve(base, path),
 	}, nil
 }
 
@@ -57,7 +61,23 @@ func (this *regularFile) Stat() (os.FileInfo, error) {
 }
 
 func (this *regularFile) Close() error {
-	return this.wrapped.Close()
+
+	err := this.wrapped.Close()
+	if err != nil || this.modTime.IsZero() {
+		return err
+	}
+	return os.Chtimes(this.path, this.modTime, this.modTime)
+}
+
+// closes and removes the file, for a write that's being thrown away.
+func (this *regularFile) Discard() error {
+	this.wrapped.Close()
+	return os.Remove(this.path)
+}
+
+func (this *regularFile) SetModTime(modTime time.Time) error {
+	this.modTime = modTime
+	return nil
 }
 
 func (this *regularFile) Write(p []byte) (n int, err error) {
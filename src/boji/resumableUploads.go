@@ -0,0 +1,484 @@
+package boji
+
+import (
+	"os"
+	"io"
+	"sync"
+	"time"
+	"strings"
+	"strconv"
+	"context"
+	"net/http"
+	"path"
+	"path/filepath"
+	"io/ioutil"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/base64"
+	"golang.org/x/net/webdav"
+)
+
+const uploadsPrefix = "/_uploads/"
+const tusVersion = "1.0.0"
+const uploadExpiry = 24 * time.Hour
+
+/*
+	Resumable uploads, using the tus protocol (https://tus.io/protocols/resumable-upload.html).
+	A client POSTs to the directory it wants to upload into, and is given an upload URL under `/_uploads/`,
+	which it PATCHes chunks to - resuming from wherever the server says it got to, if the connection drops.
+
+	Chunks are staged outside the served root. Once the last one arrives, the whole file is streamed through archivableFS,
+	so that it's compressed and/or encrypted exactly as if it had been PUT in one go.
+	Uploads which haven't seen a chunk in a day are expired. Each belongs to whoever created it, and nobody else can see or touch it.
+*/
+type uploadManager struct {
+	dir string
+	fs archivableFS
+	locks *persistentLS
+	stats *telemetryStats
+
+	active map[string]bool
+	mutex sync.Mutex
+}
+
+// the state of an upload in progress, kept next to its staged data.
+type pendingUpload struct {
+	Owner string `json:"owner"`
+	Destination string `json:"destination"`
+	Length int64 `json:"length"`
+	Metadata string `json:"metadata,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+func newUploadManager(dir string, fs archivableFS, locks *persistentLS, stats *telemetryStats) *uploadManager {
+	return &uploadManager {
+		dir: dir,
+		fs: fs,
+		locks: locks,
+		stats: stats,
+		active: make(map[string]bool),
+	}
+}
+
+/*
+	Handles the request if it's part of a resumable upload, returning true if it was.
+*/
+func (this *uploadManager) attempt(w http.ResponseWriter, r *http.Request) bool {
+
+	isUploadURL := isReservedPath(this.fs.path, r.URL.Path, uploadsPrefix)
+	isCreation := r.Method == "POST" && r.Header.Get("Tus-Resumable") != ""
+
+	if !isUploadURL && !isCreation {
+		return false
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration,termination")
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return true
+	}
+
+	if isCreation {
+		this.create(w, r)
+		return true
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, uploadsPrefix), "/")
+	if !isUploadID(id) {
+		http.NotFound(w, r)
+		return true
+	}
+
+	switch r.Method {
+	case "HEAD": this.head(w, r, id)
+	case "PATCH": this.patch(w, r, id)
+	case "DELETE": this.terminate(w, r, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+	return true
+}
+
+func (this *uploadManager) create(w http.ResponseWriter, r *http.Request) {
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length must be given", http.StatusBadRequest)
+		return
+	}
+
+	metadata := r.Header.Get("Upload-Metadata")
+	destination := r.URL.Path
+
+	// uploading into a directory, the name comes from the metadata.
+	filename := uploadMetadata(metadata, "filename")
+	if filename != "" {
+		destination = path.Join(destination, path.Base("/" + filename))
+	}
+	destination = slashClean(destination)
+
+	if destination == "/" || this.fs.resolve(destination) == "" {
+		http.Error(w, "A filename must be given", http.StatusBadRequest)
+		return
+	}
+
+	err = this.fs.quotas.check(destination, length, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload := pendingUpload {
+		Owner: requestUsername(r),
+		Destination: destination,
+		Length: length,
+		Metadata: metadata,
+		Expires: time.Now().Add(uploadExpiry),
+	}
+
+	err = os.MkdirAll(this.dir, 0700)
+	if err == nil {
+		err = ioutil.WriteFile(this.dataPath(id), []byte{}, 0600)
+	}
+	if err == nil {
+		err = this.save(id, upload)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// there'll never be a chunk to finish an empty upload, so it's finished now.
+	if length == 0 {
+		err = this.assemble(r.Context(), id, upload)
+		if err == webdav.ErrLocked {
+			this.remove(id)
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		}
+		if err != nil {
+			this.remove(id)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Location", uploadsPrefix + id)
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (this *uploadManager) head(w http.ResponseWriter, r *http.Request, id string) {
+
+	upload, offset, err := this.loadOwned(r, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (this *uploadManager) patch(w http.ResponseWriter, r *http.Request, id string) {
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// one chunk at a time.
+	if !this.claim(id) {
+		http.Error(w, "Upload is already in progress", http.StatusConflict)
+		return
+	}
+	defer this.release(id)
+
+	upload, offset, err := this.loadOwned(r, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	claimed, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || claimed != offset {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	data, err := os.OpenFile(this.dataPath(id), os.O_WRONLY | os.O_APPEND, 0600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// anything that made it to disk before a dropped connection is kept, that's the whole point.
+	written, copyErr := io.CopyN(data, r.Body, upload.Length - offset + 1)
+	closeErr := data.Close()
+	offset += written
+
+	if offset > upload.Length {
+		os.Truncate(this.dataPath(id), offset - written)
+		http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if copyErr != nil && copyErr != io.EOF {
+		http.Error(w, copyErr.Error(), http.StatusInternalServerError)
+		return
+	}
+	if closeErr != nil {
+		http.Error(w, closeErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	upload.Expires = time.Now().Add(uploadExpiry)
+	this.save(id, upload)
+
+	if offset == upload.Length {
+		err = this.assemble(r.Context(), id, upload)
+		if err == webdav.ErrLocked {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (this *uploadManager) terminate(w http.ResponseWriter, r *http.Request, id string) {
+
+	if !this.claim(id) {
+		http.Error(w, "Upload is in progress", http.StatusConflict)
+		return
+	}
+	defer this.release(id)
+
+	_, _, err := this.loadOwned(r, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	this.remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+	Streams a completed upload through the filesystem to its destination, then forgets it.
+	Uses the context of the final chunk's request, so that whatever key that request gave is used to encrypt.
+*/
+func (this *uploadManager) assemble(ctx context.Context, id string, upload pendingUpload) error {
+
+	release, err := this.locks.claimForWrite(upload.Destination, "")
+	if err != nil {
+		return webdav.ErrLocked
+	}
+	defer release()
+
+	data, err := os.Open(this.dataPath(id))
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	file, err := this.fs.OpenFile(ctx, upload.Destination, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, data)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	this.stats.uploadsCompleted++
+	this.remove(id)
+	return nil
+}
+
+/*
+	Removes any uploads which have expired, along with any other staged data (such as checksummed PUTs) older than the expiry.
+*/
+func (this *uploadManager) expire() {
+
+	children, err := ioutil.ReadDir(this.dir)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for _, child := range children {
+
+		name := child.Name()
+		if strings.HasSuffix(name, ".upload") {
+
+			id := strings.TrimSuffix(name, ".upload")
+			upload, _, err := this.load(id)
+			if (err == nil && upload.Expires.After(now)) || !this.claim(id) {
+				continue
+			}
+
+			this.remove(id)
+			this.release(id)
+			continue
+		}
+
+		// data whose upload has gone (say, if boji stopped between removing the two) is as expired as any other staged file.
+		if strings.HasSuffix(name, ".data") && existsOnDisk(this.infoPath(strings.TrimSuffix(name, ".data"))) {
+			continue
+		}
+		if now.Sub(child.ModTime()) > uploadExpiry {
+			os.Remove(filepath.Join(this.dir, name))
+		}
+	}
+}
+
+//
+
+func (this *uploadManager) load(id string) (pendingUpload, int64, error) {
+
+	var upload pendingUpload
+
+	encoded, err := ioutil.ReadFile(this.infoPath(id))
+	if err != nil {
+		return upload, 0, err
+	}
+
+	err = json.Unmarshal(encoded, &upload)
+	if err != nil {
+		return upload, 0, err
+	}
+
+	// the offset is just however much has been staged.
+	stat, err := os.Stat(this.dataPath(id))
+	if err != nil {
+		return upload, 0, err
+	}
+	return upload, stat.Size(), nil
+}
+
+// loads an upload, but only for whoever created it - to anyone else, it doesn't exist.
+func (this *uploadManager) loadOwned(r *http.Request, id string) (pendingUpload, int64, error) {
+
+	upload, offset, err := this.load(id)
+	if err == nil && upload.Owner != requestUsername(r) {
+		return upload, 0, os.ErrNotExist
+	}
+	return upload, offset, err
+}
+
+func (this *uploadManager) save(id string, upload pendingUpload) error {
+
+	encoded, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+
+	tempPath := this.infoPath(id) + "~"
+	err = ioutil.WriteFile(tempPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, this.infoPath(id))
+}
+
+func (this *uploadManager) remove(id string) {
+	os.Remove(this.infoPath(id))
+	os.Remove(this.dataPath(id))
+}
+
+func (this *uploadManager) claim(id string) bool {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.active[id] {
+		return false
+	}
+	this.active[id] = true
+	return true
+}
+
+func (this *uploadManager) release(id string) {
+	this.mutex.Lock()
+	delete(this.active, id)
+	this.mutex.Unlock()
+}
+
+func (this *uploadManager) infoPath(id string) string {
+	return filepath.Join(this.dir, id + ".upload")
+}
+
+func (this *uploadManager) dataPath(id string) string {
+	return filepath.Join(this.dir, id + ".data")
+}
+
+func newUploadID() (string, error) {
+
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func isUploadID(id string) bool {
+
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+/*
+	Returns the value of the given key from a tus `Upload-Metadata` header,
+	which is a comma-separated list of "key base64(value)" pairs.
+*/
+func uploadMetadata(header string, key string) string {
+
+	for _, pair := range strings.Split(header, ",") {
+
+		fields := strings.Fields(pair)
+		if len(fields) != 2 || fields[0] != key {
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return ""
+		}
+		return string(value)
+	}
+	return ""
+}
@@ -0,0 +1,989 @@
+package boji
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"regexp"
+	"strings"
+	"strconv"
+	"context"
+	"net/url"
+	"net/http"
+	"encoding/xml"
+	"encoding/json"
+)
+
+const searchParameter = "search"
+
+var errUnsupportedSearch = errors.New("Unsupported search")
+
+/*
+	One thing that can be found by a search - a file or directory, by the name it's served as.
+*/
+type searchEntry struct {
+	Path string `json:"path"`
+	Directory bool `json:"directory,omitempty"`
+	Size int64 `json:"size"`
+	Modified time.Time `json:"modified"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type searchMatcher func(entry searchEntry) bool
+
+func newSearchEntry(name string, info os.FileInfo, mimeTypes *mimeResolver) searchEntry {
+
+	entry := searchEntry {
+		Path: name,
+		Directory: info.IsDir(),
+		Modified: info.ModTime(),
+	}
+	if !entry.Directory {
+		entry.Size = info.Size()
+		// searches go through far too many files to sniff them all, so only names count.
+		entry.ContentType = mimeTypes.byName(name)
+		if entry.ContentType == "" {
+			entry.ContentType = defaultContentType
+		}
+	}
+	return entry
+}
+
+/*
+	Calls [fn] with everything beneath a directory - its children, or all of its descendants if [infinite] -
+	as listed by the filesystem, so files inside archives and encrypted files (by their plaintext names) are included.
+*/
+func (this archivableFS) walk(ctx context.Context, dir string, infinite bool, fn func(searchEntry)) {
+
+	file, err := this.OpenFile(ctx, dir, os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+
+	children, _ := file.Readdir(0)
+	file.Close()
+
+	for _, child := range children {
+
+		// temporary files belong to whatever's writing them.
+		if strings.HasSuffix(child.Name(), "~") {
+			continue
+		}
+
+		name := path.Join(dir, child.Name())
+		fn(newSearchEntry(name, child, this.mimeTypes))
+
+		if infinite && child.IsDir() {
+			this.walk(ctx, name, true, fn)
+		}
+	}
+}
+
+//
+
+/*
+	An index of every name in the served tree, so that searches don't have to walk it.
+	Built once at startup, then kept up to date from the change feed - which includes changes made on disk,
+	if those are being watched for. Until it's built, searches walk the tree as usual.
+*/
+type searchIndex struct {
+	fs archivableFS
+	entries map[string]searchEntry
+	ready bool
+	stop chan bool
+	mutex sync.RWMutex
+}
+
+func newSearchIndex(fs archivableFS, enabled bool) *searchIndex {
+
+	if !enabled {
+		return nil
+	}
+
+	return &searchIndex {
+		fs: fs,
+		entries: make(map[string]searchEntry),
+		stop: make(chan bool),
+	}
+}
+
+func (this *searchIndex) run() {
+
+	if this == nil {
+		return
+	}
+
+	// subscribed before the tree is read, so that nothing can change unnoticed in between.
+	cursor := this.fs.changes.cursor()
+	_, events, _ := this.fs.changes.subscribe(cursor)
+	this.rebuild()
+
+	for {
+		select {
+		case <-this.stop:
+			this.fs.changes.unsubscribe(events)
+			return
+
+		case event, open := <-events:
+			if !open {
+				var missed []changeEvent
+				var ok bool
+
+				missed, events, ok = this.fs.changes.subscribe(cursor)
+				if !ok {
+					this.rebuild()
+					cursor = this.fs.changes.cursor()
+					continue
+				}
+				for _, event := range missed {
+					this.apply(event)
+					cursor = event.ID
+				}
+				continue
+			}
+			this.apply(event)
+			cursor = event.ID
+		}
+	}
+}
+
+func (this *searchIndex) Close() {
+
+	if this == nil {
+		return
+	}
+	this.stop <- true
+}
+
+func (this *searchIndex) rebuild() {
+
+	entries := make(map[string]searchEntry)
+	this.fs.walk(context.Background(), "/", true, func(entry searchEntry) {
+		entries[entry.Path] = entry
+	})
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.entries = entries
+	this.ready = true
+}
+
+// brings whatever an event touched up to date.
+func (this *searchIndex) apply(event changeEvent) {
+
+	for _, name := range []string{event.Path, event.Destination} {
+		if name != "" {
+			this.refresh(name, event.Directory)
+		}
+	}
+}
+
+/*
+	Forgets what was known about a name (and everything beneath it, if it's a directory), and looks at it again.
+*/
+func (this *searchIndex) refresh(name string, dir bool) {
+
+	ctx := context.Background()
+	entries := make(map[string]searchEntry)
+
+	info, err := this.fs.statListed(ctx, name)
+	if err == nil {
+		entries[name] = newSearchEntry(name, info, this.fs.mimeTypes)
+		if dir && info.IsDir() {
+			this.fs.walk(ctx, name, true, func(entry searchEntry) {
+				entries[entry.Path] = entry
+			})
+		}
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	delete(this.entries, name)
+	if dir {
+		prefix := strings.TrimSuffix(name, "/") + "/"
+		for known := range this.entries {
+			if strings.HasPrefix(known, prefix) {
+				delete(this.entries, known)
+			}
+		}
+	}
+	for known, entry := range entries {
+		this.entries[known] = entry
+	}
+}
+
+/*
+	Everything beneath a directory that matches. Returns false if the index isn't ready to be used.
+*/
+func (this *searchIndex) lookup(dir string, infinite bool, matcher searchMatcher) ([]searchEntry, bool) {
+
+	if this == nil {
+		return nil, false
+	}
+
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	if !this.ready {
+		return nil, false
+	}
+
+	var ret []searchEntry
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+
+	for name, entry := range this.entries {
+
+		if !strings.HasPrefix(name, prefix) || (!infinite && path.Dir(name) != dir) {
+			continue
+		}
+		if matcher(entry) {
+			ret = append(ret, entry)
+		}
+	}
+	return ret, true
+}
+
+//
+
+/*
+	Everything beneath a directory that matches, from the index if there is one, sorted by path.
+*/
+func (this *Server) search(ctx context.Context, dir string, infinite bool, matcher searchMatcher) []searchEntry {
+
+	dir = slashClean(dir)
+
+	ret, ok := this.searches.lookup(dir, infinite, matcher)
+	if !ok {
+		this.fs.walk(ctx, dir, infinite, func(entry searchEntry) {
+			if matcher(entry) {
+				ret = append(ret, entry)
+			}
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Path < ret[j].Path
+	})
+	return ret
+}
+
+/*
+	Handles searches, returning true if this was one.
+
+	`GET <dir>?search=<glob>` returns, as JSON, everything beneath a directory whose name matches a glob
+	(or whose path does, if the glob has a slash in it), optionally narrowed down by `type` (file or directory),
+	`contenttype` (which can be a glob too, like image/*), `minsize`, `maxsize`, `after` and `before` -
+	and by `text`, the words in it, if there's a full-text index.
+
+	The `SEARCH` method takes an RFC 5323 basicsearch, and responds with a multistatus like PROPFIND does.
+*/
+func (this *Server) attemptSearchRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	// clients look for this to know they can search at all.
+	if r.Method == "OPTIONS" {
+		w.Header().Set("DASL", "<DAV:basicsearch>")
+		return false
+	}
+
+	_, isSearch := r.URL.Query()[searchParameter]
+	_, isTextSearch := r.URL.Query()["text"]
+	if !(r.Method == "GET" && (isSearch || isTextSearch)) && r.Method != "SEARCH" {
+		return false
+	}
+
+	_, _, isSnapshot := splitSnapshotName(this.Settings.Root, r.URL.Path)
+	if isSnapshot {
+		http.Error(w, "Snapshots can't be searched", http.StatusForbidden)
+		return true
+	}
+
+	if r.Method == "SEARCH" {
+		this.serveBasicSearch(w, r)
+		return true
+	}
+
+	_, err := this.checkDir(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	key, _ := r.Context().Value(contextEncryptionKey).([]byte)
+	matcher, limit, err := parseSearchQuery(r.URL.Query(), this.fs.fulltext, len(key) > 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	results := this.search(r.Context(), r.URL.Path, true, matcher)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	if results == nil {
+		results = []searchEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+	return true
+}
+
+func parseSearchQuery(query url.Values, fulltext *fullTextIndex, keyed bool) (searchMatcher, int, error) {
+
+	var matchers []searchMatcher
+	var limit int
+
+	glob := query.Get(searchParameter)
+	if glob != "" && glob != "*" {
+
+		matcher, err := nameMatcher(glob)
+		if err != nil {
+			return nil, 0, err
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	switch query.Get("type") {
+	case "":
+	case "file":
+		matchers = append(matchers, func(entry searchEntry) bool { return !entry.Directory })
+	case "directory", "dir":
+		matchers = append(matchers, func(entry searchEntry) bool { return entry.Directory })
+	default:
+		return nil, 0, errors.New("Invalid type, expected file or directory")
+	}
+
+	contentType := strings.ToLower(query.Get("contenttype"))
+	if contentType != "" {
+
+		_, err := path.Match(contentType, "")
+		if err != nil {
+			return nil, 0, errors.New("Invalid contenttype")
+		}
+		matchers = append(matchers, func(entry searchEntry) bool {
+			actual := strings.ToLower(strings.SplitN(entry.ContentType, ";", 2)[0])
+			matched, _ := path.Match(contentType, actual)
+			return !entry.Directory && matched
+		})
+	}
+
+	for _, bound := range []string{"minsize", "maxsize"} {
+
+		value := query.Get(bound)
+		if value == "" {
+			continue
+		}
+
+		size, err := parseQuotaSize(value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Invalid %s, expected something like 500K or 10M", bound)
+		}
+
+		if bound == "minsize" {
+			matchers = append(matchers, func(entry searchEntry) bool { return !entry.Directory && entry.Size >= size })
+		} else {
+			matchers = append(matchers, func(entry searchEntry) bool { return !entry.Directory && entry.Size <= size })
+		}
+	}
+
+	for _, bound := range []string{"after", "before"} {
+
+		value := query.Get(bound)
+		if value == "" {
+			continue
+		}
+
+		when, err := parseSearchTime(value)
+		if err != nil {
+			return nil, 0, fmt.Errorf("Invalid %s, expected a date like 2020-01-31 or an RFC 3339 time", bound)
+		}
+
+		if bound == "after" {
+			matchers = append(matchers, func(entry searchEntry) bool { return entry.Modified.After(when) })
+		} else {
+			matchers = append(matchers, func(entry searchEntry) bool { return entry.Modified.Before(when) })
+		}
+	}
+
+	text := query.Get("text")
+	if text != "" {
+
+		matcher, err := fulltext.containing(text, keyed)
+		if err != nil {
+			return nil, 0, err
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	value := query.Get("limit")
+	if value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return nil, 0, errors.New("Invalid limit")
+		}
+		limit = parsed
+	}
+
+	return allOf(matchers), limit, nil
+}
+
+/*
+	Matches a glob against the name of each entry, ignoring case.
+	Globs with a slash in them are matched against the whole path instead, with ** matching across directories.
+*/
+func nameMatcher(glob string) (searchMatcher, error) {
+
+	glob = strings.ToLower(glob)
+
+	if strings.Contains(glob, "/") {
+		pattern, err := globPattern(glob)
+		if err != nil {
+			return nil, errors.New("Invalid search glob")
+		}
+		return func(entry searchEntry) bool {
+			return pattern.MatchString(strings.ToLower(entry.Path))
+		}, nil
+	}
+
+	_, err := path.Match(glob, "")
+	if err != nil {
+		return nil, errors.New("Invalid search glob")
+	}
+	return func(entry searchEntry) bool {
+		matched, _ := path.Match(glob, strings.ToLower(path.Base(entry.Path)))
+		return matched
+	}, nil
+}
+
+func parseSearchTime(value string) (time.Time, error) {
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02", http.TimeFormat} {
+		when, err := time.Parse(layout, value)
+		if err == nil {
+			return when, nil
+		}
+	}
+	return time.Time{}, errors.New("Invalid time")
+}
+
+func allOf(matchers []searchMatcher) searchMatcher {
+	return func(entry searchEntry) bool {
+		for _, matcher := range matchers {
+			if !matcher(entry) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func anyOf(matchers []searchMatcher) searchMatcher {
+	return func(entry searchEntry) bool {
+		for _, matcher := range matchers {
+			if matcher(entry) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+//
+
+// any XML element, with everything in it.
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs []xml.Attr `xml:",any,attr"`
+	Text string `xml:",chardata"`
+	Children []xmlNode `xml:",any"`
+}
+
+func (this xmlNode) child(local string) (xmlNode, bool) {
+	return this.childIn("DAV:", local)
+}
+
+func (this xmlNode) childIn(space string, local string) (xmlNode, bool) {
+
+	for _, child := range this.Children {
+		if child.XMLName.Space == space && child.XMLName.Local == local {
+			return child, true
+		}
+	}
+	return xmlNode{}, false
+}
+
+func (this xmlNode) childrenIn(space string, local string) []xmlNode {
+
+	var ret []xmlNode
+	for _, child := range this.Children {
+		if child.XMLName.Space == space && child.XMLName.Local == local {
+			ret = append(ret, child)
+		}
+	}
+	return ret
+}
+
+func (this xmlNode) attr(local string) string {
+
+	for _, attr := range this.Attrs {
+		if attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// the names of the properties in a DAV:prop element.
+func (this xmlNode) propNames() propNames {
+
+	var ret propNames
+	prop, _ := this.child("prop")
+	for _, child := range prop.Children {
+		ret = append(ret, child.XMLName)
+	}
+	return ret
+}
+
+// what's given back for DAV:allprop.
+var allSearchProps = propNames {
+	{Space: "DAV:", Local: "displayname"},
+	{Space: "DAV:", Local: "resourcetype"},
+	{Space: "DAV:", Local: "getcontentlength"},
+	{Space: "DAV:", Local: "getcontenttype"},
+	{Space: "DAV:", Local: "getlastmodified"},
+	{Space: "DAV:", Local: "getetag"},
+}
+
+/*
+	Answers an RFC 5323 basicsearch: the properties to select, the scopes to look in, the conditions to match,
+	what to order by, and how many results to give. The scope itself is included, as well as what's beneath it.
+	If there are more results than the limit, the request itself is given a 507 alongside the results there's room for.
+*/
+func (this *Server) serveBasicSearch(w http.ResponseWriter, r *http.Request) {
+
+	var request xmlNode
+	err := xml.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	search, ok := request.child("basicsearch")
+	if request.XMLName != (xml.Name{Space: "DAV:", Local: "searchrequest"}) || !ok {
+		http.Error(w, "Only DAV:basicsearch is supported", http.StatusUnprocessableEntity)
+		return
+	}
+
+	ctx := r.Context()
+
+	selection, _ := search.child("select")
+	props := selection.propNames()
+	_, allprop := selection.child("allprop")
+	if allprop || len(props) == 0 {
+		props = allSearchProps
+	}
+
+	matcher := func(searchEntry) bool { return true }
+	where, ok := search.child("where")
+	if ok && len(where.Children) > 0 {
+		key, _ := ctx.Value(contextEncryptionKey).([]byte)
+		matcher, err = parseSearchCondition(where.Children[0], this.fs.fulltext, len(key) > 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	from, _ := search.child("from")
+	var results []searchEntry
+
+	for _, scope := range from.Children {
+
+		if scope.XMLName.Local != "scope" {
+			continue
+		}
+
+		href, _ := scope.child("href")
+		dir, err := scopePath(href.Text)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, _, isSnapshot := splitSnapshotName(this.Settings.Root, dir)
+		if isSnapshot {
+			http.Error(w, "Snapshots can't be searched", http.StatusForbidden)
+			return
+		}
+
+		info, err := this.fs.statListed(ctx, dir)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Scope '%s' not found", dir), http.StatusBadRequest)
+			return
+		}
+
+		scopeEntry := newSearchEntry(dir, info, this.fs.mimeTypes)
+		if matcher(scopeEntry) {
+			results = append(results, scopeEntry)
+		}
+
+		depth, _ := scope.child("depth")
+		switch strings.TrimSpace(depth.Text) {
+		case "0":
+		case "1":
+			if info.IsDir() {
+				results = append(results, this.search(ctx, dir, false, matcher)...)
+			}
+		case "", "infinity":
+			if info.IsDir() {
+				results = append(results, this.search(ctx, dir, true, matcher)...)
+			}
+		default:
+			http.Error(w, "Invalid scope depth", http.StatusBadRequest)
+			return
+		}
+	}
+
+	orderby, ok := search.child("orderby")
+	if ok {
+		err = orderSearchResults(results, orderby)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	truncated := false
+	limit, ok := search.child("limit")
+	if ok {
+		nresults, _ := limit.child("nresults")
+		count, err := strconv.Atoi(strings.TrimSpace(nresults.Text))
+		if err != nil || count < 0 {
+			http.Error(w, "Invalid nresults", http.StatusBadRequest)
+			return
+		}
+		if len(results) > count {
+			results = results[:count]
+			truncated = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	for _, result := range results {
+		this.writeMemberProps(ctx, w, result.Path, props, nil)
+	}
+	if truncated {
+		fmt.Fprintf(w, "<D:response><D:href>%s</D:href><D:status>HTTP/1.1 507 Insufficient Storage</D:status>" +
+			"<D:responsedescription>Only the first %d results are given</D:responsedescription></D:response>",
+			escapeXML(r.URL.EscapedPath()), len(results))
+	}
+	fmt.Fprint(w, "</D:multistatus>")
+}
+
+// the path a scope's href refers to, which might be a whole url.
+func scopePath(href string) (string, error) {
+
+	parsed, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "", errors.New("Invalid scope")
+	}
+	return slashClean(parsed.Path), nil
+}
+
+/*
+	Turns a basicsearch condition - and, or, not, the comparisons, like, contains, is-collection, or is-defined - into a matcher.
+*/
+func parseSearchCondition(node xmlNode, fulltext *fullTextIndex, keyed bool) (searchMatcher, error) {
+
+	if node.XMLName.Space != "DAV:" {
+		return nil, errUnsupportedSearch
+	}
+
+	switch node.XMLName.Local {
+	case "and", "or":
+		var matchers []searchMatcher
+		for _, child := range node.Children {
+			matcher, err := parseSearchCondition(child, fulltext, keyed)
+			if err != nil {
+				return nil, err
+			}
+			matchers = append(matchers, matcher)
+		}
+		if node.XMLName.Local == "and" {
+			return allOf(matchers), nil
+		}
+		return anyOf(matchers), nil
+
+	case "not":
+		if len(node.Children) != 1 {
+			return nil, errors.New("DAV:not takes exactly one condition")
+		}
+		matcher, err := parseSearchCondition(node.Children[0], fulltext, keyed)
+		if err != nil {
+			return nil, err
+		}
+		return func(entry searchEntry) bool { return !matcher(entry) }, nil
+
+	case "is-collection":
+		return func(entry searchEntry) bool { return entry.Directory }, nil
+
+	case "is-defined":
+		props := node.propNames()
+		if len(props) != 1 {
+			return nil, errors.New("DAV:is-defined takes exactly one property")
+		}
+		prop := props[0]
+		return func(entry searchEntry) bool {
+			_, ok := searchValue(entry, prop)
+			return ok
+		}, nil
+
+	case "eq", "lt", "lte", "gt", "gte":
+		return parseSearchComparison(node)
+
+	case "like":
+		return parseSearchLike(node)
+
+	case "contains":
+		return fulltext.containing(node.Text, keyed)
+	}
+	return nil, fmt.Errorf("Unsupported search condition DAV:%s", node.XMLName.Local)
+}
+
+func parseSearchComparison(node xmlNode) (searchMatcher, error) {
+
+	props := node.propNames()
+	literal, ok := node.child("literal")
+	if len(props) != 1 || !ok {
+		return nil, fmt.Errorf("DAV:%s takes a property and a literal", node.XMLName.Local)
+	}
+
+	prop := props[0]
+	operator := node.XMLName.Local
+	caseless := node.attr("caseless") != "no"
+
+	// parsed once up front, so that a bad literal is an error rather than matching nothing.
+	expected, err := searchLiteral(prop, literal.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(entry searchEntry) bool {
+
+		value, ok := searchValue(entry, prop)
+		if !ok {
+			return false
+		}
+
+		order := compareSearchValues(value, expected, caseless)
+		switch operator {
+		case "eq": return order == 0
+		case "lt": return order < 0
+		case "lte": return order <= 0
+		case "gt": return order > 0
+		default: return order >= 0
+		}
+	}, nil
+}
+
+// DAV:like, where % matches anything and _ matches any one character.
+func parseSearchLike(node xmlNode) (searchMatcher, error) {
+
+	props := node.propNames()
+	literal, ok := node.child("literal")
+	if len(props) != 1 || !ok {
+		return nil, errors.New("DAV:like takes a property and a literal")
+	}
+
+	prop := props[0]
+	if prop.Space != "DAV:" || (prop.Local != "displayname" && prop.Local != "getcontenttype") {
+		return nil, fmt.Errorf("DAV:like can't be used with %s", prop.Local)
+	}
+
+	var expression strings.Builder
+	if node.attr("caseless") != "no" {
+		expression.WriteString("(?i)")
+	}
+	expression.WriteString("^")
+
+	pattern := literal.Text
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && i + 1 < len(pattern):
+			expression.WriteString(regexp.QuoteMeta(pattern[i+1:i+2]))
+			i++
+		case pattern[i] == '%':
+			expression.WriteString("(?s:.*)")
+		case pattern[i] == '_':
+			expression.WriteString("(?s:.)")
+		default:
+			expression.WriteString(regexp.QuoteMeta(pattern[i:i+1]))
+		}
+	}
+	expression.WriteString("$")
+
+	compiled, err := regexp.Compile(expression.String())
+	if err != nil {
+		return nil, errors.New("Invalid DAV:like pattern")
+	}
+
+	return func(entry searchEntry) bool {
+		value, ok := searchValue(entry, prop)
+		return ok && compiled.MatchString(value.(string))
+	}, nil
+}
+
+/*
+	The value of a property that can be searched on, as the type it's compared as - a string, a size, or a time.
+	Returns false if the entry doesn't have it.
+*/
+func searchValue(entry searchEntry, prop xml.Name) (interface{}, bool) {
+
+	if prop.Space != "DAV:" {
+		return nil, false
+	}
+
+	switch prop.Local {
+	case "displayname":
+		return path.Base(entry.Path), true
+	case "getcontenttype":
+		return entry.ContentType, !entry.Directory
+	case "getcontentlength":
+		return entry.Size, !entry.Directory
+	case "getlastmodified":
+		return entry.Modified, true
+	case "resourcetype":
+		return "", true
+	}
+	return nil, false
+}
+
+// the properties that can be compared, and ordered by.
+func isSearchableProperty(prop xml.Name) bool {
+
+	if prop.Space != "DAV:" {
+		return false
+	}
+
+	switch prop.Local {
+	case "displayname", "getcontenttype", "getcontentlength", "getlastmodified":
+		return true
+	}
+	return false
+}
+
+func searchLiteral(prop xml.Name, literal string) (interface{}, error) {
+
+	literal = strings.TrimSpace(literal)
+
+	switch {
+	case !isSearchableProperty(prop):
+		return nil, fmt.Errorf("Can't search on %s", prop.Local)
+
+	case prop.Local == "getcontentlength":
+		size, err := strconv.ParseInt(literal, 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid getcontentlength literal")
+		}
+		return size, nil
+
+	case prop.Local == "getlastmodified":
+		when, err := parseSearchTime(literal)
+		if err != nil {
+			return nil, errors.New("Invalid getlastmodified literal")
+		}
+		return when, nil
+
+	}
+	return literal, nil
+}
+
+// -1, 0 or 1, as for strings.Compare. Both values must be the same type.
+func compareSearchValues(a interface{}, b interface{}, caseless bool) int {
+
+	switch a := a.(type) {
+	case int64:
+		b := b.(int64)
+		switch {
+		case a < b: return -1
+		case a > b: return 1
+		}
+		return 0
+
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b): return -1
+		case a.After(b): return 1
+		}
+		return 0
+
+	case string:
+		b := b.(string)
+		if caseless {
+			return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+		}
+		return strings.Compare(a, b)
+	}
+	return 0
+}
+
+// sorts by each DAV:order in turn, ascending unless it says otherwise. Anything without the property sorts last.
+func orderSearchResults(results []searchEntry, orderby xmlNode) error {
+
+	type ordering struct {
+		prop xml.Name
+		descending bool
+		caseless bool
+	}
+
+	var orderings []ordering
+	for _, order := range orderby.Children {
+
+		if order.XMLName.Local != "order" {
+			continue
+		}
+
+		props := order.propNames()
+		if len(props) != 1 {
+			return errors.New("DAV:order takes exactly one property")
+		}
+
+		if !isSearchableProperty(props[0]) {
+			return fmt.Errorf("Can't order by %s", props[0].Local)
+		}
+
+		_, descending := order.child("descending")
+		orderings = append(orderings, ordering{props[0], descending, order.attr("caseless") != "no"})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, ordering := range orderings {
+
+			a, aOk := searchValue(results[i], ordering.prop)
+			b, bOk := searchValue(results[j], ordering.prop)
+
+			if aOk != bOk {
+				return aOk
+			}
+			if !aOk {
+				continue
+			}
+
+			order := compareSearchValues(a, b, ordering.caseless)
+			if order != 0 {
+				return (order < 0) != ordering.descending
+			}
+		}
+		return false
+	})
+	return nil
+}
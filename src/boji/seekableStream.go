@@ -0,0 +1,108 @@
+package boji
+
+import (
+	"io"
+	"io/ioutil"
+	"errors"
+)
+
+/*
+	Gives proper seek semantics to content that can only be read forwards, such as a decompressor or a decryptor,
+	so that http.ServeContent can serve ranges of it.
+	Seeking only records the desired position. The stream is repositioned on the next read,
+	either by skipping forwards or (if the position is behind it) by reopening it from the start.
+*/
+type seekableStream struct {
+	open func() (io.ReadCloser, error)
+	size func() (int64, error)
+
+	reader io.ReadCloser
+	readerPos int64
+	seekPos int64
+}
+
+func newSeekableStream(open func() (io.ReadCloser, error), size func() (int64, error)) *seekableStream {
+	return &seekableStream {
+		open: open,
+		size: size,
+	}
+}
+
+func (this *seekableStream) Read(p []byte) (int, error) {
+
+	err := this.reposition()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := this.reader.Read(p)
+	this.readerPos += int64(n)
+	this.seekPos = this.readerPos
+	return n, err
+}
+
+func (this *seekableStream) Seek(offset int64, whence int) (int64, error) {
+
+	var target int64
+
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = this.seekPos + offset
+	case io.SeekEnd:
+		size, err := this.size()
+		if err != nil {
+			return this.seekPos, err
+		}
+		target = size + offset
+	default:
+		return this.seekPos, errors.New("Invalid seek whence")
+	}
+
+	if target < 0 {
+		return this.seekPos, errors.New("Cannot seek before the start of a file")
+	}
+
+	this.seekPos = target
+	return target, nil
+}
+
+func (this *seekableStream) Close() error {
+
+	if this.reader == nil {
+		return nil
+	}
+
+	err := this.reader.Close()
+	this.reader = nil
+	return err
+}
+
+// moves the underlying stream to wherever the last seek asked for.
+func (this *seekableStream) reposition() error {
+
+	if this.reader == nil || this.readerPos > this.seekPos {
+
+		this.Close()
+
+		reader, err := this.open()
+		if err != nil {
+			return err
+		}
+		this.reader = reader
+		this.readerPos = 0
+	}
+
+	if this.readerPos < this.seekPos {
+
+		skipped, err := io.CopyN(ioutil.Discard, this.reader, this.seekPos - this.readerPos)
+		this.readerPos += skipped
+
+		// seeking past the end is allowed, reads from there just hit EOF.
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package boji
+
+import (
+	"os"
+	"fmt"
+	"bytes"
+	"strings"
+	"context"
+	"testing"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+	"net/http/httptest"
+	"golang.org/x/net/webdav"
+)
+
+var testStreamKey = []byte("correct horse battery staple")
+
+// a range/conditional GET, and what should come back for it.
+type rangeCase struct {
+	name string
+	headers map[string]string
+	status int
+	body func(content []byte) []byte
+	contentRange string
+	multipart []string
+}
+
+/*
+	Serves the same content as a regular file, a member of an archive, and an encrypted file,
+	and checks that each answers ranges and conditions exactly as a plain file served by net/http would.
+*/
+func TestSeekableStreamConformance(test *testing.T) {
+
+	root, cleanup := newTestTree(test)
+	defer cleanup()
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte('a' + i % 26)
+	}
+
+	writeTestFile(test, filepath.Join(root, "plain", "data.txt"), content)
+
+	writeTestFile(test, filepath.Join(root, "zipped", "data.txt"), content)
+	err := archiveDir(filepath.Join(root, "zipped"), nil)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	writeTestFile(test, filepath.Join(root, "secret", "data.txt"), content)
+	err = encryptFile(filepath.Join(root, "secret", "data.txt"), testStreamKey)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	handler, fs := newTestStreamHandler(root)
+
+	for _, kind := range []string{"plain", "zipped", "secret"} {
+
+		name := "/" + kind + "/data.txt"
+
+		// an encrypted file's ETag is only strong once its digest is known.
+		if kind == "secret" {
+			etag := serveTest(handler, "GET", name, nil).Header().Get("ETag")
+			if !strings.HasPrefix(etag, "W/") {
+				test.Errorf("%s: expected a weak ETag before the digest is known, got '%s'", kind, etag)
+			}
+
+			ctx := context.WithValue(context.Background(), contextEncryptionKey, testStreamKey)
+			_, err = fs.digests.digest(fs.resolve(name), nil, fsOpener(ctx, fs, name))
+			if err != nil {
+				test.Fatal(err)
+			}
+		}
+
+		etag := serveTest(handler, "GET", name, nil).Header().Get("ETag")
+		if etag == "" {
+			test.Fatalf("%s: no ETag", kind)
+		}
+
+		for _, testCase := range rangeCases(etag) {
+
+			response := serveTest(handler, "GET", name, testCase.headers)
+			label := kind + ": " + testCase.name
+
+			if response.Code != testCase.status {
+				test.Errorf("%s: expected status %d, got %d", label, testCase.status, response.Code)
+				continue
+			}
+			if testCase.contentRange != response.Header().Get("Content-Range") {
+				test.Errorf("%s: expected Content-Range '%s', got '%s'", label, testCase.contentRange, response.Header().Get("Content-Range"))
+			}
+			if testCase.body != nil && !bytes.Equal(response.Body.Bytes(), testCase.body(content)) {
+				test.Errorf("%s: expected body '%s', got '%s'", label, testCase.body(content), response.Body.Bytes())
+			}
+			for _, part := range testCase.multipart {
+				if !strings.Contains(response.Body.String(), part) {
+					test.Errorf("%s: expected a part containing '%s'", label, part)
+				}
+			}
+		}
+	}
+}
+
+func rangeCases(etag string) []rangeCase {
+
+	slice := func(from int, to int) func([]byte) []byte {
+		return func(content []byte) []byte {
+			return content[from:to]
+		}
+	}
+	whole := slice(0, 1000)
+
+	return []rangeCase {
+		{
+			name: "no range",
+			status: 200,
+			body: whole,
+		},
+		{
+			name: "range from the start",
+			headers: map[string]string{"Range": "bytes=0-9"},
+			status: 206,
+			body: slice(0, 10),
+			contentRange: "bytes 0-9/1000",
+		},
+		{
+			name: "range in the middle",
+			headers: map[string]string{"Range": "bytes=500-549"},
+			status: 206,
+			body: slice(500, 550),
+			contentRange: "bytes 500-549/1000",
+		},
+		{
+			name: "open-ended range",
+			headers: map[string]string{"Range": "bytes=990-"},
+			status: 206,
+			body: slice(990, 1000),
+			contentRange: "bytes 990-999/1000",
+		},
+		{
+			name: "suffix range",
+			headers: map[string]string{"Range": "bytes=-5"},
+			status: 206,
+			body: slice(995, 1000),
+			contentRange: "bytes 995-999/1000",
+		},
+		{
+			name: "range past the end",
+			headers: map[string]string{"Range": "bytes=990-2000"},
+			status: 206,
+			body: slice(990, 1000),
+			contentRange: "bytes 990-999/1000",
+		},
+		{
+			// the second part is behind the first, so the stream has to go back to the start.
+			name: "multiple ranges, out of order",
+			headers: map[string]string{"Range": "bytes=700-709,26-35"},
+			status: 206,
+			multipart: []string{"Content-Range: bytes 700-709/1000", "Content-Range: bytes 26-35/1000", "yzabcdefgh", "abcdefghij"},
+		},
+		{
+			name: "unsatisfiable range",
+			headers: map[string]string{"Range": "bytes=2000-3000"},
+			status: 416,
+			contentRange: "bytes */1000",
+		},
+		{
+			name: "If-Range with the current ETag",
+			headers: map[string]string{"Range": "bytes=100-199", "If-Range": etag},
+			status: 206,
+			body: slice(100, 200),
+			contentRange: "bytes 100-199/1000",
+		},
+		{
+			// If-Range only ever matches a strong ETag, so net/http ignores the range for a weak one.
+			name: "If-Range with the current weak ETag",
+			headers: map[string]string{"Range": "bytes=100-199", "If-Range": "W/" + etag},
+			status: 200,
+			body: whole,
+		},
+		{
+			name: "If-Range with a stale ETag",
+			headers: map[string]string{"Range": "bytes=100-199", "If-Range": `"stale"`},
+			status: 200,
+			body: whole,
+		},
+		{
+			name: "If-None-Match with the current ETag",
+			headers: map[string]string{"If-None-Match": etag},
+			status: 304,
+		},
+		{
+			name: "If-None-Match with a stale ETag",
+			headers: map[string]string{"If-None-Match": `"stale"`},
+			status: 200,
+			body: whole,
+		},
+		{
+			name: "If-None-Match with any ETag",
+			headers: map[string]string{"If-None-Match": "*"},
+			status: 304,
+		},
+	}
+}
+
+//
+
+func newTestTree(test *testing.T) (string, func()) {
+
+	dir, err := ioutil.TempDir("", "boji-test-")
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	root := filepath.Join(dir, "data")
+	err = os.Mkdir(root, 0700)
+	if err != nil {
+		test.Fatal(err)
+	}
+	return root, func() { os.RemoveAll(dir) }
+}
+
+func writeTestFile(test *testing.T, path string, content []byte) {
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path, content, 0600)
+	}
+	if err != nil {
+		test.Fatal(err)
+	}
+}
+
+// a webdav handler over the given root, which knows the key to encrypted files.
+func newTestStreamHandler(root string) (http.Handler, archivableFS) {
+
+	fs := archivableFS {
+		path: root,
+		stats: &telemetryStats{},
+		digests: newDigestCache(root, filepath.Join(filepath.Dir(root), "state")),
+	}
+
+	handler := &webdav.Handler {
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), contextEncryptionKey, testStreamKey)
+		handler.ServeHTTP(w, r.WithContext(ctx))
+	}), fs
+}
+
+func serveTest(handler http.Handler, method string, name string, headers map[string]string) *httptest.ResponseRecorder {
+
+	request := httptest.NewRequest(method, fmt.Sprintf("http://boji%s", name), nil)
+	for header, value := range headers {
+		request.Header.Set(header, value)
+	}
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
@@ -0,0 +1,318 @@
+package boji
+
+import (
+	"os"
+	"time"
+	"context"
+	"net/http"
+	"path"
+	"encoding/xml"
+	"golang.org/x/net/webdav"
+)
+
+/*
+	Wraps every file handed out by archivableFS, whatever kind it is underneath,
+	so that they all behave the same way as far as webdav is concerned:
+	they can all hold dead properties, and their FileInfos all have strong ETags.
+*/
+type servedFile struct {
+	webdav.File
+
+	fs archivableFS
+	name string
+	path string
+	flag int
+	created bool
+	key []byte
+	props *propertyStore
+
+	// adjusts quota usage by however much writing changed the file, if it was opened for writing.
+	tracked func()
+
+	// how many more bytes can be written before the quota runs out, or -1 if there's no limit.
+	allowance int64
+	written int64
+	overran bool
+
+	// set once the quota runs out, so the request can say so.
+	exceeded *bool
+
+	// the version kept of whatever this file replaced, so that it can be put back.
+	replaced string
+}
+
+/*
+	Implemented by files which can throw away what's been written to them, rather than keep it.
+*/
+type discardable interface {
+	Discard() error
+}
+
+// counts what's written against the quota, and refuses anything that would go over it.
+func (this *servedFile) Write(p []byte) (int, error) {
+
+	if this.allowance >= 0 && this.written + int64(len(p)) > this.allowance {
+		this.overran = true
+		if this.exceeded != nil {
+			*this.exceeded = true
+		}
+		return 0, errQuotaExceeded
+	}
+
+	n, err := this.File.Write(p)
+	this.written += int64(n)
+	return n, err
+}
+
+func (this *servedFile) Stat() (os.FileInfo, error) {
+
+	info, err := this.File.Stat()
+	if err != nil {
+		return info, err
+	}
+	return this.fs.wrapInfo(this.name, this.path, hideEncryptionInfo(info)), nil
+}
+
+func (this *servedFile) Readdir(count int) ([]os.FileInfo, error) {
+
+	children, err := this.File.Readdir(count)
+	for i, child := range children {
+		name := path.Join(this.name, child.Name())
+		children[i] = this.fs.wrapInfo(name, this.fs.resolve(name), child)
+	}
+	return children, err
+}
+
+func (this *servedFile) Close() error {
+
+	var err error
+	if this.overran {
+		err = this.rollback()
+	} else {
+		err = this.File.Close()
+	}
+
+	// whatever we cached about the old content is no longer true.
+	if isFlagWriteable(this.flag) {
+		defer this.fs.changes.finishWriting(this.name)
+		this.fs.digests.invalidate(this.path)
+
+		// rolling back changes the file more than once, so it's simplest to count it again.
+		if this.overran {
+			this.fs.quotas.invalidate(this.name)
+		} else if this.tracked != nil {
+			this.tracked()
+		}
+
+		if err == nil && this.created {
+			this.fs.changes.publish("create", this.name, "", false)
+		} else if err == nil {
+			this.fs.changes.publish("modify", this.name, "", false)
+		}
+
+		if err == nil {
+			name := this.fs.photos.organize(this.name, this.key)
+			this.fs.fulltext.wrote(name, this.key)
+		}
+	}
+	return err
+}
+
+/*
+	Throws away a write which ran out of quota, and puts back whatever it replaced from the version kept of it.
+	Without a version there's nothing to put back (opening the file truncated it), so it's removed rather than left half-written.
+*/
+func (this *servedFile) rollback() error {
+
+	discarded, ok := this.File.(discardable)
+	if !ok {
+		this.File.Close()
+		return errQuotaExceeded
+	}
+
+	err := discarded.Discard()
+	if err != nil {
+		return err
+	}
+
+	// archive members are only staged until they're closed, so the archive still has the old one.
+	if existsOnDisk(this.path) {
+		return errQuotaExceeded
+	}
+
+	if this.replaced != "" {
+		ctx := context.Background()
+		if len(this.key) > 0 {
+			ctx = context.WithValue(ctx, contextEncryptionKey, this.key)
+		}
+
+		err = this.fs.versions.restore(ctx, this.name, this.replaced)
+		if err != nil {
+			return err
+		}
+	} else if !this.created {
+		this.fs.changes.publish("delete", this.name, "", false)
+	}
+	return errQuotaExceeded
+}
+
+// whether this is an encrypted file, being read or written with a key.
+func (this *servedFile) isEncrypted() bool {
+
+	switch this.File.(type) {
+	case *encryptedFile, *encryptedFileW:
+		return true
+	}
+	return false
+}
+
+//
+
+/*
+	A FileInfo for anything served by archivableFS.
+*/
+type servedInfo struct {
+	os.FileInfo
+
+	fs archivableFS
+	name string
+	path string
+}
+
+func (this archivableFS) wrapInfo(name string, path string, info os.FileInfo) servedInfo {
+	return servedInfo {
+		FileInfo: info,
+		fs: this,
+		name: name,
+		path: path,
+	}
+}
+
+func (this servedInfo) ETag(ctx context.Context) (string, error) {
+
+	etag, err := this.fs.digests.etag(this.path, this.FileInfo)
+	if err != nil {
+		// an ETag is never worth failing a whole PROPFIND over, use webdav's own.
+		return "", webdav.ErrNotImplemented
+	}
+	return etag, nil
+}
+
+//
+
+func (this *servedFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+
+	props, err := this.props.load(this.path)
+	if err != nil {
+		return props, err
+	}
+
+	// quotas (and the rest) aren't dead properties, but webdav has no other way to add live ones.
+	info, err := this.File.Stat()
+	if err == nil && info.IsDir() {
+		for name, prop := range this.fs.quotas.properties(this.name) {
+			props[name] = prop
+		}
+		for name, prop := range this.fs.changes.properties() {
+			props[name] = prop
+		}
+	}
+	if err == nil {
+		for name, prop := range this.fs.photos.properties(this, info) {
+			props[name] = prop
+		}
+		for name, prop := range this.fs.groupware.properties(this.name, info) {
+			props[name] = prop
+		}
+	}
+	return props, nil
+}
+
+/*
+	Either every change is made, or none of them are (RFC 4918 §9.2). Live properties can't be changed (403),
+	and a Win32LastModifiedTime has to be a time (409) - if any property fails, the rest fail because of it (424).
+*/
+func (this *servedFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+
+	props, err := this.props.load(this.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var modTime time.Time
+	var names []xml.Name
+	failed := make(map[xml.Name]int)
+
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+
+			names = append(names, prop.XMLName)
+			switch {
+			case isQuotaProperty(prop.XMLName) || isSyncProperty(prop.XMLName) || isExifProperty(prop.XMLName) || isGroupwareProperty(prop.XMLName):
+				failed[prop.XMLName] = http.StatusForbidden
+
+			// windows sets the original modification time of uploads this way, so it has to actually be applied.
+			case !patch.Remove && prop.XMLName == win32LastModifiedTime:
+				modTime, err = parseWin32Time(prop.InnerXML)
+				if err != nil {
+					failed[prop.XMLName] = http.StatusConflict
+				}
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return failedPropstats(names, failed), nil
+	}
+
+	status := webdav.Propstat{Status: http.StatusOK}
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+
+			status.Props = append(status.Props, webdav.Property{XMLName: prop.XMLName})
+			if patch.Remove {
+				delete(props, prop.XMLName)
+				continue
+			}
+			props[prop.XMLName] = prop
+		}
+	}
+
+	err = this.props.save(this.path, props)
+	if err != nil {
+		return nil, err
+	}
+
+	setter, ok := this.File.(modTimeSetter)
+	if ok && !modTime.IsZero() {
+		err = setter.SetModTime(modTime)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []webdav.Propstat{status}, nil
+}
+
+// groups the properties of a failed PROPPATCH by why they failed, where those that didn't fail themselves are 424 Failed Dependency.
+func failedPropstats(names []xml.Name, failed map[xml.Name]int) []webdav.Propstat {
+
+	var ret []webdav.Propstat
+	indices := make(map[int]int)
+
+	for _, name := range names {
+
+		code, ok := failed[name]
+		if !ok {
+			code = http.StatusFailedDependency
+		}
+
+		idx, ok := indices[code]
+		if !ok {
+			idx = len(ret)
+			indices[code] = idx
+			ret = append(ret, webdav.Propstat{Status: code})
+		}
+		ret[idx].Props = append(ret[idx].Props, webdav.Property{XMLName: name})
+	}
+	return ret
+}
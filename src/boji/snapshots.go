@@ -0,0 +1,368 @@
+package boji
+
+import (
+	"os"
+	"time"
+	"errors"
+	"regexp"
+	"strings"
+	"context"
+	"net/http"
+	"path/filepath"
+	"io/ioutil"
+	"encoding/json"
+	"golang.org/x/net/webdav"
+)
+
+const snapshotsPrefix = "/.snapshots"
+const snapshotInfoName = "snapshot.json"
+const snapshotTreeName = "tree"
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+var errSnapshotExists = errors.New("A snapshot with that name already exists")
+
+/*
+	Named, read-only, point-in-time copies of a subtree, kept in the state dir.
+
+	Each file is taken as a copy-on-write clone where the filesystem supports them, otherwise as a plain copy.
+	Never as a hardlink, since then anything that writes to the live file in place (including tools other than boji)
+	would change the snapshot too.
+
+	Snapshots are exact copies of what's on disk, so archives and encrypted files are snapshotted as they are,
+	and read back through their own archivableFS exactly like the live tree.
+*/
+type snapshotStore struct {
+	root string
+	dir string
+	live archivableFS
+}
+
+// what's recorded about each snapshot, next to its tree.
+type snapshotInfo struct {
+	Name string `json:"name"`
+	Origin string `json:"origin"`
+	Created time.Time `json:"created"`
+}
+
+func newSnapshotStore(root string, stateDir string) *snapshotStore {
+	return &snapshotStore {
+		root: root,
+		dir: filepath.Join(stateDir, "snapshots"),
+	}
+}
+
+/*
+	Takes a snapshot of the directory at the given name. If [snapshotName] is empty, one is made up from the time.
+*/
+func (this *snapshotStore) take(name string, snapshotName string) (snapshotInfo, error) {
+
+	info := snapshotInfo {
+		Name: snapshotName,
+		Origin: slashClean(name),
+		Created: time.Now(),
+	}
+
+	if info.Name == "" {
+		info.Name = info.Created.UTC().Format("2006-01-02T15-04-05")
+	}
+	if !snapshotNamePattern.MatchString(info.Name) {
+		return info, errors.New("Snapshot names may only contain letters, numbers, dots, dashes and underscores")
+	}
+
+	source := this.live.resolve(name)
+	snapshotDir := filepath.Join(this.dir, info.Name)
+
+	_, err := os.Stat(snapshotDir)
+	if err == nil {
+		return info, errSnapshotExists
+	}
+
+	err = os.MkdirAll(snapshotDir, 0700)
+	if err != nil {
+		return info, err
+	}
+
+	err = cloneTree(source, filepath.Join(snapshotDir, snapshotTreeName))
+	if err != nil {
+		os.RemoveAll(snapshotDir)
+		return info, err
+	}
+
+	// sidecar properties don't live in the tree, so they're copied separately.
+	sidecar := this.live.props.sidecarDir(source)
+	_, err = os.Stat(sidecar)
+	if err == nil {
+		copyTree(sidecar, filepath.Join(snapshotDir, "props"))
+	}
+
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		os.RemoveAll(snapshotDir)
+		return info, err
+	}
+	return info, ioutil.WriteFile(filepath.Join(snapshotDir, snapshotInfoName), encoded, 0600)
+}
+
+func (this *snapshotStore) remove(snapshotName string) error {
+
+	if !snapshotNamePattern.MatchString(snapshotName) {
+		return os.ErrNotExist
+	}
+
+	snapshotDir := filepath.Join(this.dir, snapshotName)
+	_, err := os.Stat(filepath.Join(snapshotDir, snapshotInfoName))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(snapshotDir)
+}
+
+// the filesystem that serves the given snapshot, read-only.
+func (this *snapshotStore) filesystem(snapshotName string) (archivableFS, error) {
+
+	if !snapshotNamePattern.MatchString(snapshotName) {
+		return archivableFS{}, os.ErrNotExist
+	}
+
+	snapshotDir := filepath.Join(this.dir, snapshotName)
+	_, err := os.Stat(filepath.Join(snapshotDir, snapshotInfoName))
+	if err != nil {
+		return archivableFS{}, os.ErrNotExist
+	}
+
+	tree := filepath.Join(snapshotDir, snapshotTreeName)
+	return archivableFS {
+		path: tree,
+		stats: this.live.stats,
+		props: &propertyStore{root: tree, sidecar: filepath.Join(snapshotDir, "props")},
+		digests: newDigestCache(tree, snapshotDir),
+	}, nil
+}
+
+/*
+	Handles a request to take a snapshot of a directory, such as `POST /photos?snapshot=before-encrypt`.
+	Returns true if this was one.
+*/
+func (this *Server) attemptSnapshotRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	query := r.URL.Query()
+	_, ok := query["snapshot"]
+	if r.Method != "POST" || !ok {
+		return false
+	}
+
+	_, err := this.checkDir(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	info, err := this.snapshots.take(r.URL.Path, query.Get("snapshot"))
+	switch {
+	case err == nil:
+		w.Header().Set("Location", snapshotsPrefix + "/" + info.Name + "/")
+		w.WriteHeader(http.StatusCreated)
+	case err == errSnapshotExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+	return true
+}
+
+//
+
+/*
+	The webdav.FileSystem actually served. Everything is passed through to the live tree, except for `/.snapshots/`,
+	which lists every snapshot, and serves each of them read-only. The only change allowed there is deleting a whole snapshot.
+*/
+type snapshotFS struct {
+	archivableFS
+	snapshots *snapshotStore
+}
+
+func (this snapshotFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+
+	_, _, ok := splitSnapshotName(this.path, name)
+	if ok {
+		return os.ErrPermission
+	}
+	return this.archivableFS.Mkdir(ctx, name, perm)
+}
+
+func (this snapshotFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+
+	snapshotName, rest, ok := splitSnapshotName(this.path, name)
+	if !ok {
+		return this.archivableFS.OpenFile(ctx, name, flag, perm)
+	}
+
+	// even a bare O_RDWR is refused, since that's how properties (and modification times) are patched.
+	if flag != os.O_RDONLY {
+		return nil, os.ErrPermission
+	}
+
+	if snapshotName == "" {
+		return this.listing()
+	}
+
+	fs, err := this.snapshots.filesystem(snapshotName)
+	if err != nil {
+		return nil, err
+	}
+	return fs.OpenFile(ctx, rest, flag, perm)
+}
+
+func (this snapshotFS) RemoveAll(ctx context.Context, name string) error {
+
+	snapshotName, rest, ok := splitSnapshotName(this.path, name)
+	if !ok {
+		return this.archivableFS.RemoveAll(ctx, name)
+	}
+
+	if snapshotName == "" || rest != "/" {
+		return os.ErrPermission
+	}
+	return this.snapshots.remove(snapshotName)
+}
+
+func (this snapshotFS) Rename(ctx context.Context, oldName, newName string) error {
+
+	_, _, oldOK := splitSnapshotName(this.path, oldName)
+	_, _, newOK := splitSnapshotName(this.path, newName)
+	if oldOK || newOK {
+		return os.ErrPermission
+	}
+	return this.archivableFS.Rename(ctx, oldName, newName)
+}
+
+func (this snapshotFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+
+	f, err := this.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Stat()
+}
+
+// a directory of every snapshot, named as they are.
+func (this snapshotFS) listing() (webdav.File, error) {
+
+	err := os.MkdirAll(this.snapshots.dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	listing, err := os.Open(this.snapshots.dir)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotListing{File: listing, dir: this.snapshots.dir}, nil
+}
+
+/*
+	Lists snapshot directories in place of the state dir they're kept in,
+	with each snapshot looking like the directory it was taken of.
+*/
+type snapshotListing struct {
+	*os.File
+	dir string
+}
+
+func (this *snapshotListing) Readdir(count int) ([]os.FileInfo, error) {
+
+	children, err := this.File.Readdir(count)
+
+	var ret []os.FileInfo
+	for _, child := range children {
+
+		info, statErr := os.Stat(filepath.Join(this.dir, child.Name(), snapshotTreeName))
+		if statErr != nil || !child.IsDir() {
+			continue
+		}
+		ret = append(ret, overrideFileInfo{wrapped: info, FixedName: child.Name()})
+	}
+	return ret, err
+}
+
+func (this *snapshotListing) Stat() (os.FileInfo, error) {
+
+	info, err := this.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return overrideFileInfo{wrapped: info, FixedName: strings.TrimPrefix(snapshotsPrefix, "/")}, nil
+}
+
+func (this *snapshotListing) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+/*
+	Splits a name under `/.snapshots` into the snapshot's name and the path within it.
+	Returns false if the name isn't under `/.snapshots` at all, and an empty snapshot name for `/.snapshots` itself.
+*/
+func splitSnapshotName(root string, name string) (string, string, bool) {
+
+	name = slashClean(name)
+	if !isReservedPath(root, name, snapshotsPrefix) {
+		return "", "", false
+	}
+	if name == snapshotsPrefix {
+		return "", "/", true
+	}
+	if !strings.HasPrefix(name, snapshotsPrefix + "/") {
+		return "", "", false
+	}
+
+	rest := strings.TrimPrefix(name, snapshotsPrefix + "/")
+	idx := strings.IndexByte(rest, '/')
+	if idx < 0 {
+		return rest, "/", true
+	}
+	return rest[:idx], rest[idx:], true
+}
+
+//
+
+/*
+	Recreates the tree at [from] under [to], cloning files rather than copying them wherever possible.
+*/
+func cloneTree(from string, to string) error {
+
+	return filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, relative)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm() | 0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		err = cloneFile(path, target)
+		if err == nil {
+			os.Chmod(target, info.Mode().Perm())
+		} else {
+			err = copyFile(path, target, info.Mode().Perm())
+		}
+		if err != nil {
+			return err
+		}
+
+		copyPropertiesXattr(path, target)
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+}
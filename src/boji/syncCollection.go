@@ -0,0 +1,447 @@
+package boji
+
+import (
+	"os"
+	"fmt"
+	"path"
+	"sort"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+	"context"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"encoding/xml"
+	"golang.org/x/net/webdav"
+)
+
+const syncTokenPrefix = "urn:boji:sync:"
+
+var syncTokenName = xml.Name{Space: "DAV:", Local: "sync-token"}
+var supportedReportSetName = xml.Name{Space: "DAV:", Local: "supported-report-set"}
+
+var errInvalidSyncToken = errors.New("Invalid sync token")
+
+/*
+	The body of a sync-collection REPORT (RFC 6578).
+*/
+type syncCollectionRequest struct {
+	XMLName xml.Name `xml:"DAV: sync-collection"`
+	SyncToken string `xml:"DAV: sync-token"`
+	SyncLevel string `xml:"DAV: sync-level"`
+	Limit int `xml:"DAV: limit>nresults"`
+	Prop propNames `xml:"DAV: prop"`
+}
+
+// the names of every child of a DAV:prop element.
+type propNames []xml.Name
+
+func (this *propNames) UnmarshalXML(decoder *xml.Decoder, start xml.StartElement) error {
+
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			*this = append(*this, element.Name)
+			err = decoder.Skip()
+			if err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+/*
+	Handles a sync-collection REPORT, returning true if this was one. Other REPORTs are left to webdav, which refuses them.
+
+	With an empty sync token, every member of the collection is returned, along with a token for the state of things now.
+	With a token from an earlier REPORT (or from the collection's DAV:sync-token property), only members that have been
+	created, changed or removed since are returned - worked out from the change journal, rather than by walking the tree.
+*/
+func (this *Server) attemptSyncReport(w http.ResponseWriter, r *http.Request) bool {
+
+	if r.Method != "REPORT" {
+		return false
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	// some other kind of REPORT gets its body back, untouched.
+	if reportName(body) != (xml.Name{Space: "DAV:", Local: "sync-collection"}) {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return false
+	}
+
+	var request syncCollectionRequest
+	err = xml.Unmarshal(body, &request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	_, _, isSnapshot := splitSnapshotName(this.Settings.Root, r.URL.Path)
+	if isSnapshot {
+		http.Error(w, "Snapshots never change", http.StatusForbidden)
+		return true
+	}
+
+	ctx := r.Context()
+	collection := slashClean(r.URL.Path)
+
+	info, err := this.fs.Stat(ctx, collection)
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	if !info.IsDir() {
+		http.Error(w, "Only collections can be synced", http.StatusForbidden)
+		return true
+	}
+
+	infinite := request.SyncLevel == "infinite" || request.SyncLevel == "infinity"
+	if !infinite && request.SyncLevel != "1" {
+		http.Error(w, "sync-level must be 1 or infinite", http.StatusBadRequest)
+		return true
+	}
+
+	if len(request.Prop) == 0 {
+		request.Prop = propNames{{Space: "DAV:", Local: "getetag"}}
+	}
+
+	// anything that changes while the members are being looked at will be given again next time.
+	token := this.fs.changes.cursor()
+
+	var members []string
+	var gone map[string]bool
+
+	if request.SyncToken == "" {
+		members = this.syncMembers(ctx, collection, infinite)
+	} else {
+		members, gone, err = this.syncChanges(ctx, collection, request.SyncToken, infinite)
+		if err != nil {
+			writeDAVError(w, http.StatusForbidden, "valid-sync-token")
+			return true
+		}
+	}
+
+	if request.Limit > 0 && len(members) > request.Limit {
+		writeDAVError(w, http.StatusInsufficientStorage, "number-of-matches-within-limits")
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	for _, member := range members {
+		if gone[member] {
+			fmt.Fprintf(w, "<D:response><D:href>%s</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response>", escapeXML(memberHref(member, false)))
+			continue
+		}
+		this.writeMemberProps(ctx, w, member, request.Prop, nil)
+	}
+	fmt.Fprintf(w, "<D:sync-token>%s%d</D:sync-token></D:multistatus>", syncTokenPrefix, token)
+	return true
+}
+
+/*
+	Every member of a collection; its children, or all of its descendants if [infinite].
+*/
+func (this *Server) syncMembers(ctx context.Context, collection string, infinite bool) []string {
+
+	var ret []string
+
+	file, err := this.fs.OpenFile(ctx, collection, os.O_RDONLY, 0)
+	if err != nil {
+		return ret
+	}
+
+	children, _ := file.Readdir(-1)
+	file.Close()
+
+	for _, child := range children {
+
+		name := path.Join(collection, child.Name())
+		ret = append(ret, name)
+
+		if infinite && child.IsDir() {
+			ret = append(ret, this.syncMembers(ctx, name, true)...)
+		}
+	}
+	return ret
+}
+
+/*
+	Every member of a collection that's changed since the given token, in the order they were last changed.
+	Members which no longer exist are marked as gone.
+*/
+func (this *Server) syncChanges(ctx context.Context, collection string, syncToken string, infinite bool) ([]string, map[string]bool, error) {
+
+	if !strings.HasPrefix(syncToken, syncTokenPrefix) {
+		return nil, nil, errInvalidSyncToken
+	}
+
+	cursor, err := strconv.ParseInt(strings.TrimPrefix(syncToken, syncTokenPrefix), 10, 64)
+	if err != nil {
+		return nil, nil, errInvalidSyncToken
+	}
+
+	feed := this.fs.changes
+	feed.mutex.Lock()
+	events, ok := feed.since(cursor)
+	feed.mutex.Unlock()
+
+	if !ok {
+		return nil, nil, errInvalidSyncToken
+	}
+
+	inScope := func(name string) bool {
+		if infinite {
+			return strings.HasPrefix(name, strings.TrimSuffix(collection, "/") + "/")
+		}
+		return path.Dir(name) == collection
+	}
+
+	// each member's position is that of the last change to it.
+	changed := make(map[string]int64)
+	touch := func(name string, id int64) {
+		if inScope(name) {
+			changed[name] = id
+		}
+	}
+
+	for _, event := range events {
+
+		touch(event.Path, event.ID)
+		if event.Destination != "" {
+			touch(event.Destination, event.ID)
+		}
+
+		// a directory that arrives (or is rewritten by compression or encryption) changes everything in it.
+		if !event.Directory || event.Type == "delete" {
+			continue
+		}
+
+		target := event.Path
+		if event.Destination != "" {
+			target = event.Destination
+		}
+
+		// ...including the collection itself, if it was one of the things in it.
+		if strings.HasPrefix(collection, strings.TrimSuffix(target, "/") + "/") {
+			target = collection
+		}
+
+		if target == collection || inScope(target) {
+			for _, member := range this.syncMembers(ctx, target, infinite) {
+				touch(member, event.ID)
+			}
+		}
+	}
+
+	members := make([]string, 0, len(changed))
+	for member := range changed {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		if changed[members[i]] == changed[members[j]] {
+			return members[i] < members[j]
+		}
+		return changed[members[i]] < changed[members[j]]
+	})
+
+	gone := make(map[string]bool)
+	for _, member := range members {
+		_, err := this.fs.Stat(ctx, member)
+		if err != nil && !existsOnDisk(this.fs.resolve(member)) {
+			gone[member] = true
+		}
+	}
+	return members, gone, nil
+}
+
+/*
+	Writes a DAV:response for a member that exists, with each requested property that it has.
+	Any extra properties given, like the contents of a contact or event, are used over what's stored or worked out.
+*/
+func (this *Server) writeMemberProps(ctx context.Context, w http.ResponseWriter, name string, props propNames, extra map[xml.Name]string) {
+
+	var found []string
+	var missing []string
+
+	info, err := this.fs.statListed(ctx, name)
+	if err != nil {
+		return
+	}
+
+	var dead map[xml.Name]webdav.Property
+	file, err := this.fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err == nil {
+		holder, ok := file.(webdav.DeadPropsHolder)
+		if ok {
+			dead, _ = holder.DeadProps()
+		}
+		file.Close()
+	}
+
+	for _, prop := range props {
+
+		value, ok := extra[prop]
+		if !ok {
+			deadProp, isDead := dead[prop]
+			value, ok = string(deadProp.InnerXML), isDead
+		}
+		if !ok {
+			value, ok = liveProperty(ctx, name, info, prop)
+		}
+
+		element := fmt.Sprintf(`<%s xmlns="%s">`, prop.Local, escapeXML(prop.Space))
+		if ok {
+			found = append(found, element + value + "</" + prop.Local + ">")
+		} else {
+			missing = append(missing, fmt.Sprintf(`<%s xmlns="%s"/>`, prop.Local, escapeXML(prop.Space)))
+		}
+	}
+
+	fmt.Fprintf(w, "<D:response><D:href>%s</D:href>", escapeXML(memberHref(name, info.IsDir())))
+	if len(found) > 0 {
+		fmt.Fprintf(w, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>", strings.Join(found, ""))
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>", strings.Join(missing, ""))
+	}
+	fmt.Fprint(w, "</D:response>")
+}
+
+/*
+	The value of one of the live properties webdav would give in a PROPFIND, as inner XML.
+	Returns false if it isn't one, or this member doesn't have it.
+*/
+func liveProperty(ctx context.Context, name string, info os.FileInfo, prop xml.Name) (string, bool) {
+
+	if prop.Space != "DAV:" {
+		return "", false
+	}
+
+	switch prop.Local {
+	case "resourcetype":
+		if info.IsDir() {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		return escapeXML(path.Base(name)), true
+	case "getlastmodified":
+		return info.ModTime().UTC().Format(http.TimeFormat), true
+	case "getcontentlength":
+		if info.IsDir() {
+			return "", false
+		}
+		return strconv.FormatInt(info.Size(), 10), true
+	case "getcontenttype":
+		if info.IsDir() {
+			return "", false
+		}
+		typer, ok := info.(webdav.ContentTyper)
+		if !ok {
+			return "", false
+		}
+		contentType, err := typer.ContentType(ctx)
+		if err != nil {
+			return "", false
+		}
+		return escapeXML(contentType), true
+	case "getetag":
+		if info.IsDir() {
+			return "", false
+		}
+		etagger, ok := info.(webdav.ETager)
+		if !ok {
+			return "", false
+		}
+		etag, err := etagger.ETag(ctx)
+		if err != nil {
+			return "", false
+		}
+		return escapeXML(etag), true
+	}
+	return "", false
+}
+
+/*
+	The live properties boji adds to every collection, so that clients know they can sync it, and what its sync token is now.
+*/
+func (this *changeFeed) properties() map[xml.Name]webdav.Property {
+
+	if this == nil {
+		return nil
+	}
+
+	return map[xml.Name]webdav.Property {
+		syncTokenName: webdav.Property {
+			XMLName: syncTokenName,
+			InnerXML: []byte(syncTokenPrefix + strconv.FormatInt(this.cursor(), 10)),
+		},
+		supportedReportSetName: webdav.Property {
+			XMLName: supportedReportSetName,
+			InnerXML: []byte(`<D:supported-report xmlns:D="DAV:"><D:report><D:sync-collection/></D:report></D:supported-report>`),
+		},
+	}
+}
+
+func isSyncProperty(name xml.Name) bool {
+	return name == syncTokenName || name == supportedReportSetName
+}
+
+// responds with a DAV:error body naming the precondition that failed.
+func writeDAVError(w http.ResponseWriter, status int, precondition string) {
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:error xmlns:D="DAV:"><D:%s/></D:error>`, precondition)
+}
+
+func memberHref(name string, dir bool) string {
+
+	href := (&url.URL{Path: name}).EscapedPath()
+	if dir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+func escapeXML(value string) string {
+
+	var buffer bytes.Buffer
+	xml.EscapeText(&buffer, []byte(value))
+	return buffer.String()
+}
+
+// the name of the root element of a REPORT body, which says what kind of report it is.
+func reportName(body []byte) xml.Name {
+
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return xml.Name{}
+		}
+
+		start, ok := token.(xml.StartElement)
+		if ok {
+			return start.Name
+		}
+	}
+}
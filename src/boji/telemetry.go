@@ -2,6 +2,7 @@ package boji
 
 import (
 	"context"
+	"sync"
 	"time"
 	"github.com/influxdata/influxdb-client-go"
 )
@@ -12,6 +13,7 @@ type telemetry struct {
 	active bool
 	
 	Bucket string
+	mutex sync.Mutex
 }
 
 type telemetryStats struct {
@@ -24,6 +26,15 @@ type telemetryStats struct {
 	bytesWritten int64
 	bytesRead int64
 	failedAuths int
+	checksumFailures int
+	uploadsCompleted int
+	filesReplicated int
+	replicationFailures int
+	webhooksDelivered int
+	webhookFailures int
+
+	locksCreated int
+	locksReleased int
 }
 
 func newTelemetry(url string, bucket string) *telemetry {
@@ -42,11 +53,33 @@ func newTelemetry(url string, bucket string) *telemetry {
 	}
 }
 
+/*
+	Sends telemetry somewhere else from now on, or nowhere, if [url] is empty.
+*/
+func (this *telemetry) retarget(url string, bucket string) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.client != nil {
+		this.client.Close()
+		this.client = nil
+	}
+	if url != "" {
+		this.client = influxdb2.NewClient(url, "")
+	}
+	this.active = url != ""
+	this.Bucket = bucket
+}
+
 func (this *telemetry) publish() error {
 
 	snapshot := this.stats
 	this.stats = telemetryStats{}
 
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
 	if this.client == nil {
 		return nil
 	}
@@ -63,6 +96,14 @@ func (this *telemetry) publish() error {
 			"bytesWritten": snapshot.bytesWritten,
 			"bytesRead": snapshot.bytesRead,
 			"failedAuths": snapshot.failedAuths,
+			"checksumFailures": snapshot.checksumFailures,
+			"uploadsCompleted": snapshot.uploadsCompleted,
+			"filesReplicated": snapshot.filesReplicated,
+			"replicationFailures": snapshot.replicationFailures,
+			"webhooksDelivered": snapshot.webhooksDelivered,
+			"webhookFailures": snapshot.webhookFailures,
+			"locksCreated": snapshot.locksCreated,
+			"locksReleased": snapshot.locksReleased,
 		},
 		time.Now(),
 	)
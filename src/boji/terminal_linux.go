@@ -0,0 +1,28 @@
+package boji
+
+import (
+	"unsafe"
+	"syscall"
+)
+
+// stops a terminal from showing what's typed into it, returning a func that puts it back how it was.
+func disableEcho(fd uintptr) (func(), error) {
+
+	var state syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&state)))
+	if errno != 0 {
+		return nil, errno
+	}
+
+	quiet := state
+	quiet.Lflag &^= syscall.ECHO
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&quiet)))
+	if errno != 0 {
+		return nil, errno
+	}
+
+	return func() {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(&state)))
+	}, nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package boji
+
+import (
+	"errors"
+)
+
+// terminals aren't portable, everywhere else shows keys as they're typed.
+func disableEcho(fd uintptr) (func(), error) {
+	return nil, errors.New("hiding input is not supported on this platform")
+}
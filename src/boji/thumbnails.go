@@ -0,0 +1,385 @@
+package boji
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"image"
+	"strconv"
+	"strings"
+	"net/http"
+	"io/ioutil"
+	"image/png"
+	"image/jpeg"
+	"image/draw"
+	"image/color"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"golang.org/x/net/webdav"
+
+	_ "image/gif"
+)
+
+const thumbnailParameter = "thumb"
+const thumbnailDefaultSize = 256
+const thumbnailMaxSize = 2048
+
+// thumbnails that haven't been asked for in this long are deleted.
+const thumbnailRetention = 30 * 24 * time.Hour
+
+// bigger than nearly any phone photo, but small enough that decoding one won't run boji out of memory.
+const thumbnailMaxBytes = 100 << 20
+const thumbnailMaxPixels = 50000000
+
+// how many thumbnails are made at once, however many CPUs there are.
+const thumbnailWorkers = 2
+
+// at most this many pixels along each side of a block are averaged into one pixel of a thumbnail.
+const thumbnailSamples = 4
+
+var errNotAnImage = errors.New("Not a JPEG, PNG or GIF image")
+var errImageTooLarge = errors.New("Image is too large to make a thumbnail of")
+
+/*
+	Small previews of images, made on request and cached in the state dir - keyed by the image's ETag,
+	so that a thumbnail is never stale, and identical images share one.
+
+	Thumbnails of encrypted images would be plaintext copies of them, so they're never cached; they're made every time.
+*/
+type thumbnailCache struct {
+	dir string
+
+	// decoding a photo takes a lot of memory, so only so many are done at once.
+	working chan bool
+}
+
+func newThumbnailCache(stateDir string) *thumbnailCache {
+
+	return &thumbnailCache {
+		dir: filepath.Join(stateDir, "thumbnails"),
+		working: make(chan bool, thumbnailWorkers),
+	}
+}
+
+func (this *thumbnailCache) path(etag string, size int) string {
+
+	hash := sha256.Sum256([]byte(etag))
+	return filepath.Join(this.dir, fmt.Sprintf("%s-%d", hex.EncodeToString(hash[:16]), size))
+}
+
+// returns a cached thumbnail and its content type, if there is one.
+func (this *thumbnailCache) get(etag string, size int) ([]byte, string, bool) {
+
+	path := this.path(etag, size)
+	for _, kind := range []string{"image/jpeg", "image/png"} {
+
+		name := path + thumbnailExtension(kind)
+		contents, err := ioutil.ReadFile(name)
+		if err == nil {
+			// remembers that it's still wanted.
+			now := time.Now()
+			os.Chtimes(name, now, now)
+			return contents, kind, true
+		}
+	}
+	return nil, "", false
+}
+
+func (this *thumbnailCache) put(etag string, size int, contents []byte, kind string) {
+
+	err := os.MkdirAll(this.dir, 0700)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to cache thumbnail: %v\n", err)
+		return
+	}
+
+	path := this.path(etag, size) + thumbnailExtension(kind)
+	tempPath := path + "~"
+
+	err = ioutil.WriteFile(tempPath, contents, 0600)
+	if err == nil {
+		err = os.Rename(tempPath, path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to cache thumbnail: %v\n", err)
+	}
+}
+
+// deletes thumbnails that haven't been asked for in a while.
+func (this *thumbnailCache) expire() {
+
+	entries, err := ioutil.ReadDir(this.dir)
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-thumbnailRetention)
+	for _, entry := range entries {
+		if entry.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(this.dir, entry.Name()))
+		}
+	}
+}
+
+func thumbnailExtension(kind string) string {
+	if kind == "image/png" {
+		return ".png"
+	}
+	return ".jpg"
+}
+
+//
+
+/*
+	Handles `GET <file>?thumb=<size>`, returning true if this was one.
+	Gives a thumbnail of an image no larger than [size] in either direction (256 if it isn't given), turned the right way up.
+	Works for anything webdav can read - images inside archives, in snapshots, and encrypted ones (with the key).
+*/
+func (this *Server) attemptThumbnailRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	value, ok := r.URL.Query()[thumbnailParameter]
+	if !ok || (r.Method != "GET" && r.Method != "HEAD") {
+		return false
+	}
+
+	size := thumbnailDefaultSize
+	if len(value) > 0 && value[0] != "" {
+		parsed, err := strconv.Atoi(value[0])
+		if err != nil || parsed < 16 || parsed > thumbnailMaxSize {
+			http.Error(w, fmt.Sprintf("Invalid thumb, expected a size from 16 to %d", thumbnailMaxSize), http.StatusBadRequest)
+			return true
+		}
+		size = parsed
+	}
+
+	ctx := r.Context()
+	file, err := this.wdav.FileSystem.OpenFile(ctx, r.URL.Path, os.O_RDONLY, 0)
+	if err != nil {
+		http.NotFound(w, r)
+		return true
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, errNotAnImage.Error(), http.StatusUnsupportedMediaType)
+		return true
+	}
+
+	served, ok := file.(*servedFile)
+	encrypted := ok && served.isEncrypted()
+
+	// thumbnails of the same content are the same, so they're keyed - and tagged - by the image's own ETag.
+	etag := ""
+	etagger, ok := info.(webdav.ETager)
+	if ok && !encrypted {
+		etag, _ = etagger.ETag(ctx)
+	}
+
+	var contents []byte
+	var kind string
+	cached := false
+
+	if etag != "" {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-thumb%d"`, strings.Trim(etag, `"`), size))
+		contents, kind, cached = this.thumbnails.get(etag, size)
+	}
+
+	if !cached {
+		this.thumbnails.working <- true
+		contents, kind, err = makeThumbnail(file, size)
+		<-this.thumbnails.working
+
+		switch {
+		case err == errNotAnImage:
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return true
+		case err == errImageTooLarge:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return true
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+
+		if etag != "" {
+			this.thumbnails.put(etag, size, contents, kind)
+		}
+	}
+
+	if encrypted {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	}
+	w.Header().Set("Content-Type", kind)
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(contents))
+	return true
+}
+
+/*
+	Decodes an image, scales it down to fit within [size] square, and turns it the way its EXIF data says it should be.
+	Returns the thumbnail as a JPEG, or as a PNG if it has any transparency.
+*/
+func makeThumbnail(reader io.Reader, size int) ([]byte, string, error) {
+
+	contents, err := ioutil.ReadAll(io.LimitReader(reader, thumbnailMaxBytes + 1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(contents) > thumbnailMaxBytes {
+		return nil, "", errImageTooLarge
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(contents))
+	if err != nil || (format != "jpeg" && format != "png" && format != "gif") {
+		return nil, "", errNotAnImage
+	}
+	if config.Width * config.Height > thumbnailMaxPixels {
+		return nil, "", errImageTooLarge
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(contents))
+	if err != nil {
+		return nil, "", err
+	}
+
+	thumbnail := scaleImage(decoded, size)
+	if format == "jpeg" {
+		exif, err := readExif(contents)
+		if err == nil {
+			thumbnail = orientImage(thumbnail, exif.Orientation)
+		}
+	}
+
+	var buffer bytes.Buffer
+	if thumbnail.Opaque() {
+		err = jpeg.Encode(&buffer, thumbnail, &jpeg.Options{Quality: 85})
+		return buffer.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buffer, thumbnail)
+	return buffer.Bytes(), "image/png", err
+}
+
+/*
+	Scales an image down to fit within [size] square, keeping its shape, by averaging a few pixels from each block
+	that becomes one. Images that already fit are left as they are.
+	Pixels are read straight from the decoded image, which is never copied at full size.
+*/
+func scaleImage(src image.Image, size int) *image.RGBA {
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width <= size && height <= size {
+		full := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(full, full.Bounds(), src, bounds.Min, draw.Src)
+		return full
+	}
+
+	scaledWidth, scaledHeight := size, size
+	if width > height {
+		scaledHeight = maxInt(1, height * size / width)
+	} else {
+		scaledWidth = maxInt(1, width * size / height)
+	}
+
+	// JPEGs decode to YCbCr, which is much quicker to read directly than through a color.Color per pixel.
+	ycbcr, _ := src.(*image.YCbCr)
+
+	scaled := image.NewRGBA(image.Rect(0, 0, scaledWidth, scaledHeight))
+	for y := 0; y < scaledHeight; y++ {
+
+		top := y * height / scaledHeight
+		bottom := maxInt(top + 1, (y + 1) * height / scaledHeight)
+		rowStep := maxInt(1, (bottom - top) / thumbnailSamples)
+
+		for x := 0; x < scaledWidth; x++ {
+
+			left := x * width / scaledWidth
+			right := maxInt(left + 1, (x + 1) * width / scaledWidth)
+			columnStep := maxInt(1, (right - left) / thumbnailSamples)
+
+			var sums [4]int
+			count := 0
+			for row := top; row < bottom; row += rowStep {
+				for column := left; column < right; column += columnStep {
+					pixel := samplePixel(src, ycbcr, bounds.Min.X + column, bounds.Min.Y + row)
+					for i := 0; i < 4; i++ {
+						sums[i] += int(pixel[i])
+					}
+					count++
+				}
+			}
+
+			offset := y * scaled.Stride + x * 4
+			for i := 0; i < 4; i++ {
+				scaled.Pix[offset + i] = uint8(sums[i] / count)
+			}
+		}
+	}
+	return scaled
+}
+
+// a single pixel of the image, as premultiplied RGBA - which is how image.RGBA keeps them.
+func samplePixel(src image.Image, ycbcr *image.YCbCr, x int, y int) [4]uint8 {
+
+	if ycbcr != nil {
+		pixel := ycbcr.YCbCrAt(x, y)
+		r, g, b := color.YCbCrToRGB(pixel.Y, pixel.Cb, pixel.Cr)
+		return [4]uint8{r, g, b, 255}
+	}
+
+	r, g, b, a := src.At(x, y).RGBA()
+	return [4]uint8{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}
+}
+
+/*
+	Turns an image the right way up, given its EXIF orientation: 2 to 4 are mirrored or upside down,
+	5 to 8 are on their side (and come out with their width and height swapped).
+*/
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+
+			var srcX, srcY int
+			switch orientation {
+			case 2: srcX, srcY = width - 1 - x, y
+			case 3: srcX, srcY = width - 1 - x, height - 1 - y
+			case 4: srcX, srcY = x, height - 1 - y
+			case 5: srcX, srcY = y, x
+			case 6: srcX, srcY = y, height - 1 - x
+			case 7: srcX, srcY = width - 1 - y, height - 1 - x
+			case 8: srcX, srcY = width - 1 - y, x
+			}
+
+			from := srcY * src.Stride + srcX * 4
+			to := y * dst.Stride + x * 4
+			copy(dst.Pix[to:to+4], src.Pix[from:from+4])
+		}
+	}
+	return dst
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
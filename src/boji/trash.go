@@ -0,0 +1,655 @@
+package boji
+
+import (
+	"os"
+	"io"
+	"sort"
+	"time"
+	"errors"
+	"strings"
+	"context"
+	"net/url"
+	"net/http"
+	"path/filepath"
+	"io/ioutil"
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"golang.org/x/net/webdav"
+)
+
+const trashPrefix = "/_trash/"
+const trashItemName = "item.json"
+const trashDataName = "data"
+const trashPropsName = "props"
+
+var errTrashConflict = errors.New("Something already exists where the item would be restored")
+
+/*
+	Deleted items aren't removed, they're moved into a trash bin in the state dir,
+	where they can be listed and restored over HTTP until they're purged after the retention period.
+
+	Each item belongs to whoever deleted it, and only they can see, restore or purge it.
+	Items are kept exactly as they were on disk - encrypted files stay encrypted, and directories keep whatever
+	archives and encrypted files they held. Archive members are extracted from their archive when they're deleted,
+	and go back into it (or whatever archive is there at the time) when they're restored.
+*/
+type trashBin struct {
+	dir string
+	retention time.Duration
+	fs archivableFS
+}
+
+// what's recorded about each item in the trash, next to its data.
+type trashedItem struct {
+	ID string `json:"id"`
+	Owner string `json:"owner,omitempty"`
+	Origin string `json:"origin"`
+	Deleted time.Time `json:"deleted"`
+	Size int64 `json:"size"`
+	Dir bool `json:"dir,omitempty"`
+	Encrypted bool `json:"encrypted,omitempty"`
+	Archived bool `json:"archived,omitempty"`
+	Props []webdav.Property `json:"props,omitempty"`
+}
+
+func newTrashBin(stateDir string, retentionDays int) *trashBin {
+
+	if retentionDays <= 0 {
+		return nil
+	}
+
+	return &trashBin {
+		dir: filepath.Join(stateDir, "trash"),
+		retention: time.Duration(retentionDays) * 24 * time.Hour,
+	}
+}
+
+/*
+	Moves whatever is at the given name into [owner]'s trash.
+*/
+func (this *trashBin) put(name string, owner string) error {
+	return this.putItem(name, owner, false)
+}
+
+/*
+	Moves exactly the file or directory on disk at the given name into [owner]'s trash,
+	without looking for an archive member or encrypted file of that name.
+*/
+func (this *trashBin) putRaw(name string, owner string) error {
+	return this.putItem(name, owner, true)
+}
+
+func (this *trashBin) putItem(name string, owner string, raw bool) error {
+
+	// the whole tree can't be deleted, trash or no trash.
+	if slashClean(name) == "/" {
+		return os.ErrPermission
+	}
+
+	path := this.fs.resolve(name)
+	if path == "" {
+		return errors.New("Unable to resolve local file")
+	}
+
+	id, err := newTrashID()
+	if err != nil {
+		return err
+	}
+
+	item := trashedItem {
+		ID: id,
+		Owner: owner,
+		Origin: slashClean(name),
+		Deleted: time.Now(),
+	}
+
+	props, err := this.fs.props.load(path)
+	if err != nil {
+		return err
+	}
+	item.Props = propertyList(props)
+
+	itemDir := filepath.Join(this.dir, id)
+	err = os.MkdirAll(itemDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	if raw {
+		err = this.takeRaw(path, itemDir, &item)
+	} else {
+		err = this.take(path, itemDir, &item)
+	}
+	if err != nil {
+		os.RemoveAll(itemDir)
+		return err
+	}
+
+	// sidecar properties of the item and anything beneath it go along with it.
+	sidecar := this.fs.props.sidecarDir(path)
+	_, err = os.Stat(sidecar)
+	if err == nil {
+		moveAcross(sidecar, filepath.Join(itemDir, trashPropsName))
+	}
+
+	return this.save(item)
+}
+
+/*
+	Restores an item to where it came from, or to [destination] if that's given.
+	Refuses to overwrite anything that's already there.
+*/
+func (this *trashBin) restore(id string, destination string) (trashedItem, error) {
+
+	item, err := this.load(id)
+	if err != nil {
+		return item, err
+	}
+
+	if destination == "" {
+		destination = item.Origin
+	}
+	destination = slashClean(destination)
+
+	path := this.fs.resolve(destination)
+	if path == "" || destination == "/" {
+		return item, errors.New("Unable to resolve local file")
+	}
+
+	if existsOnDisk(path) {
+		return item, errTrashConflict
+	}
+
+	stat, err := os.Stat(filepath.Dir(path))
+	if err != nil || !stat.IsDir() {
+		return item, errTrashConflict
+	}
+
+	err = this.fs.quotas.check(destination, item.Size, false)
+	if err != nil {
+		return item, err
+	}
+
+	itemDir := filepath.Join(this.dir, id)
+	data := filepath.Join(itemDir, trashDataName)
+
+	_, err = os.Stat(filepath.Join(filepath.Dir(path), "archive.zip"))
+	intoArchive := err == nil && !item.Dir && !item.Encrypted
+
+	tracked := this.fs.quotas.track(destination)
+	defer tracked()
+
+	switch {
+	case intoArchive:
+		err = this.restoreIntoArchive(data, destination)
+	case item.Encrypted:
+		err = moveAcross(data, path + encryptedExtension)
+	default:
+		err = moveAcross(data, path)
+	}
+	if err != nil {
+		return item, err
+	}
+
+	sidecar := filepath.Join(itemDir, trashPropsName)
+	_, err = os.Stat(sidecar)
+	if err == nil {
+		target := this.fs.props.sidecarDir(path)
+		os.RemoveAll(target)
+		os.MkdirAll(filepath.Dir(target), 0700)
+		moveAcross(sidecar, target)
+	}
+
+	props := make(map[xml.Name]webdav.Property)
+	for _, prop := range item.Props {
+		props[prop.XMLName] = prop
+	}
+	this.fs.props.save(path, props)
+
+	this.fs.digests.remove(path)
+	return item, os.RemoveAll(itemDir)
+}
+
+// removes a single item from the trash for good.
+func (this *trashBin) purge(id string) error {
+
+	_, err := this.load(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(this.dir, id))
+}
+
+// removes every item that's been in the trash longer than the retention period. Used by maintenance.
+func (this *trashBin) expire() {
+
+	if this == nil {
+		return
+	}
+
+	items, err := this.list()
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-this.retention)
+	for _, item := range items {
+		if item.Deleted.Before(cutoff) {
+			os.RemoveAll(filepath.Join(this.dir, item.ID))
+		}
+	}
+}
+
+// every item in [owner]'s trash, most recently deleted first.
+func (this *trashBin) listFor(owner string, admin bool) ([]trashedItem, error) {
+
+	items, err := this.list()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []trashedItem{}
+	for _, item := range items {
+		if item.ownedBy(owner, admin) {
+			ret = append(ret, item)
+		}
+	}
+	return ret, nil
+}
+
+// an item from [owner]'s trash, as if nobody else's existed.
+func (this *trashBin) loadFor(id string, owner string, admin bool) (trashedItem, error) {
+
+	item, err := this.load(id)
+	if err == nil && !item.ownedBy(owner, admin) {
+		return trashedItem{}, os.ErrNotExist
+	}
+	return item, err
+}
+
+// items deleted before there was more than one user belong to the admin.
+func (this trashedItem) ownedBy(owner string, admin bool) bool {
+	return this.Owner == owner || (this.Owner == "" && admin)
+}
+
+// every item in the trash, whoever it belongs to, most recently deleted first.
+func (this *trashBin) list() ([]trashedItem, error) {
+
+	ret := []trashedItem{}
+
+	children, err := ioutil.ReadDir(this.dir)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+
+		item, err := this.load(child.Name())
+		if err != nil {
+			continue
+		}
+		ret = append(ret, item)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Deleted.After(ret[j].Deleted)
+	})
+	return ret, nil
+}
+
+/*
+	Handles any request for the trash itself, returning true if it was one.
+		`GET /_trash/` lists the items in the trash as JSON.
+		`POST /_trash/<id>` restores an item where it came from, or to the path in a `Destination` header.
+		`DELETE /_trash/<id>` purges an item immediately, and `DELETE /_trash/` empties the trash.
+*/
+func (this *Server) attemptTrashRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	if !isReservedPath(this.Settings.Root, r.URL.Path, trashPrefix) {
+		return false
+	}
+
+	if this.trash == nil {
+		http.Error(w, "The trash is disabled", http.StatusNotFound)
+		return true
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path + "/", trashPrefix), "/")
+	owner := requestUsername(r)
+	admin := owner == this.Settings.AdminUsername
+
+	switch {
+	case r.Method == "GET" && id == "":
+		items, err := this.trash.listFor(owner, admin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+
+		// properties are only kept for restoring, they'd just be noise here.
+		for i := range items {
+			items[i].Props = nil
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+
+	case r.Method == "DELETE" && id == "":
+		items, err := this.trash.listFor(owner, admin)
+		if err == nil {
+			for _, item := range items {
+				this.trash.purge(item.ID)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "DELETE" && isTrashID(id):
+		_, err := this.trash.loadFor(id, owner, admin)
+		if err == nil {
+			err = this.trash.purge(id)
+		}
+		if err != nil {
+			http.NotFound(w, r)
+			return true
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "POST" && isTrashID(id):
+		destination, err := trashDestination(r, this.Settings.Root)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+
+		item, err := this.trash.loadFor(id, owner, admin)
+		if err != nil {
+			http.NotFound(w, r)
+			return true
+		}
+		if destination == "" {
+			destination = item.Origin
+		}
+
+		release, err := this.locks.claimForWrite(destination, r.Header.Get("If"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return true
+		}
+		defer release()
+
+		_, err = this.trash.restore(id, destination)
+		switch {
+		case err == nil:
+			this.fs.changes.publish("create", destination, "", item.Dir)
+			w.Header().Set("Location", destination)
+			w.WriteHeader(http.StatusCreated)
+		case err == errTrashConflict:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case err == errQuotaExceeded:
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+	return true
+}
+
+//
+
+/*
+	Moves the item at [path] into [itemDir], filling in what kind of item it was.
+	Follows the same precedence as opening a file does; archive members, then encrypted files, then anything else.
+*/
+func (this *trashBin) take(path string, itemDir string, item *trashedItem) error {
+
+	filename := filepath.Base(path)
+	archive := filepath.Join(filepath.Dir(path), "archive.zip")
+	data := filepath.Join(itemDir, trashDataName)
+
+	zreader, err := zip.OpenReader(archive)
+	if err == nil {
+		for _, zfile := range zreader.File {
+			if zfile.Name != filename {
+				continue
+			}
+
+			err = extractFile(zreader, filename, data)
+			if err == nil {
+				os.Chtimes(data, zfile.Modified, zfile.Modified)
+				_, err = rewriteArchive(zreader, archive, "", "", filename, time.Time{})
+			}
+			zreader.Close()
+
+			item.Archived = true
+			item.Size = int64(zfile.CompressedSize64)
+			return err
+		}
+		zreader.Close()
+	}
+
+	stat, err := os.Lstat(path + encryptedExtension)
+	if err == nil {
+		item.Encrypted = true
+		item.Size = stat.Size()
+		return moveAcross(path + encryptedExtension, data)
+	}
+
+	return this.takeRaw(path, itemDir, item)
+}
+
+func (this *trashBin) takeRaw(path string, itemDir string, item *trashedItem) error {
+
+	data := filepath.Join(itemDir, trashDataName)
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	item.Dir = stat.IsDir()
+	item.Size = diskUsage(path)
+	return moveAcross(path, data)
+}
+
+// writes a plaintext file into the archive of the directory it's being restored to, keeping its modification time.
+func (this *trashBin) restoreIntoArchive(data string, destination string) error {
+
+	source, err := os.Open(data)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	file, err := this.fs.open(context.Background(), destination, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	setter, ok := file.(modTimeSetter)
+	if ok {
+		setter.SetModTime(stat.ModTime())
+	}
+
+	_, err = io.Copy(file, source)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (this *trashBin) load(id string) (trashedItem, error) {
+
+	var item trashedItem
+
+	if !isTrashID(id) {
+		return item, os.ErrNotExist
+	}
+
+	encoded, err := ioutil.ReadFile(filepath.Join(this.dir, id, trashItemName))
+	if err != nil {
+		return item, err
+	}
+	return item, json.Unmarshal(encoded, &item)
+}
+
+func (this *trashBin) save(item trashedItem) error {
+
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(this.dir, item.ID, trashItemName), encoded, 0600)
+}
+
+// the path to restore to from a `Destination` header, which may be a full URL (as in a webdav MOVE) or just a path.
+func trashDestination(r *http.Request, root string) (string, error) {
+
+	header := r.Header.Get("Destination")
+	if header == "" {
+		return "", nil
+	}
+
+	parsed, err := url.Parse(header)
+	if err != nil {
+		return "", errors.New("Invalid Destination header")
+	}
+	_, _, isSnapshot := splitSnapshotName(root, parsed.Path)
+	if isSnapshot || isReservedPath(root, parsed.Path, trashPrefix) || isReservedPath(root, parsed.Path, uploadsPrefix) {
+		return "", errors.New("Cannot restore into boji's own paths")
+	}
+	return slashClean(parsed.Path), nil
+}
+
+// whether anything is at the given path in any form - plain, encrypted, or archived - whether or not it could be read.
+func existsOnDisk(path string) bool {
+
+	_, err := os.Lstat(path)
+	if err == nil {
+		return true
+	}
+
+	_, err = os.Lstat(path + encryptedExtension)
+	if err == nil {
+		return true
+	}
+
+	zreader, err := zip.OpenReader(filepath.Join(filepath.Dir(path), "archive.zip"))
+	if err != nil {
+		return false
+	}
+	defer zreader.Close()
+
+	for _, zfile := range zreader.File {
+		if zfile.Name == filepath.Base(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func newTrashID() (string, error) {
+
+	raw := make([]byte, 16)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+func isTrashID(id string) bool {
+
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+/*
+	Moves a file or directory, even if the state dir is on a different filesystem to the served root.
+*/
+func moveAcross(from string, to string) error {
+
+	err := os.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+
+	// only worth copying if the source is still there to copy.
+	_, statErr := os.Lstat(from)
+	if statErr != nil {
+		return err
+	}
+
+	err = copyTree(from, to)
+	if err != nil {
+		os.RemoveAll(to)
+		return err
+	}
+	return os.RemoveAll(from)
+}
+
+func copyTree(from string, to string) error {
+
+	return filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+
+		if err != nil {
+			return err
+		}
+
+		relative, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, relative)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm() | 0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		err = copyFile(path, target, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+}
+
+func copyFile(from string, to string, perm os.FileMode) error {
+
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(to, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destination, source)
+	closeErr := destination.Close()
+	if err != nil {
+		return err
+	}
+
+	// xattr properties would otherwise be lost crossing filesystems.
+	copyPropertiesXattr(from, to)
+	return closeErr
+}
@@ -0,0 +1,65 @@
+package boji
+
+import (
+	"os"
+	"strings"
+	"net/http"
+	"path/filepath"
+)
+
+const uiPrefix = "/_ui/"
+
+/*
+	Serves the browser UI's own files, from the static dir, returning true if this was a request for one.
+	There's nothing secret in them, so they're served to anyone; the UI logs in for itself, which is where the key is given.
+*/
+func (this *Server) attemptUIRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	if !isReservedPath(this.Settings.Root, r.URL.Path, uiPrefix) {
+		return false
+	}
+	if r.URL.Path == strings.TrimSuffix(uiPrefix, "/") {
+		http.Redirect(w, r, uiPrefix, http.StatusMovedPermanently)
+		return true
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return true
+	}
+
+	_, err := os.Stat(filepath.Join(this.Settings.StaticDir, "index.html"))
+	if err != nil {
+		http.Error(w, "The web interface isn't installed", http.StatusNotFound)
+		return true
+	}
+
+	http.StripPrefix(uiPrefix, http.FileServer(http.Dir(this.Settings.StaticDir))).ServeHTTP(w, r)
+	return true
+}
+
+/*
+	Browsers asking for a directory get the UI, opened at that directory, rather than webdav's refusal.
+	Returns true if this was one of those.
+*/
+func (this *Server) attemptUIPage(w http.ResponseWriter, r *http.Request) bool {
+
+	if r.Method != "GET" || r.URL.RawQuery != "" || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return false
+	}
+
+	_, err := this.checkDir(r.URL.Path)
+	if err != nil {
+		return false
+	}
+
+	index := filepath.Join(this.Settings.StaticDir, "index.html")
+	_, err = os.Stat(index)
+	if err != nil {
+		return false
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeFile(w, r, index)
+	return true
+}
@@ -0,0 +1,711 @@
+package boji
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"context"
+	"net/http"
+	"path/filepath"
+	"io/ioutil"
+	"compress/gzip"
+	"encoding/json"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const versionRulesFileName = "versions.json"
+const compressedVersionExtension = ".gz"
+
+var errNoSuchVersion = errors.New("No such version")
+
+/*
+	Keeps previous versions of files whenever they're overwritten, under the state dir in a tree that mirrors the served one.
+	Each version is named for the time it was superseded, and keeps the modification time the content originally had.
+
+	Versions are always compressed. Versions of encrypted files stay encrypted - re-encrypted with compression using the key
+	of the request that overwrote them, or copied exactly as they were if that isn't possible.
+
+	How many versions are kept is decided by a rule, which is inherited from the nearest directory that has one
+	(or the default, if none do). See parseVersionRule.
+*/
+type versionStore struct {
+	root string
+	dir string
+	rulesPath string
+	defaultRule versionRule
+	fs archivableFS
+
+	rules map[string]string
+	mutex sync.Mutex
+}
+
+// a single kept version of a file, as listed to clients.
+type fileVersion struct {
+	ID string `json:"id"`
+	Modified time.Time `json:"modified"`
+	Superseded time.Time `json:"superseded"`
+	Size int64 `json:"size"`
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	path string
+}
+
+// how many versions to keep. A zero in either field means no limit of that kind, and both zero means versions aren't kept.
+type versionRule struct {
+	count int
+	age time.Duration
+}
+
+func newVersionStore(root string, stateDir string, defaultRule string) (*versionStore, error) {
+
+	rule, err := parseVersionRule(defaultRule)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &versionStore {
+		root: root,
+		dir: filepath.Join(stateDir, "versions"),
+		rulesPath: filepath.Join(stateDir, versionRulesFileName),
+		defaultRule: rule,
+		rules: make(map[string]string),
+	}
+
+	encoded, err := ioutil.ReadFile(ret.rulesPath)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(encoded, &ret.rules)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+	Keeps the current content of the given file as a version, if it exists and its directory keeps versions.
+	Called just before anything overwrites it. Gives back the ID of the version it kept, if it kept one.
+*/
+func (this *versionStore) capture(ctx context.Context, name string) (string, error) {
+
+	if this == nil {
+		return "", nil
+	}
+
+	name = slashClean(name)
+	rule := this.ruleFor(name)
+	if rule.disabled() {
+		return "", nil
+	}
+
+	path := this.fs.resolve(name)
+	if path == "" || !existsOnDisk(path) {
+		return "", nil
+	}
+
+	_, encryptedErr := os.Stat(path + encryptedExtension)
+	encrypted := encryptedErr == nil
+
+	superseded := time.Now()
+	versionDir := this.versionDir(path)
+	err := os.MkdirAll(versionDir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	id := strconv.FormatInt(superseded.UnixNano(), 10)
+	base := filepath.Join(versionDir, id)
+
+	if encrypted {
+		err = this.captureEncrypted(ctx, path + encryptedExtension, base + encryptedExtension)
+	} else {
+		err = this.captureCompressed(ctx, name, base + compressedVersionExtension)
+	}
+
+	if os.IsNotExist(err) {
+		os.Remove(versionDir)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	this.prune(path, rule)
+	return id, nil
+}
+
+// every kept version of the given file, newest first.
+func (this *versionStore) list(name string) ([]fileVersion, error) {
+
+	path := this.fs.resolve(name)
+	if path == "" {
+		return nil, errors.New("Unable to resolve local file")
+	}
+	return this.listAt(path)
+}
+
+func (this *versionStore) listAt(path string) ([]fileVersion, error) {
+
+	ret := []fileVersion{}
+
+	children, err := ioutil.ReadDir(this.versionDir(path))
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, child := range children {
+
+		filename := child.Name()
+		encrypted := strings.HasSuffix(filename, encryptedExtension)
+
+		id := strings.TrimSuffix(strings.TrimSuffix(filename, encryptedExtension), compressedVersionExtension)
+		nanos, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || child.IsDir() {
+			continue
+		}
+
+		ret = append(ret, fileVersion {
+			ID: id,
+			Modified: child.ModTime(),
+			Superseded: time.Unix(0, nanos),
+			Size: child.Size(),
+			Encrypted: encrypted,
+			path: filepath.Join(this.versionDir(path), filename),
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Superseded.After(ret[j].Superseded)
+	})
+	return ret, nil
+}
+
+/*
+	Writes the given version back over the file, through the filesystem - so the current content becomes a version itself,
+	and the result is compressed and/or encrypted like any other write.
+*/
+func (this *versionStore) restore(ctx context.Context, name string, id string) error {
+
+	versions, err := this.list(name)
+	if err != nil {
+		return err
+	}
+
+	var version *fileVersion
+	for i := range versions {
+		if versions[i].ID == id {
+			version = &versions[i]
+		}
+	}
+	if version == nil {
+		return errNoSuchVersion
+	}
+
+	key, _ := ctx.Value(contextEncryptionKey).([]byte)
+
+	// without a key, restoring would leave a plaintext copy beside the encrypted file.
+	_, err = os.Stat(this.fs.resolve(name) + encryptedExtension)
+	if (version.Encrypted || err == nil) && len(key) == 0 {
+		return errors.New("A key must be provided to restore a version of an encrypted file")
+	}
+
+	source, err := openVersion(*version, key)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	// restoring is itself an overwrite, and can be undone the same way.
+	_, err = this.capture(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	tracked := this.fs.quotas.track(name)
+	defer tracked()
+
+	file, err := this.fs.open(ctx, name, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	setter, ok := file.(modTimeSetter)
+	if ok {
+		setter.SetModTime(version.Modified)
+	}
+
+	_, err = io.Copy(file, source)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+
+	this.fs.digests.invalidate(this.fs.resolve(name))
+	return closeErr
+}
+
+// carries kept versions, and the rules of a moved directory, along when something is moved.
+func (this *versionStore) move(oldName string, newName string) {
+
+	if this == nil {
+		return
+	}
+
+	this.moveRules(slashClean(oldName), slashClean(newName))
+
+	newPath := this.fs.resolve(newName)
+	oldDir := this.versionDir(this.fs.resolve(oldName))
+	newDir := this.versionDir(newPath)
+
+	_, err := os.Stat(oldDir)
+	if err != nil {
+		return
+	}
+
+	_, err = os.Stat(newDir)
+	if os.IsNotExist(err) {
+		os.MkdirAll(filepath.Dir(newDir), 0700)
+		os.Rename(oldDir, newDir)
+		return
+	}
+
+	// moved over a file that has a history of its own (including what was just replaced), so the two are merged.
+	filepath.Walk(oldDir, func(path string, info os.FileInfo, err error) error {
+
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(oldDir, path)
+		if err != nil {
+			return nil
+		}
+
+		target := filepath.Join(newDir, relative)
+		os.MkdirAll(filepath.Dir(target), 0700)
+		os.Rename(path, target)
+		return nil
+	})
+	os.RemoveAll(oldDir)
+
+	this.prune(newPath, this.ruleFor(slashClean(newName)))
+}
+
+// drops every version kept of what was at the given name, so that nothing made there later inherits them.
+func (this *versionStore) forget(name string) {
+
+	if this == nil {
+		return
+	}
+
+	path := this.fs.resolve(name)
+	if path != "" && path != this.root {
+		os.RemoveAll(this.versionDir(path))
+	}
+}
+
+/*
+	Sets the retention rule for the given directory and everything beneath it, or "default" to go back to inheriting one.
+*/
+func (this *versionStore) setRule(name string, rule string) error {
+
+	name = slashClean(name)
+
+	if rule != "default" {
+		_, err := parseVersionRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if rule == "default" {
+		delete(this.rules, name)
+	} else {
+		this.rules[name] = rule
+	}
+	return this.saveRules()
+}
+
+// re-keys the rules of a moved directory and everything beneath it.
+func (this *versionStore) moveRules(oldName string, newName string) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	moved := false
+	for dir, rule := range this.rules {
+
+		if dir != oldName && !strings.HasPrefix(dir, oldName + "/") {
+			continue
+		}
+
+		delete(this.rules, dir)
+		this.rules[newName + strings.TrimPrefix(dir, oldName)] = rule
+		moved = true
+	}
+
+	if moved {
+		this.saveRules()
+	}
+}
+
+// must be called with the mutex held.
+func (this *versionStore) saveRules() error {
+
+	encoded, err := json.Marshal(this.rules)
+	if err != nil {
+		return err
+	}
+
+	tempPath := this.rulesPath + "~"
+	err = ioutil.WriteFile(tempPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, this.rulesPath)
+}
+
+// applies retention rules to every kept version, so that versions age out even for files which are never written again.
+func (this *versionStore) expire() {
+
+	if this == nil {
+		return
+	}
+
+	// each directory may hold the versions of the file at its own name, as well as the directories of files beneath it.
+	filepath.Walk(this.dir, func(versionDir string, info os.FileInfo, err error) error {
+
+		if err != nil || !info.IsDir() || versionDir == this.dir {
+			return nil
+		}
+
+		relative, err := filepath.Rel(this.dir, versionDir)
+		if err != nil {
+			return nil
+		}
+
+		name := "/" + filepath.ToSlash(relative)
+		path := this.fs.resolve(name)
+		rule := this.ruleFor(name)
+
+		// versions of a file that's gone (deleted directly on disk) are no longer of any use.
+		if !existsOnDisk(path) {
+			rule = versionRule{}
+		}
+
+		this.prune(path, rule)
+		return nil
+	})
+}
+
+//
+
+func (this *versionStore) captureCompressed(ctx context.Context, name string, versionPath string) error {
+
+	source, err := this.fs.open(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.IsDir() {
+		return os.ErrNotExist
+	}
+
+	destination, err := os.OpenFile(versionPath, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	compressor := gzip.NewWriter(destination)
+	_, err = io.Copy(compressor, source)
+	if err == nil {
+		err = compressor.Close()
+	}
+	closeErr := destination.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(versionPath)
+		return err
+	}
+
+	return os.Chtimes(versionPath, stat.ModTime(), stat.ModTime())
+}
+
+/*
+	Re-encrypts the plaintext with compression if the request's key can read it,
+	otherwise the ciphertext is kept as it is - it's still encrypted, just not compressed.
+*/
+func (this *versionStore) captureEncrypted(ctx context.Context, encryptedPath string, versionPath string) error {
+
+	stat, err := os.Stat(encryptedPath)
+	if err != nil {
+		return err
+	}
+
+	key, _ := ctx.Value(contextEncryptionKey).([]byte)
+	if len(key) > 0 {
+		err = recompressEncrypted(encryptedPath, versionPath, key)
+	}
+	if len(key) == 0 || err != nil {
+		err = copyFile(encryptedPath, versionPath, 0600)
+	}
+	if err != nil {
+		os.Remove(versionPath)
+		return err
+	}
+
+	return os.Chtimes(versionPath, stat.ModTime(), stat.ModTime())
+}
+
+// removes whatever versions of the file at the given path the rule doesn't keep.
+func (this *versionStore) prune(path string, rule versionRule) {
+
+	versionDir := this.versionDir(path)
+
+	versions, err := this.listAt(path)
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-rule.age)
+	for i, version := range versions {
+
+		tooMany := rule.count > 0 && i >= rule.count
+		tooOld := rule.age > 0 && version.Superseded.Before(cutoff)
+
+		if rule.disabled() || tooMany || tooOld {
+			os.Remove(version.path)
+		}
+	}
+
+	// only succeeds once every version is gone.
+	os.Remove(versionDir)
+}
+
+// the rule of the nearest directory (including the file's own) which has one.
+func (this *versionStore) ruleFor(name string) versionRule {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for dir := name; ; dir = filepath.ToSlash(filepath.Dir(dir)) {
+
+		encoded, ok := this.rules[dir]
+		if ok {
+			rule, err := parseVersionRule(encoded)
+			if err == nil {
+				return rule
+			}
+		}
+
+		if dir == "/" || dir == "." {
+			break
+		}
+	}
+	return this.defaultRule
+}
+
+func (this *versionStore) versionDir(path string) string {
+
+	relative, err := filepath.Rel(this.root, path)
+	if err != nil {
+		relative = filepath.Base(path)
+	}
+	return filepath.Join(this.dir, relative)
+}
+
+func (this versionRule) disabled() bool {
+	return this.count <= 0 && this.age <= 0
+}
+
+/*
+	Parses a retention rule, which is a count of versions to keep ("10"), an age in days to keep them for ("30d"),
+	both ("10,30d" keeps at most ten, none older than thirty days), or "off".
+*/
+func parseVersionRule(rule string) (versionRule, error) {
+
+	var ret versionRule
+
+	rule = strings.ToLower(strings.TrimSpace(rule))
+	if rule == "" || rule == "off" {
+		return ret, nil
+	}
+
+	for _, part := range strings.Split(rule, ",") {
+
+		part = strings.TrimSpace(part)
+		days := strings.HasSuffix(part, "d")
+
+		value, err := strconv.Atoi(strings.TrimSuffix(part, "d"))
+		if err != nil || value < 0 {
+			return ret, fmt.Errorf("Invalid version rule '%s', expected something like 10, 30d, or 10,30d", rule)
+		}
+
+		if days {
+			ret.age = time.Duration(value) * 24 * time.Hour
+		} else {
+			ret.count = value
+		}
+	}
+	return ret, nil
+}
+
+// decrypts the given file, and encrypts it again with compression.
+func recompressEncrypted(encryptedPath string, versionPath string, key []byte) error {
+
+	source, err := os.Open(encryptedPath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	message, err := openpgp.ReadMessage(source, defaultEmptyKeyring, newNoPromptKey(key).prompt, nil)
+	if err != nil {
+		return err
+	}
+
+	destination, err := os.OpenFile(versionPath, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+
+	config := defaultPacketConfig()
+	config.DefaultCompressionAlgo = packet.CompressionZLIB
+	config.CompressionConfig = &packet.CompressionConfig{Level: packet.DefaultCompression}
+
+	plaintext, err := openpgp.SymmetricallyEncrypt(destination, key, nil, config)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(plaintext, message.UnverifiedBody)
+	if err != nil {
+		return err
+	}
+
+	// the signature check at the end of the message is what catches a wrong key.
+	err = plaintext.Close()
+	if err != nil {
+		return err
+	}
+	return destination.Close()
+}
+
+// opens the plaintext of a kept version.
+func openVersion(version fileVersion, key []byte) (io.ReadCloser, error) {
+
+	fd, err := os.Open(version.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !version.Encrypted {
+		reader, err := gzip.NewReader(fd)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		return versionReader{Reader: reader, fd: fd}, nil
+	}
+
+	message, err := openpgp.ReadMessage(fd, defaultEmptyKeyring, newNoPromptKey(key).prompt, nil)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return versionReader{Reader: message.UnverifiedBody, fd: fd}, nil
+}
+
+type versionReader struct {
+	io.Reader
+	fd *os.File
+}
+
+func (this versionReader) Close() error {
+	return this.fd.Close()
+}
+
+/*
+	Handles requests for a file's versions, returning true if this was one.
+		`GET /file?versions` lists the versions kept of a file as JSON.
+		`POST /file?restore=<id>` restores one of them.
+		`POST /dir?versions=<rule>` sets the retention rule for a directory.
+*/
+func (this *Server) attemptVersionRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	query := r.URL.Query()
+	_, isVersions := query["versions"]
+	_, isRestore := query["restore"]
+
+	switch {
+	case r.Method == "GET" && isVersions:
+		versions, err := this.versions.list(r.URL.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+
+	case r.Method == "POST" && isVersions:
+		_, err := this.checkDir(r.URL.Path)
+		if err == nil {
+			err = this.versions.setRule(r.URL.Path, query.Get("versions"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+
+	case r.Method == "POST" && isRestore:
+		release, err := this.locks.claimForWrite(slashClean(r.URL.Path), r.Header.Get("If"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return true
+		}
+		defer release()
+
+		err = this.versions.restore(r.Context(), r.URL.Path, query.Get("restore"))
+		switch {
+		case err == nil:
+			this.fs.changes.publish("modify", r.URL.Path, "", false)
+			key, _ := r.Context().Value(contextEncryptionKey).([]byte)
+			this.fs.fulltext.wrote(r.URL.Path, key)
+			w.WriteHeader(http.StatusNoContent)
+		case err == errNoSuchVersion:
+			http.NotFound(w, r)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+
+	default:
+		return false
+	}
+	return true
+}
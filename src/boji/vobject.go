@@ -0,0 +1,526 @@
+package boji
+
+import (
+	"time"
+	"bytes"
+	"errors"
+	"strings"
+	"strconv"
+)
+
+// no calendar needs more occurrences than this looked at to answer a query.
+const maxRecurrences = 10000
+
+var errInvalidVObject = errors.New("Not a valid vCard or iCalendar object")
+
+/*
+	A component of a vCard or iCalendar object, such as a VCARD, a VCALENDAR, or a VEVENT inside one.
+	Names are kept in upper case, since that's how they're compared.
+*/
+type vComponent struct {
+	Name string
+	Properties []vProperty
+	Children []*vComponent
+}
+
+type vProperty struct {
+	Name string
+	Params map[string][]string
+	Value string
+}
+
+/*
+	Parses a vCard (RFC 6350) or iCalendar (RFC 5545) object, which are both lines of `NAME;PARAM=value:value`,
+	folded onto continuation lines that start with a space, with BEGIN and END around each component.
+	Returns the outermost component.
+*/
+func parseVObject(data []byte) (*vComponent, error) {
+
+	var root *vComponent
+	var stack []*vComponent
+
+	// continuation lines start with a space or tab, which is dropped when they're put back together.
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	data = bytes.Replace(data, []byte("\n "), nil, -1)
+	data = bytes.Replace(data, []byte("\n\t"), nil, -1)
+
+	for _, line := range strings.Split(string(data), "\n") {
+
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		property, err := parseVProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch property.Name {
+		case "BEGIN":
+			component := &vComponent{Name: strings.ToUpper(property.Value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, component)
+			} else if root == nil {
+				root = component
+			} else {
+				return nil, errInvalidVObject
+			}
+			stack = append(stack, component)
+
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(property.Value) {
+				return nil, errInvalidVObject
+			}
+			stack = stack[:len(stack)-1]
+
+		default:
+			if len(stack) == 0 {
+				return nil, errInvalidVObject
+			}
+			component := stack[len(stack)-1]
+			component.Properties = append(component.Properties, property)
+		}
+	}
+
+	if root == nil || len(stack) > 0 {
+		return nil, errInvalidVObject
+	}
+	return root, nil
+}
+
+// parses one unfolded content line. Parameter values can be quoted, to have ; , or : in them.
+func parseVProperty(line string) (vProperty, error) {
+
+	ret := vProperty{Params: make(map[string][]string)}
+
+	quoted := false
+	separators := []int{}
+	colon := -1
+
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if quoted {
+			continue
+		}
+		if c == ';' {
+			separators = append(separators, i)
+		}
+		if c == ':' {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return ret, errInvalidVObject
+	}
+
+	ret.Value = line[colon+1:]
+	separators = append(separators, colon)
+
+	// vCards can group properties with a prefix, like "item1.EMAIL", which doesn't change what they are.
+	name := line[:separators[0]]
+	name = name[strings.LastIndex(name, ".")+1:]
+	ret.Name = strings.ToUpper(name)
+	if ret.Name == "" {
+		return ret, errInvalidVObject
+	}
+
+	for i := 0; i < len(separators) - 1; i++ {
+
+		param := line[separators[i]+1 : separators[i+1]]
+		equals := strings.Index(param, "=")
+		if equals < 0 {
+			// vCard 2.1 allows a bare type, like "TEL;CELL:".
+			ret.Params["TYPE"] = append(ret.Params["TYPE"], param)
+			continue
+		}
+
+		key := strings.ToUpper(param[:equals])
+		for _, value := range splitParamValues(param[equals+1:]) {
+			ret.Params[key] = append(ret.Params[key], value)
+		}
+	}
+	return ret, nil
+}
+
+func splitParamValues(values string) []string {
+
+	var ret []string
+	quoted := false
+	start := 0
+
+	for i, c := range values {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if c == ',' && !quoted {
+			ret = append(ret, strings.Trim(values[start:i], `"`))
+			start = i + 1
+		}
+	}
+	return append(ret, strings.Trim(values[start:], `"`))
+}
+
+func (this *vComponent) property(name string) (vProperty, bool) {
+
+	for _, property := range this.Properties {
+		if property.Name == name {
+			return property, true
+		}
+	}
+	return vProperty{}, false
+}
+
+func (this *vComponent) properties(name string) []vProperty {
+
+	var ret []vProperty
+	for _, property := range this.Properties {
+		if property.Name == name {
+			ret = append(ret, property)
+		}
+	}
+	return ret
+}
+
+//
+
+/*
+	Parses a DATE or DATE-TIME value, in UTC (ending in Z), in the timezone given by its TZID,
+	or "floating" - which is taken to be UTC, since there's no telling where the client is.
+	Also returns whether it was just a date.
+*/
+func (this vProperty) time() (time.Time, bool, error) {
+	return parseICalTime(this.Value, this.location())
+}
+
+// the timezone named by a property's TZID, if it has one (and it's one Go knows of).
+func (this vProperty) location() *time.Location {
+
+	tzid, ok := this.Params["TZID"]
+	if ok && len(tzid) > 0 {
+		loaded, err := time.LoadLocation(strings.TrimPrefix(tzid[0], "/"))
+		if err == nil {
+			return loaded
+		}
+	}
+	return time.UTC
+}
+
+func parseICalTime(value string, location *time.Location) (time.Time, bool, error) {
+
+	value = strings.TrimSpace(value)
+	switch {
+	case len(value) == 8:
+		ret, err := time.ParseInLocation("20060102", value, location)
+		return ret, true, err
+	case strings.HasSuffix(value, "Z"):
+		ret, err := time.Parse("20060102T150405Z", value)
+		return ret, false, err
+	}
+	ret, err := time.ParseInLocation("20060102T150405", value, location)
+	return ret, false, err
+}
+
+// parses an iCalendar duration, like "PT1H30M", "P2D" or "-P1W".
+func parseICalDuration(value string) (time.Duration, error) {
+
+	value = strings.ToUpper(strings.TrimSpace(value))
+
+	sign := time.Duration(1)
+	if strings.HasPrefix(value, "-") {
+		sign = -1
+	}
+	value = strings.TrimLeft(value, "+-")
+
+	if !strings.HasPrefix(value, "P") || len(value) < 3 {
+		return 0, errInvalidVObject
+	}
+
+	var ret time.Duration
+	number := ""
+	inTime := false
+
+	for _, c := range value[1:] {
+
+		if c >= '0' && c <= '9' {
+			number += string(c)
+			continue
+		}
+		if c == 'T' {
+			inTime = true
+			continue
+		}
+
+		count, err := strconv.Atoi(number)
+		if err != nil {
+			return 0, errInvalidVObject
+		}
+		number = ""
+
+		switch {
+		case c == 'W' && !inTime: ret += time.Duration(count) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime: ret += time.Duration(count) * 24 * time.Hour
+		case c == 'H' && inTime: ret += time.Duration(count) * time.Hour
+		case c == 'M' && inTime: ret += time.Duration(count) * time.Minute
+		case c == 'S' && inTime: ret += time.Duration(count) * time.Second
+		default: return 0, errInvalidVObject
+		}
+	}
+	if number != "" {
+		return 0, errInvalidVObject
+	}
+	return sign * ret, nil
+}
+
+//
+
+// one occurrence of an event, to-do or journal entry. Zero-length periods are instants, like a to-do that's only due.
+type vPeriod struct {
+	start time.Time
+	end time.Time
+}
+
+func (this vPeriod) overlaps(start time.Time, end time.Time) bool {
+
+	if this.start.Equal(this.end) {
+		return !this.start.Before(start) && this.start.Before(end)
+	}
+	return this.start.Before(end) && this.end.After(start)
+}
+
+/*
+	The first occurrence of a component - when it starts, and when it ends.
+	Returns false for components that don't have a time at all, like a to-do with no dates.
+*/
+func (this *vComponent) period() (vPeriod, bool) {
+
+	dtstart, hasStart := this.property("DTSTART")
+	if !hasStart {
+		// to-dos can just be due.
+		due, ok := this.property("DUE")
+		if !ok {
+			return vPeriod{}, false
+		}
+		at, _, err := due.time()
+		return vPeriod{start: at, end: at}, err == nil
+	}
+
+	start, allDay, err := dtstart.time()
+	if err != nil {
+		return vPeriod{}, false
+	}
+
+	for _, name := range []string{"DTEND", "DUE"} {
+		property, ok := this.property(name)
+		if ok {
+			end, _, err := property.time()
+			if err == nil && !end.Before(start) {
+				return vPeriod{start: start, end: end}, true
+			}
+		}
+	}
+
+	duration, ok := this.property("DURATION")
+	if ok {
+		length, err := parseICalDuration(duration.Value)
+		if err == nil && length >= 0 {
+			return vPeriod{start: start, end: start.Add(length)}, true
+		}
+	}
+
+	// an all-day event lasts the day.
+	if allDay && this.Name == "VEVENT" {
+		return vPeriod{start: start, end: start.AddDate(0, 0, 1)}, true
+	}
+	return vPeriod{start: start, end: start}, true
+}
+
+/*
+	Every occurrence of a component between [start] and [end].
+
+	Recurrences are expanded for the common rules - daily, weekly (on any days), monthly and yearly, with an interval,
+	count or end - along with any RDATEs and EXDATEs. For anything more complicated, false is returned,
+	along with just the first occurrence; the component might (or might not) happen again at any time after that.
+*/
+func (this *vComponent) occurrences(start time.Time, end time.Time) ([]vPeriod, bool) {
+
+	first, ok := this.period()
+	if !ok {
+		return nil, true
+	}
+	length := first.end.Sub(first.start)
+
+	var ret []vPeriod
+	add := func(at time.Time) {
+		occurrence := vPeriod{start: at, end: at.Add(length)}
+		if occurrence.overlaps(start, end) {
+			ret = append(ret, occurrence)
+		}
+	}
+
+	excluded := make(map[int64]bool)
+	for _, exdate := range this.properties("EXDATE") {
+		for _, value := range strings.Split(exdate.Value, ",") {
+			at, _, err := parseICalTime(value, exdate.location())
+			if err == nil {
+				excluded[at.Unix()] = true
+			}
+		}
+	}
+
+	for _, rdate := range this.properties("RDATE") {
+		for _, value := range strings.Split(rdate.Value, ",") {
+			// periods ("start/end") are rare enough to just take the start of.
+			value = strings.SplitN(value, "/", 2)[0]
+			at, _, err := parseICalTime(value, rdate.location())
+			if err == nil && !excluded[at.Unix()] {
+				add(at)
+			}
+		}
+	}
+
+	rrule, ok := this.property("RRULE")
+	if !ok {
+		if !excluded[first.start.Unix()] {
+			add(first.start)
+		}
+		return ret, true
+	}
+
+	rule, ok := parseRecurrenceRule(rrule.Value)
+	if !ok {
+		add(first.start)
+		return ret, false
+	}
+
+	count := 0
+	for period := 0; count < maxRecurrences; period++ {
+
+		days := rule.expand(rule.advance(first.start, period * rule.interval))
+		if len(days) == 0 || !days[0].Before(end) {
+			break
+		}
+
+		for _, at := range days {
+
+			if at.Before(first.start) {
+				continue
+			}
+			if (rule.count > 0 && count >= rule.count) || (!rule.until.IsZero() && at.After(rule.until)) || !at.Before(end) {
+				return ret, true
+			}
+
+			count++
+			if !excluded[at.Unix()] {
+				add(at)
+			}
+		}
+	}
+	return ret, true
+}
+
+// the parts of an RRULE that boji knows how to follow.
+type recurrenceRule struct {
+	frequency string
+	interval int
+	count int
+	until time.Time
+	weekdays []time.Weekday
+}
+
+var icalWeekdays = map[string]time.Weekday {
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+/*
+	Parses an RRULE, like "FREQ=WEEKLY;BYDAY=MO,WE;COUNT=10".
+	Returns false for rules that use anything beyond the frequency, interval, count, end, and (for weekly rules) days of the week.
+*/
+func parseRecurrenceRule(value string) (recurrenceRule, bool) {
+
+	ret := recurrenceRule{interval: 1}
+
+	for _, part := range strings.Split(value, ";") {
+
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return ret, false
+		}
+
+		var err error
+		switch strings.ToUpper(pair[0]) {
+		case "FREQ":
+			ret.frequency = strings.ToUpper(pair[1])
+		case "INTERVAL":
+			ret.interval, err = strconv.Atoi(pair[1])
+			if ret.interval < 1 {
+				return ret, false
+			}
+		case "COUNT":
+			ret.count, err = strconv.Atoi(pair[1])
+		case "UNTIL":
+			ret.until, _, err = parseICalTime(pair[1], time.UTC)
+		case "BYDAY":
+			for _, day := range strings.Split(strings.ToUpper(pair[1]), ",") {
+				weekday, ok := icalWeekdays[day]
+				if !ok {
+					// days with an ordinal, like "2MO", need BYSETPOS-style counting; not followed.
+					return ret, false
+				}
+				ret.weekdays = append(ret.weekdays, weekday)
+			}
+		case "WKST":
+		default:
+			return ret, false
+		}
+		if err != nil {
+			return ret, false
+		}
+	}
+
+	switch ret.frequency {
+	case "DAILY", "MONTHLY", "YEARLY":
+		return ret, len(ret.weekdays) == 0
+	case "WEEKLY":
+		return ret, true
+	}
+	return ret, false
+}
+
+// the start of the [n]th period after the first.
+func (this recurrenceRule) advance(first time.Time, n int) time.Time {
+
+	switch this.frequency {
+	case "DAILY": return first.AddDate(0, 0, n)
+	case "WEEKLY": return first.AddDate(0, 0, 7 * n)
+	case "MONTHLY": return first.AddDate(0, n, 0)
+	}
+	return first.AddDate(n, 0, 0)
+}
+
+// the occurrences within the period starting at [base], in order.
+func (this recurrenceRule) expand(base time.Time) []time.Time {
+
+	if len(this.weekdays) == 0 {
+		return []time.Time{base}
+	}
+
+	// weeks start on Monday, unless WKST says otherwise - which only matters for intervals over one, and is ignored.
+	monday := base.AddDate(0, 0, -((int(base.Weekday()) + 6) % 7))
+
+	var ret []time.Time
+	for offset := 0; offset < 7; offset++ {
+		day := monday.AddDate(0, 0, offset)
+		for _, weekday := range this.weekdays {
+			if day.Weekday() == weekday {
+				ret = append(ret, day)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,348 @@
+package boji
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"path"
+	"strings"
+	"io/ioutil"
+)
+
+/*
+	Notices changes made directly on disk - by hand, by rsync, by anything other than boji - so that nothing boji
+	remembers about a file (checksums, quota usage) goes stale, and so they can be published as change events too.
+
+	Every directory is watched with inotify where that's available, and rescanned shortly after anything in it changes.
+	Elsewhere, or once the kernel runs out of watches, the whole tree is rescanned periodically instead.
+	Each rescan is compared against what was last seen, so only what's actually different is reported.
+
+	boji's own changes are all published to the change feed, and the watcher takes each of those as the new normal
+	rather than reporting them again. Anything boji is part-way through writing isn't reported at all.
+*/
+type diskWatcher struct {
+	root string
+	fs archivableFS
+	interval time.Duration
+	notify func()
+
+	notifier *dirNotifier
+	known map[string]map[string]watchedEntry
+	dirty map[string]time.Time
+	rescanAll bool
+	stop chan bool
+	mutex sync.Mutex
+}
+
+// what a directory entry was like, when it was last seen.
+type watchedEntry struct {
+	size int64
+	modTime time.Time
+	dir bool
+}
+
+func newDiskWatcher(fs archivableFS, interval time.Duration, notify func()) *diskWatcher {
+
+	if interval <= 0 {
+		return nil
+	}
+
+	return &diskWatcher {
+		root: fs.path,
+		fs: fs,
+		interval: interval,
+		notify: notify,
+		known: make(map[string]map[string]watchedEntry),
+		dirty: make(map[string]time.Time),
+		stop: make(chan bool),
+	}
+}
+
+func (this *diskWatcher) run() {
+
+	if this == nil {
+		return
+	}
+
+	notifier, err := newDirNotifier(this.changed, this.overflowed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to watch for changes on disk (%v), will scan for them every %v instead\n", err, this.interval)
+	}
+	this.notifier = notifier
+
+	cursor := this.fs.changes.cursor()
+	_, events, _ := this.fs.changes.subscribe(cursor)
+
+	// the first scan only learns what's there.
+	this.rescanTree("/", false)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastScan := time.Now()
+
+	for {
+		select {
+		case <-this.stop:
+			this.fs.changes.unsubscribe(events)
+			this.notifier.Close()
+			return
+
+		case event, open := <-events:
+			if !open {
+				// fell behind boji's own changes; catch up on whatever's still held, and carry on.
+				var missed []changeEvent
+				missed, events, _ = this.fs.changes.subscribe(cursor)
+				for _, event := range missed {
+					this.absorb(event)
+					cursor = event.ID
+				}
+				continue
+			}
+			this.absorb(event)
+			cursor = event.ID
+
+		case <-ticker.C:
+			if this.notifier == nil && time.Since(lastScan) >= this.interval {
+				this.rescanTree("/", true)
+				lastScan = time.Now()
+				continue
+			}
+			this.rescanDirty()
+		}
+	}
+}
+
+func (this *diskWatcher) Close() {
+
+	if this == nil {
+		return
+	}
+	this.stop <- true
+}
+
+// called by the notifier whenever something in [dir] changes.
+func (this *diskWatcher) changed(dir string) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	_, ok := this.dirty[dir]
+	if !ok {
+		this.dirty[dir] = time.Now()
+	}
+}
+
+// called by the notifier if the kernel dropped events, in which case anything might have changed.
+func (this *diskWatcher) overflowed() {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.rescanAll = true
+}
+
+/*
+	Rescans every directory that's been changed, once it's been left alone for a moment -
+	which lets boji publish its own changes first, and lets a burst of changes (like an rsync) settle.
+*/
+func (this *diskWatcher) rescanDirty() {
+
+	var dirs []string
+
+	this.mutex.Lock()
+	rescanAll := this.rescanAll
+	this.rescanAll = false
+
+	for dir, since := range this.dirty {
+		if time.Since(since) >= time.Second {
+			dirs = append(dirs, dir)
+			delete(this.dirty, dir)
+		}
+	}
+	this.mutex.Unlock()
+
+	if rescanAll {
+		this.rescanTree("/", true)
+		return
+	}
+	for _, dir := range dirs {
+		this.rescanDir(dir, true)
+	}
+}
+
+/*
+	Takes one of boji's own changes as the way things are now, so it isn't reported as an external change.
+*/
+func (this *diskWatcher) absorb(event changeEvent) {
+
+	if event.External {
+		return
+	}
+
+	for _, name := range []string{event.Path, event.Destination} {
+
+		if name == "" {
+			continue
+		}
+
+		this.rescanDir(path.Dir(name), false)
+		if event.Directory {
+			this.rescanTree(name, false)
+		}
+	}
+}
+
+// rescans a directory, and everything in any new subdirectories.
+func (this *diskWatcher) rescanDir(dir string, report bool) {
+
+	for _, created := range this.rescan(dir, report) {
+		this.rescanTree(created, report)
+	}
+}
+
+func (this *diskWatcher) rescanTree(dir string, report bool) {
+
+	this.rescan(dir, report)
+
+	for name, entry := range this.known[dir] {
+		if entry.dir {
+			this.rescanTree(path.Join(dir, name), report)
+		}
+	}
+}
+
+/*
+	Compares what's in a directory now to what was in it last time, reporting (if asked to) every difference.
+	Gone subdirectories are forgotten in full, and new ones are returned - but not scanned.
+*/
+func (this *diskWatcher) rescan(dir string, report bool) []string {
+
+	dir = slashClean(dir)
+
+	// watched before listed, so that nothing can change unnoticed in between.
+	_, seen := this.known[dir]
+	if !seen {
+		this.watch(dir)
+	}
+
+	children, err := ioutil.ReadDir(resolve(this.root, dir))
+	if err != nil {
+		// the directory's gone; its parent will report that.
+		this.forget(dir)
+		return nil
+	}
+
+	previous := this.known[dir]
+	current := make(map[string]watchedEntry)
+	var created []string
+
+	for _, child := range children {
+
+		// temporary files belong to whatever's writing them.
+		if strings.HasSuffix(child.Name(), "~") || (!child.IsDir() && !child.Mode().IsRegular()) {
+			continue
+		}
+
+		name := path.Join(dir, child.Name())
+		entry := watchedEntry {
+			size: child.Size(),
+			modTime: child.ModTime(),
+			dir: child.IsDir(),
+		}
+		current[child.Name()] = entry
+
+		old, existed := previous[child.Name()]
+		switch {
+		case existed && old.dir != entry.dir:
+			if old.dir {
+				this.forget(name)
+			}
+			this.report(report, "delete", name, old.dir)
+			this.report(report, "create", name, entry.dir)
+		case !existed:
+			this.report(report, "create", name, entry.dir)
+		case !entry.dir && (old.size != entry.size || !old.modTime.Equal(entry.modTime)):
+			this.report(report, "modify", name, false)
+		}
+
+		if entry.dir && (!existed || !old.dir) {
+			created = append(created, name)
+		}
+	}
+
+	for childName, old := range previous {
+
+		_, exists := current[childName]
+		if exists {
+			continue
+		}
+
+		name := path.Join(dir, childName)
+		if old.dir {
+			this.forget(name)
+		}
+		this.report(report, "delete", name, old.dir)
+	}
+
+	this.known[dir] = current
+	return created
+}
+
+// stops remembering anything about a directory and everything beneath it.
+func (this *diskWatcher) forget(dir string) {
+
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for known := range this.known {
+		if known == dir || strings.HasPrefix(known, prefix) {
+			delete(this.known, known)
+		}
+	}
+}
+
+func (this *diskWatcher) watch(dir string) {
+
+	if this.notifier == nil {
+		return
+	}
+
+	err := this.notifier.add(dir, resolve(this.root, dir))
+	if err == nil || os.IsNotExist(err) {
+		return
+	}
+
+	// almost always the kernel's limit on watches (fs.inotify.max_user_watches). Scanning always works.
+	fmt.Fprintf(os.Stderr, "Unable to watch '%s' for changes (%v), will scan for them every %v instead\n", dir, err, this.interval)
+	this.notifier.Close()
+	this.notifier = nil
+}
+
+/*
+	Reports a change to an on-disk name, under the name it's served as - so archives are reported as
+	a change to the directory they're in, and encrypted files are reported without their extension.
+*/
+func (this *diskWatcher) report(report bool, kind string, rawName string, dir bool) {
+
+	name := rawName
+	if !dir && path.Base(rawName) == "archive.zip" {
+		name = path.Dir(rawName)
+		kind = "modify"
+		dir = true
+	}
+	name = strings.TrimSuffix(name, encryptedExtension)
+
+	if !report || this.fs.changes.isWriting(name) {
+		return
+	}
+
+	if kind == "delete" {
+		this.fs.digests.remove(this.fs.resolve(name))
+	} else {
+		this.fs.digests.invalidate(this.fs.resolve(name))
+	}
+	this.fs.quotas.invalidate(name)
+	this.fs.changes.publishExternal(kind, name, dir)
+
+	if this.notify != nil {
+		this.notify()
+	}
+}
@@ -0,0 +1,528 @@
+package boji
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"sort"
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+	"net/url"
+	"net/http"
+	"io/ioutil"
+	"path/filepath"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+const webhooksPrefix = "/_webhooks/"
+const webhookMaxAttempts = 12
+
+/*
+	Calls out to other services whenever something matching one of their hooks changes.
+
+	Every change event (see changeFeed) is matched against each hook's glob and event types, and a delivery for each match
+	is written to an outbox in the state dir before anything is sent - so nothing is lost to a restart, or to the other
+	end being down. Deliveries are POSTed as JSON, signed with the hook's secret, and retried with a backoff until they
+	succeed or have been tried too many times. Each hook gets its events in order; one failing holds up only its own.
+*/
+type webhookDispatcher struct {
+	path string
+	outbox string
+	feed *changeFeed
+	stats *telemetryStats
+
+	client *http.Client
+	hooks map[string]webhook
+	poke chan bool
+	stop chan bool
+	mutex sync.Mutex
+}
+
+type webhook struct {
+	ID string `json:"id"`
+	URL string `json:"url"`
+	Glob string `json:"glob,omitempty"`
+	Events []string `json:"events,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// a single event, waiting in the outbox to be sent to a single hook.
+type webhookDelivery struct {
+	Hook string `json:"hook"`
+	Event changeEvent `json:"event"`
+	Attempts int `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+func newWebhookDispatcher(stateDir string, feed *changeFeed, stats *telemetryStats) (*webhookDispatcher, error) {
+
+	ret := &webhookDispatcher {
+		path: filepath.Join(stateDir, "webhooks.json"),
+		outbox: filepath.Join(stateDir, "webhooks"),
+		feed: feed,
+		stats: stats,
+		client: &http.Client{Timeout: 30 * time.Second},
+		hooks: make(map[string]webhook),
+		poke: make(chan bool, 1),
+		stop: make(chan bool),
+	}
+
+	encoded, err := ioutil.ReadFile(ret.path)
+	if os.IsNotExist(err) {
+		return ret, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []webhook
+	err = json.Unmarshal(encoded, &hooks)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read webhooks from '%s': %v", ret.path, err)
+	}
+
+	for _, hook := range hooks {
+		ret.hooks[hook.ID] = hook
+	}
+	return ret, nil
+}
+
+/*
+	Queues and sends deliveries until stopped.
+*/
+func (this *webhookDispatcher) run() {
+
+	go this.listen()
+
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		this.deliver()
+
+		select {
+		case <-this.stop:
+			return
+		case <-this.poke:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (this *webhookDispatcher) Close() {
+	close(this.stop)
+}
+
+// puts every event that matches a hook into the outbox, resubscribing whenever it falls behind the feed.
+func (this *webhookDispatcher) listen() {
+
+	cursor := this.feed.cursor()
+	for {
+		missed, events, ok := this.feed.subscribe(cursor)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Webhooks fell too far behind, and some events were not delivered\n")
+		}
+
+		for _, event := range missed {
+			this.enqueue(event)
+			cursor = event.ID
+		}
+
+		for open := true; open; {
+			select {
+			case <-this.stop:
+				this.feed.unsubscribe(events)
+				return
+			case event, more := <-events:
+				open = more
+				if more {
+					this.enqueue(event)
+					cursor = event.ID
+				}
+			}
+		}
+	}
+}
+
+func (this *webhookDispatcher) enqueue(event changeEvent) {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	queued := false
+	for _, hook := range this.hooks {
+
+		if !hook.matches(event) {
+			continue
+		}
+
+		delivery := webhookDelivery {
+			Hook: hook.ID,
+			Event: event,
+			NextAttempt: time.Now(),
+		}
+
+		err := this.save(fmt.Sprintf("%020d-%s.json", event.ID, hook.ID), delivery)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to queue webhook delivery to '%s': %v\n", hook.URL, err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case this.poke <- true:
+		default:
+		}
+	}
+}
+
+/*
+	Sends everything in the outbox that's due, oldest first.
+*/
+func (this *webhookDispatcher) deliver() {
+
+	children, err := ioutil.ReadDir(this.outbox)
+	if err != nil {
+		return
+	}
+
+	names := make([]string, 0, len(children))
+	for _, child := range children {
+		if strings.HasSuffix(child.Name(), ".json") {
+			names = append(names, child.Name())
+		}
+	}
+	sort.Strings(names)
+
+	// a hook that's failing gets nothing newer until it's had what it missed.
+	blocked := make(map[string]bool)
+
+	for _, name := range names {
+
+		deliveryPath := filepath.Join(this.outbox, name)
+
+		var delivery webhookDelivery
+		encoded, err := ioutil.ReadFile(deliveryPath)
+		if err == nil {
+			err = json.Unmarshal(encoded, &delivery)
+		}
+		if err != nil {
+			os.Remove(deliveryPath)
+			continue
+		}
+
+		this.mutex.Lock()
+		hook, ok := this.hooks[delivery.Hook]
+		this.mutex.Unlock()
+
+		if !ok {
+			os.Remove(deliveryPath)
+			continue
+		}
+		if blocked[hook.ID] || time.Now().Before(delivery.NextAttempt) {
+			blocked[hook.ID] = true
+			continue
+		}
+
+		err = this.send(hook, name, delivery.Event)
+		if err == nil {
+			this.stats.webhooksDelivered++
+			os.Remove(deliveryPath)
+			continue
+		}
+
+		this.stats.webhookFailures++
+		blocked[hook.ID] = true
+		delivery.Attempts++
+
+		if delivery.Attempts >= webhookMaxAttempts {
+			fmt.Fprintf(os.Stderr, "Giving up on webhook delivery to '%s' after %d attempts: %v\n", hook.URL, delivery.Attempts, err)
+			os.Remove(deliveryPath)
+			continue
+		}
+
+		backoff := (10 * time.Second) << uint(delivery.Attempts - 1)
+		if backoff > time.Hour {
+			backoff = time.Hour
+		}
+		delivery.NextAttempt = time.Now().Add(backoff)
+
+		this.mutex.Lock()
+		this.save(name, delivery)
+		this.mutex.Unlock()
+	}
+}
+
+func (this *webhookDispatcher) send(hook webhook, deliveryID string, event changeEvent) error {
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "boji")
+	request.Header.Set("X-Boji-Event", event.Type)
+	request.Header.Set("X-Boji-Delivery", strings.TrimSuffix(deliveryID, ".json"))
+
+	if hook.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(hook.Secret))
+		mac.Write(body)
+		request.Header.Set("X-Boji-Signature", "sha256=" + hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := this.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned %s", response.Status)
+	}
+	return nil
+}
+
+// writes a delivery into the outbox. Caller must hold the mutex.
+func (this *webhookDispatcher) save(name string, delivery webhookDelivery) error {
+
+	err := os.MkdirAll(this.outbox, 0700)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	deliveryPath := filepath.Join(this.outbox, name)
+	tempPath := deliveryPath + "~"
+
+	err = ioutil.WriteFile(tempPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, deliveryPath)
+}
+
+func (this *webhookDispatcher) add(hook webhook) (webhook, error) {
+
+	target, err := url.Parse(hook.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return hook, errors.New("A webhook needs an http(s) url")
+	}
+
+	_, err = globPattern(hook.Glob)
+	if err != nil {
+		return hook, err
+	}
+
+	for _, kind := range hook.Events {
+		if !isChangeEventType(kind) {
+			return hook, fmt.Errorf("Unknown event type '%s'", kind)
+		}
+	}
+
+	hook.ID, err = newTrashID()
+	if err != nil {
+		return hook, err
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.hooks[hook.ID] = hook
+	return hook, this.persist()
+}
+
+func (this *webhookDispatcher) remove(id string) error {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	_, ok := this.hooks[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	delete(this.hooks, id)
+	return this.persist()
+}
+
+// every hook, oldest first, without their secrets.
+func (this *webhookDispatcher) list() []webhook {
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	ret := make([]webhook, 0, len(this.hooks))
+	for _, hook := range this.hooks {
+		if hook.Secret != "" {
+			hook.Secret = "********"
+		}
+		ret = append(ret, hook)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].URL < ret[j].URL
+	})
+	return ret
+}
+
+// Caller must hold the mutex.
+func (this *webhookDispatcher) persist() error {
+
+	hooks := make([]webhook, 0, len(this.hooks))
+	for _, hook := range this.hooks {
+		hooks = append(hooks, hook)
+	}
+
+	encoded, err := json.MarshalIndent(hooks, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tempPath := this.path + "~"
+	err = ioutil.WriteFile(tempPath, encoded, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, this.path)
+}
+
+/*
+	Returns true if the hook wants to hear about this event. Moves match on either end.
+*/
+func (this webhook) matches(event changeEvent) bool {
+
+	if len(this.Events) > 0 {
+		wanted := false
+		for _, kind := range this.Events {
+			wanted = wanted || kind == event.Type
+		}
+		if !wanted {
+			return false
+		}
+	}
+
+	if this.Glob == "" {
+		return true
+	}
+
+	pattern, err := globPattern(this.Glob)
+	if err != nil {
+		return false
+	}
+	return pattern.MatchString(event.Path) || (event.Destination != "" && pattern.MatchString(event.Destination))
+}
+
+/*
+	Turns a glob into a regexp. `*` and `?` match within a single path segment, `**` matches across any number of them,
+	so `/photos/**.jpg` matches every jpeg anywhere beneath /photos.
+*/
+func globPattern(glob string) (*regexp.Regexp, error) {
+
+	var expression strings.Builder
+	expression.WriteString("^")
+
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			expression.WriteString("[^/]*")
+		case glob[i] == '?':
+			expression.WriteString("[^/]")
+		default:
+			expression.WriteString(regexp.QuoteMeta(glob[i:i+1]))
+		}
+	}
+
+	expression.WriteString("$")
+	return regexp.Compile(expression.String())
+}
+
+func isChangeEventType(kind string) bool {
+
+	switch kind {
+	case "create", "modify", "delete", "move", "compress", "uncompress", "encrypt", "decrypt":
+		return true
+	}
+	return false
+}
+
+//
+
+/*
+	Manages webhooks, returning true if this was a request to.
+		`GET /_webhooks/` lists every hook (without secrets).
+		`POST /_webhooks/` with a JSON body of `{"url", "glob", "events", "secret"}` adds a hook, and gives back its ID.
+		`DELETE /_webhooks/<id>` removes one.
+	Only the admin can manage them, since a hook hears about everyone's files, and has boji send requests wherever it points.
+*/
+func (this *Server) attemptWebhookRequest(w http.ResponseWriter, r *http.Request) bool {
+
+	if !isReservedPath(this.Settings.Root, r.URL.Path, webhooksPrefix) {
+		return false
+	}
+	if requestUsername(r) != this.Settings.AdminUsername {
+		http.Error(w, "Only the admin can manage webhooks", http.StatusForbidden)
+		return true
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path + "/", webhooksPrefix), "/")
+
+	switch {
+	case r.Method == "GET" && id == "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(this.webhooks.list())
+
+	case r.Method == "POST" && id == "":
+		var hook webhook
+
+		err := json.NewDecoder(r.Body).Decode(&hook)
+		if err == nil {
+			hook, err = this.webhooks.add(hook)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return true
+		}
+
+		hook.Secret = ""
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", webhooksPrefix + hook.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hook)
+
+	case r.Method == "DELETE" && id != "":
+		err := this.webhooks.remove(id)
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusNoContent)
+		case os.IsNotExist(err):
+			http.NotFound(w, r)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+	return true
+}
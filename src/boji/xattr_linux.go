@@ -0,0 +1,28 @@
+package boji
+
+import (
+	"syscall"
+)
+
+func getXattr(path string, name string) ([]byte, error) {
+
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+func setXattr(path string, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
+
+func removeXattr(path string, name string) error {
+	return syscall.Removexattr(path, name)
+}
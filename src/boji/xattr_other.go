@@ -0,0 +1,22 @@
+// +build !linux
+
+package boji
+
+import (
+	"errors"
+)
+
+var errXattrUnsupported = errors.New("xattrs are not supported on this platform")
+
+// xattrs aren't portable, everywhere else just uses sidecar files.
+func getXattr(path string, name string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+func setXattr(path string, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func removeXattr(path string, name string) error {
+	return errXattrUnsupported
+}
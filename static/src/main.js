@@ -1,4 +1,461 @@
+/*
+    A file browser for boji, built on the same webdav calls (and POST query endpoints) any other client uses.
+    Nothing is fetched from anywhere but boji itself, so it works without internet access.
+
+    Credentials (and the encryption key, if one's given) are kept for this browser tab only,
+    and sent with every request. Without them, whatever the browser already logged in with is used.
+*/
+
+var state = {
+    path: "/",
+    auth: null,
+    hasKey: false,
+};
+
 function main()
-{}
+{
+    state.auth = sessionStorage.getItem("boji-auth");
+    state.hasKey = sessionStorage.getItem("boji-key") === "true";
+    state.path = currentPath();
+
+    byID("newFolder").onclick = newFolder;
+    byID("upload").onclick = function() { byID("files").click(); };
+    byID("files").onchange = function() { upload(this.files); this.value = ""; };
+    byID("compress").onclick = function() { runJob("compress=true", "Compressing"); };
+    byID("uncompress").onclick = function() { runJob("compress=false", "Uncompressing"); };
+    byID("encrypt").onclick = function() { runKeyedJob("encrypt=true", "Encrypting"); };
+    byID("decrypt").onclick = function() { runKeyedJob("encrypt=false", "Decrypting"); };
+    byID("login").onclick = showLogin;
+    byID("loginForm").onsubmit = login;
+
+    var listing = byID("listing");
+    listing.ondragover = function(event) { event.preventDefault(); listing.classList.add("dropping"); };
+    listing.ondragleave = function() { listing.classList.remove("dropping"); };
+    listing.ondrop = function(event)
+    {
+        event.preventDefault();
+        listing.classList.remove("dropping");
+        upload(event.dataTransfer.files);
+    };
+
+    window.onhashchange = function() { state.path = currentPath(); refresh(); };
+    window.onpopstate = window.onhashchange;
+
+    refresh();
+}
+
+//
+
+// the directory being looked at; from the hash under /_ui/, otherwise from wherever boji served the UI.
+function currentPath()
+{
+    var path = decodeURIComponent(isUIPath() ? location.hash.substring(1) : location.pathname);
+    if (path === "")
+    {
+        path = "/";
+    }
+    if (path.charAt(path.length - 1) !== "/")
+    {
+        path += "/";
+    }
+    return path;
+}
+
+function isUIPath()
+{
+    return location.pathname.indexOf("/_ui/") === 0;
+}
+
+function navigate(path)
+{
+    if (isUIPath())
+    {
+        location.hash = path;
+        return;
+    }
+
+    history.pushState(null, "", encodePath(path));
+    state.path = path;
+    refresh();
+}
+
+function refresh()
+{
+    list(state.path).then(render).catch(showError);
+}
+
+//
+
+function request(method, path, headers, body)
+{
+    headers = headers || {};
+    headers["X-Requested-With"] = "XMLHttpRequest";
+    if (state.auth)
+    {
+        headers["Authorization"] = "Basic " + state.auth;
+    }
+
+    return fetch(encodePath(path), {
+        method: method,
+        headers: headers,
+        body: body,
+        credentials: "same-origin",
+    }).then(function(response)
+    {
+        if (response.status === 401)
+        {
+            showLogin();
+            throw new Error("Please log in");
+        }
+        if (!response.ok && response.status !== 207)
+        {
+            return response.text().then(function(text)
+            {
+                throw new Error(text.trim() || response.statusText);
+            });
+        }
+        return response;
+    });
+}
+
+var propfindBody = '<?xml version="1.0" encoding="utf-8"?>' +
+    '<D:propfind xmlns:D="DAV:"><D:prop>' +
+    '<D:resourcetype/><D:getcontentlength/><D:getlastmodified/>' +
+    '</D:prop></D:propfind>';
+
+function list(path)
+{
+    return request("PROPFIND", path, {"Depth": "1", "Content-Type": "application/xml"}, propfindBody)
+        .then(function(response) { return response.text(); })
+        .then(function(text)
+        {
+            var doc = new DOMParser().parseFromString(text, "application/xml");
+            var entries = [];
+
+            var responses = doc.getElementsByTagNameNS("DAV:", "response");
+            for (var i = 0; i < responses.length; i++)
+            {
+                var href = decodeURIComponent(first(responses[i], "href").textContent);
+                var entryPath = href.replace(/\/$/, "");
+
+                // the directory itself is in there too.
+                if (entryPath + "/" === path || entryPath === path || entryPath === "")
+                {
+                    continue;
+                }
+
+                var length = first(responses[i], "getcontentlength");
+                var modified = first(responses[i], "getlastmodified");
+
+                entries.push({
+                    name: entryPath.substring(entryPath.lastIndexOf("/") + 1),
+                    directory: first(responses[i], "collection") !== null,
+                    size: length ? parseInt(length.textContent, 10) : 0,
+                    modified: modified ? new Date(modified.textContent) : null,
+                });
+            }
+
+            entries.sort(function(a, b)
+            {
+                if (a.directory !== b.directory)
+                {
+                    return a.directory ? -1 : 1;
+                }
+                return a.name.localeCompare(b.name);
+            });
+            return entries;
+        });
+}
+
+function first(element, name)
+{
+    var found = element.getElementsByTagNameNS("DAV:", name);
+    return found.length > 0 ? found[0] : null;
+}
+
+//
+
+function render(entries)
+{
+    renderCrumbs();
+
+    var body = byID("entries");
+    body.innerHTML = "";
+
+    if (state.path !== "/")
+    {
+        var parent = state.path.replace(/[^\/]+\/$/, "");
+        body.appendChild(row(link("..", function() { navigate(parent); }), "directory", "", ""));
+    }
+
+    entries.forEach(function(entry)
+    {
+        var path = state.path + entry.name;
+        var name;
+
+        if (entry.directory)
+        {
+            name = link(entry.name + "/", function() { navigate(path + "/"); });
+        }
+        else
+        {
+            name = link(entry.name, function() { download(path, entry.name); });
+        }
+
+        var tr = row(name, entry.directory ? "directory" : "file",
+            entry.directory ? "" : formatSize(entry.size),
+            entry.modified ? entry.modified.toLocaleString() : "");
+
+        var actions = tr.lastChild;
+        actions.appendChild(button("Rename", function() { rename(path, entry.name, entry.directory); }));
+        actions.appendChild(button("Delete", function() { remove(path, entry.name, entry.directory); }));
+        body.appendChild(tr);
+    });
+
+    setStatus(entries.length + (entries.length === 1 ? " item" : " items") + (state.hasKey ? ", key given" : ""));
+}
+
+function renderCrumbs()
+{
+    var crumbs = byID("crumbs");
+    crumbs.innerHTML = "";
+    crumbs.appendChild(link("boji", function() { navigate("/"); }));
+
+    var path = "/";
+    state.path.split("/").filter(Boolean).forEach(function(part)
+    {
+        path += part + "/";
+        var target = path;
+
+        var separator = document.createElement("span");
+        separator.textContent = "/";
+        crumbs.appendChild(separator);
+        crumbs.appendChild(link(part, function() { navigate(target); }));
+    });
+}
+
+function row(name, kind, size, modified)
+{
+    var tr = document.createElement("tr");
+    [name, size, modified, ""].forEach(function(content, i)
+    {
+        var td = document.createElement("td");
+        td.className = ["name " + kind, "size", "modified", "row-actions"][i];
+        if (typeof content === "string")
+        {
+            td.textContent = content;
+        }
+        else
+        {
+            td.appendChild(content);
+        }
+        tr.appendChild(td);
+    });
+    return tr;
+}
+
+function link(text, onclick)
+{
+    var a = document.createElement("a");
+    a.href = "#";
+    a.textContent = text;
+    a.onclick = function(event) { event.preventDefault(); onclick(); };
+    return a;
+}
+
+function button(text, onclick)
+{
+    var b = document.createElement("button");
+    b.textContent = text;
+    b.onclick = onclick;
+    return b;
+}
+
+//
+
+function newFolder()
+{
+    var name = prompt("Folder name");
+    if (!name)
+    {
+        return;
+    }
+
+    request("MKCOL", state.path + name)
+        .then(refresh)
+        .catch(showError);
+}
+
+function upload(files)
+{
+    var queue = Array.prototype.slice.call(files);
+    var total = queue.length;
+
+    function next()
+    {
+        if (queue.length === 0)
+        {
+            refresh();
+            return;
+        }
+
+        var file = queue.shift();
+        setStatus("Uploading " + file.name + " (" + (total - queue.length) + " of " + total + ")");
+
+        var headers = {"X-OC-Mtime": String(Math.floor(file.lastModified / 1000))};
+        return request("PUT", state.path + file.name, headers, file)
+            .then(next)
+            .catch(function(error)
+            {
+                showError(error);
+                refresh();
+            });
+    }
+    next();
+}
+
+function download(path, name)
+{
+    setStatus("Downloading " + name);
+
+    request("GET", path)
+        .then(function(response) { return response.blob(); })
+        .then(function(blob)
+        {
+            var a = document.createElement("a");
+            a.href = URL.createObjectURL(blob);
+            a.download = name;
+            document.body.appendChild(a);
+            a.click();
+            a.remove();
+            setTimeout(function() { URL.revokeObjectURL(a.href); }, 60000);
+            setStatus("Downloaded " + name);
+        })
+        .catch(showError);
+}
+
+function rename(path, name, directory)
+{
+    var newName = prompt("Rename " + name + " to", name);
+    if (!newName || newName === name)
+    {
+        return;
+    }
+
+    var destination = location.origin + encodePath(state.path + newName + (directory ? "/" : ""));
+    request("MOVE", path + (directory ? "/" : ""), {"Destination": destination, "Overwrite": "F"})
+        .then(refresh)
+        .catch(showError);
+}
+
+function remove(path, name, directory)
+{
+    if (!confirm("Delete " + name + (directory ? " and everything in it" : "") + "?"))
+    {
+        return;
+    }
+
+    request("DELETE", path + (directory ? "/" : ""))
+        .then(refresh)
+        .catch(showError);
+}
+
+// compression, encryption, and their reverses, which all apply to the whole directory being looked at.
+function runJob(query, doing)
+{
+    setStatus(doing + " " + state.path);
+
+    request("POST", state.path + "?" + query)
+        .then(refresh)
+        .catch(showError);
+}
+
+function runKeyedJob(query, doing)
+{
+    if (!state.hasKey)
+    {
+        showError(new Error("Log in with an encryption key first"));
+        showLogin();
+        return;
+    }
+    runJob(query, doing);
+}
+
+//
+
+function showLogin()
+{
+    byID("loginForm").hidden = false;
+    byID("username").focus();
+}
+
+function login(event)
+{
+    event.preventDefault();
+
+    var credentials = byID("username").value + ":" + byID("password").value;
+    var key = byID("key").value;
+    if (key)
+    {
+        credentials += ":" + key;
+    }
+
+    // basic auth is base64 of utf-8, which btoa doesn't do by itself.
+    state.auth = btoa(unescape(encodeURIComponent(credentials)));
+    state.hasKey = key !== "";
+    sessionStorage.setItem("boji-auth", state.auth);
+    sessionStorage.setItem("boji-key", String(state.hasKey));
+
+    byID("password").value = "";
+    byID("key").value = "";
+    byID("loginForm").hidden = true;
+    refresh();
+}
+
+//
+
+function setStatus(text)
+{
+    var status = byID("status");
+    status.className = "";
+    status.textContent = text;
+}
+
+function showError(error)
+{
+    var status = byID("status");
+    status.className = "error";
+    status.textContent = error.message;
+}
+
+function formatSize(size)
+{
+    var units = ["B", "KB", "MB", "GB", "TB"];
+    var unit = 0;
+
+    while (size >= 1024 && unit < units.length - 1)
+    {
+        size /= 1024;
+        unit++;
+    }
+    return (unit === 0 ? size : size.toFixed(1)) + " " + units[unit];
+}
+
+function encodePath(path)
+{
+    var query = "";
+    var index = path.indexOf("?");
+    if (index >= 0)
+    {
+        query = path.substring(index);
+        path = path.substring(0, index);
+    }
+    return path.split("/").map(encodeURIComponent).join("/") + query;
+}
+
+function byID(id)
+{
+    return document.getElementById(id);
+}
 
-window.onload = main;
\ No newline at end of file
+window.onload = main;